@@ -0,0 +1,1735 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The admin command line replaces the bank operations of the old Lua console:
+//
+//	eco-nomic admin [-lang en|es] <db-filename> <command> [arguments...]
+type adminCommand struct {
+	name  string
+	usage string
+	help  map[string]string
+	run   func(b *Bank, lang string, args []string) error
+}
+
+var adminCommands []adminCommand
+
+func init() {
+	adminCommands = []adminCommand{
+		{"date", "", map[string]string{
+			LANG_ENGLISH: "print the current date",
+			LANG_SPANISH: "imprimir la fecha actual",
+		}, adminDate},
+		{"next", "", map[string]string{
+			LANG_ENGLISH: "advance to the next date",
+			LANG_SPANISH: "avanzar a la siguiente fecha",
+		}, adminNext},
+		{"rewind", "<date>", map[string]string{
+			LANG_ENGLISH: "go back to a past date, the later dates settle again when advancing",
+			LANG_SPANISH: "volver a una fecha pasada, las fechas posteriores se liquidan de nuevo al avanzar",
+		}, adminRewind},
+		{"pause", "", map[string]string{
+			LANG_ENGLISH: "pause the scheduled date advances of the server",
+			LANG_SPANISH: "pausar los avances de fecha programados del servidor",
+		}, adminPause},
+		{"resume", "", map[string]string{
+			LANG_ENGLISH: "resume the scheduled date advances of the server",
+			LANG_SPANISH: "reanudar los avances de fecha programados del servidor",
+		}, adminResume},
+		{"revoke", "<transaction>", map[string]string{
+			LANG_ENGLISH: "revoke a transaction",
+			LANG_SPANISH: "revocar una transacción",
+		}, adminRevoke},
+		{"create", "<holder> <password>", map[string]string{
+			LANG_ENGLISH: "create a new account",
+			LANG_SPANISH: "crear una nueva cuenta",
+		}, adminCreate},
+		{"deposit", "<account> <amount> [currency]", map[string]string{
+			LANG_ENGLISH: "make a cash deposit",
+			LANG_SPANISH: "hacer un depósito de efectivo",
+		}, adminDeposit},
+		{"withdraw", "<account> <amount> [currency]", map[string]string{
+			LANG_ENGLISH: "make a cash withdrawal",
+			LANG_SPANISH: "hacer un retiro de efectivo",
+		}, adminWithdraw},
+		{"currency", "[<code> <symbol> [name]]", map[string]string{
+			LANG_ENGLISH: "print the currencies and exchange rates, or define a currency",
+			LANG_SPANISH: "imprimir las monedas y los tipos de cambio, o definir una moneda",
+		}, adminCurrency},
+		{"exchange-rate", "<from> <to> <from-units> <to-units>|none", map[string]string{
+			LANG_ENGLISH: "set or remove how many units of a currency the vault gives for another",
+			LANG_SPANISH: "cambiar o quitar cuántas unidades de una moneda da la caja por otra",
+		}, adminExchangeRate},
+		{"convert", "<account> <amount> <from> <to>", map[string]string{
+			LANG_ENGLISH: "exchange an amount of one currency for another at the bank's rate",
+			LANG_SPANISH: "cambiar un importe de una moneda por otra al tipo del banco",
+		}, adminConvert},
+		{"balance", "<account> [date]", map[string]string{
+			LANG_ENGLISH: "print the balance of an account, as of a past date if given",
+			LANG_SPANISH: "imprimir el saldo de una cuenta, a una fecha pasada si se indica",
+		}, adminBalance},
+		{"info", "<account> [date]", map[string]string{
+			LANG_ENGLISH: "print the statement of an account, as of a past date if given",
+			LANG_SPANISH: "imprimir el estado de una cuenta, a una fecha pasada si se indica",
+		}, adminInfo},
+		{"accounts", "", map[string]string{
+			LANG_ENGLISH: "print all the accounts in the bank",
+			LANG_SPANISH: "imprimir todas las cuentas en el banco",
+		}, adminAccounts},
+		{"policy", "[reject|overdraft|partial] [limit]", map[string]string{
+			LANG_ENGLISH: "print or set what happens to transfers that cannot be covered",
+			LANG_SPANISH: "imprimir o cambiar qué pasa con las transferencias sin fondos",
+		}, adminPolicy},
+		{"loan", "<account> <principal> <rate> <term>", map[string]string{
+			LANG_ENGLISH: "give out a loan from the vault (rate in basis points per date, term in dates)",
+			LANG_SPANISH: "conceder un préstamo desde la caja (interés en puntos básicos por fecha, plazo en fechas)",
+		}, adminLoan},
+		{"loans", "[account] [all]", map[string]string{
+			LANG_ENGLISH: "list the active loans, or all of them",
+			LANG_SPANISH: "listar los préstamos activos, o todos",
+		}, adminLoans},
+		{"schedule", "<loan>", map[string]string{
+			LANG_ENGLISH: "print the repayment schedule of a loan",
+			LANG_SPANISH: "imprimir el calendario de pagos de un préstamo",
+		}, adminSchedule},
+		{"restructure", "<loan> <rate> <term>", map[string]string{
+			LANG_ENGLISH: "reschedule what is still owed on a loan",
+			LANG_SPANISH: "recalendarizar lo que se debe de un préstamo",
+		}, adminRestructure},
+		{"forgive", "<loan>", map[string]string{
+			LANG_ENGLISH: "forgive what is still owed on a loan",
+			LANG_SPANISH: "condonar lo que se debe de un préstamo",
+		}, adminForgive},
+		{"standing", "[account]", map[string]string{
+			LANG_ENGLISH: "list the active standing orders",
+			LANG_SPANISH: "listar las órdenes permanentes activas",
+		}, adminStanding},
+		{"cancel-standing", "<order>", map[string]string{
+			LANG_ENGLISH: "cancel a standing order",
+			LANG_SPANISH: "cancelar una orden permanente",
+		}, adminCancelStanding},
+		{"escrows", "[account] [all]", map[string]string{
+			LANG_ENGLISH: "list the escrows still held, or all of them",
+			LANG_SPANISH: "listar las custodias retenidas, o todas",
+		}, adminEscrows},
+		{"release", "<escrow>", map[string]string{
+			LANG_ENGLISH: "release an escrow to its payee, whatever the parties said",
+			LANG_SPANISH: "liberar una custodia a su beneficiario, digan lo que digan las partes",
+		}, adminRelease},
+		{"return", "<escrow>", map[string]string{
+			LANG_ENGLISH: "return an escrow to its payer, whatever the parties said",
+			LANG_SPANISH: "devolver una custodia a su ordenante, digan lo que digan las partes",
+		}, adminReturn},
+		{"invoices", "[account] [all]", map[string]string{
+			LANG_ENGLISH: "list the open invoices, or all of them",
+			LANG_SPANISH: "listar las facturas abiertas, o todas",
+		}, adminInvoices},
+		{"users", "", map[string]string{
+			LANG_ENGLISH: "list the users and the accounts they can use",
+			LANG_SPANISH: "listar los usuarios y las cuentas que pueden usar",
+		}, adminUsers},
+		{"user", "<name> <password>", map[string]string{
+			LANG_ENGLISH: "add a user who logs in with their own name, or change their password",
+			LANG_SPANISH: "añadir un usuario que entra con su propio nombre, o cambiar su contraseña",
+		}, adminUser},
+		{"link", "<user> <account> <owner|signer|viewer>", map[string]string{
+			LANG_ENGLISH: "let a user use an account with a role, or change their role",
+			LANG_SPANISH: "dejar que un usuario use una cuenta con un rol, o cambiar su rol",
+		}, adminLink},
+		{"unlink", "<user> <account>", map[string]string{
+			LANG_ENGLISH: "stop a user from using an account",
+			LANG_SPANISH: "impedir que un usuario use una cuenta",
+		}, adminUnlink},
+		{"members", "<account>", map[string]string{
+			LANG_ENGLISH: "list the members of a joint account and the approvals it needs",
+			LANG_SPANISH: "listar los miembros de una cuenta conjunta y las aprobaciones que necesita",
+		}, adminMembers},
+		{"member", "<account> <name> <password>", map[string]string{
+			LANG_ENGLISH: "add a member to a joint account, or change their password",
+			LANG_SPANISH: "añadir un miembro a una cuenta conjunta, o cambiar su contraseña",
+		}, adminMember},
+		{"remove-member", "<account> <name>", map[string]string{
+			LANG_ENGLISH: "remove a member from a joint account",
+			LANG_SPANISH: "quitar un miembro de una cuenta conjunta",
+		}, adminRemoveMember},
+		{"member-user", "<account> <name> <user|none>", map[string]string{
+			LANG_ENGLISH: "let a user approve the transfers of a joint account as one of its members",
+			LANG_SPANISH: "dejar que un usuario apruebe las transferencias de una cuenta conjunta como uno de sus miembros",
+		}, adminMemberUser},
+		{"approvals", "<account> <threshold|none> [required]", map[string]string{
+			LANG_ENGLISH: "make transfers above the threshold wait for the approval of some members",
+			LANG_SPANISH: "hacer que las transferencias por encima del umbral esperen la aprobación de varios miembros",
+		}, adminApprovals},
+		{"interest", "[rate] [floor|round|ceil]", map[string]string{
+			LANG_ENGLISH: "print or set the savings interest rate (basis points per date)",
+			LANG_SPANISH: "imprimir o cambiar el interés de las cuentas (puntos básicos por fecha)",
+		}, adminInterest},
+		{"class-rate", "<class> <rate|none>", map[string]string{
+			LANG_ENGLISH: "set or remove the interest rate of an account class",
+			LANG_SPANISH: "cambiar o quitar el interés de una clase de cuenta",
+		}, adminClassRate},
+		{"class", "<account> [class]", map[string]string{
+			LANG_ENGLISH: "print or set the class of an account",
+			LANG_SPANISH: "imprimir o cambiar la clase de una cuenta",
+		}, adminClass},
+		{"fees", "", map[string]string{
+			LANG_ENGLISH: "list the fee rules of the transfers",
+			LANG_SPANISH: "listar las reglas de comisión de las transferencias",
+		}, adminFees},
+		{"fee", "<class|any> <account|any> <flat> <rate> [min] [max]", map[string]string{
+			LANG_ENGLISH: "charge a fee on transfers from a class or to an account (rate in basis points)",
+			LANG_SPANISH: "cobrar una comisión en las transferencias de una clase o a una cuenta (tipo en puntos básicos)",
+		}, adminFee},
+		{"remove-fee", "<rule>", map[string]string{
+			LANG_ENGLISH: "remove a fee rule",
+			LANG_SPANISH: "quitar una regla de comisión",
+		}, adminRemoveFee},
+		{"taxes", "", map[string]string{
+			LANG_ENGLISH: "list the tax rules",
+			LANG_SPANISH: "listar las reglas de impuestos",
+		}, adminTaxes},
+		{"tax", "wealth|income <from> <to|none> <rate> [name] | poll <amount> [name]", map[string]string{
+			LANG_ENGLISH: "define a tax rule, disabled until enabled (rate in basis points of the bracket)",
+			LANG_SPANISH: "definir una regla de impuesto, desactivada hasta que se active (tipo en puntos básicos del tramo)",
+		}, adminTax},
+		{"enable-tax", "<rule>", map[string]string{
+			LANG_ENGLISH: "levy a tax rule every time the date advances",
+			LANG_SPANISH: "recaudar una regla de impuesto cada vez que avance la fecha",
+		}, adminEnableTax},
+		{"disable-tax", "<rule>", map[string]string{
+			LANG_ENGLISH: "stop levying a tax rule",
+			LANG_SPANISH: "dejar de recaudar una regla de impuesto",
+		}, adminDisableTax},
+		{"remove-tax", "<rule>", map[string]string{
+			LANG_ENGLISH: "remove a tax rule",
+			LANG_SPANISH: "quitar una regla de impuesto",
+		}, adminRemoveTax},
+		{"tax-preview", "[rule...]", map[string]string{
+			LANG_ENGLISH: "print what each tax rule would levy at the next date, the enabled ones or the given ones",
+			LANG_SPANISH: "imprimir lo que recaudaría cada regla en la siguiente fecha, las activas o las indicadas",
+		}, adminTaxPreview},
+		{"tax-dry-run", "[rule...]", map[string]string{
+			LANG_ENGLISH: "print every transaction the tax rules would post at the next date, without posting them",
+			LANG_SPANISH: "imprimir cada transacción que las reglas de impuestos harían en la siguiente fecha, sin hacerlas",
+		}, adminTaxDryRun},
+		{"verify", "", map[string]string{
+			LANG_ENGLISH: "check the hash chain of the ledger and print its head",
+			LANG_SPANISH: "comprobar la cadena de hashes del libro de cuentas e imprimir su cabeza",
+		}, adminVerify},
+		{"audit", "[account=<n>] [action=<name>] [from=<date>] [to=<date>] [csv|json]", map[string]string{
+			LANG_ENGLISH: "print or export the log of every change made to the bank",
+			LANG_SPANISH: "imprimir o exportar el registro de todos los cambios hechos en el banco",
+		}, adminAuditLog},
+		{"decimals", "[n]", map[string]string{
+			LANG_ENGLISH: "print or set the decimals of the amounts, rescaling every amount of the bank",
+			LANG_SPANISH: "imprimir o cambiar los decimales de los importes, reescalando todos los importes del banco",
+		}, adminDecimals},
+		{"bank", "", map[string]string{
+			LANG_ENGLISH: "print internal information summary of the bank",
+			LANG_SPANISH: "imprimir resumen interno del banco",
+		}, adminBank},
+	}
+}
+
+func adminUsage(lang string) {
+	fmt.Printf("Usage: %s admin [-lang en|es] <db-filename> <command> [arguments...]\n\n", os.Args[0])
+	fmt.Println("Commands:")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "    new <name> <master-password>\t%s\n", map[string]string{
+		LANG_ENGLISH: "create a new bank database",
+		LANG_SPANISH: "crear una nueva base de datos de banco",
+	}[lang])
+	for _, c := range adminCommands {
+		fmt.Fprintf(w, "    %s %s\t%s\n", c.name, c.usage, c.help[lang])
+	}
+	fmt.Fprintf(w, "    help\t%s\n", map[string]string{
+		LANG_ENGLISH: "print this help",
+		LANG_SPANISH: "imprimir esta ayuda",
+	}[lang])
+	w.Flush()
+}
+
+func adminMain(args []string) {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	lang := fs.String("lang", LANG_ENGLISH, "language of the messages (en or es)")
+	fs.Parse(args)
+
+	if _, ok := ErrorStrings[*lang]; !ok {
+		*lang = LANG_ENGLISH
+	}
+
+	rest := fs.Args()
+	if len(rest) < 2 || rest[0] == "help" || rest[1] == "help" {
+		adminUsage(*lang)
+		if len(rest) < 2 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	dbfname, cmd, cmdargs := rest[0], rest[1], rest[2:]
+
+	if cmd == "new" {
+		if len(cmdargs) != 2 {
+			adminFail(*lang, fmt.Errorf(MSG_INVALID_ARGUMENTS))
+		}
+
+		b, err := CreateBank(dbfname, cmdargs[0],
+			GetAdminMessage(*lang, MSG_WITHDRAWALS),
+			GetAdminMessage(*lang, MSG_DEPOSITS),
+			GetAdminMessage(*lang, MSG_VAULT),
+			GetAdminMessage(*lang, MSG_ESCROW),
+			cmdargs[1])
+		if err != nil {
+			adminFail(*lang, err)
+		}
+		defer b.Close()
+
+		adminAudit(b, "new", map[string]any{"name": cmdargs[0]})
+
+		fmt.Println(GetAdminMessage(*lang, MSG_BANK_CREATED) + dbfname)
+		return
+	}
+
+	if _, err := os.Stat(dbfname); errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "No such database file: ", dbfname)
+		os.Exit(1)
+	}
+
+	b, err := OpenBank(dbfname)
+	if err != nil {
+		adminFail(*lang, err)
+	}
+	defer b.Close()
+
+	for _, c := range adminCommands {
+		if c.name == cmd {
+			if err := c.run(b, *lang, cmdargs); err != nil {
+				b.Close()
+				adminFail(*lang, err)
+			}
+			return
+		}
+	}
+
+	b.Close()
+	adminFail(*lang, fmt.Errorf(MSG_NOT_A_VALID_COMMAND))
+}
+
+func adminFail(lang string, err error) {
+	msg := GetBackendError(lang, err.Error())
+	if msg == err.Error() {
+		msg = GetAdminMessage(lang, err.Error())
+	}
+
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(1)
+}
+
+// adminAudit records a command that changed the bank. The administrator
+// has no account and no address.
+func adminAudit(b *Bank, cmd string, params map[string]any) {
+	b.Audit(nil, cmd, params, "")
+}
+
+// parseArgs parses every argument as a signed integer, failing if the count
+// does not match.
+func parseArgs(args []string, n int) ([]int64, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	nums := make([]int64, n)
+	for i, a := range args {
+		v, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(MSG_INVALID_ARGUMENTS)
+		}
+		nums[i] = v
+	}
+
+	return nums, nil
+}
+
+// parseAmountArg parses an amount argument with the decimals of the bank.
+func parseAmountArg(b *Bank, arg string) (int64, error) {
+	amount, err := parseAmount(arg, b.GetDecimals())
+	if err != nil {
+		return 0, fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+	return amount, nil
+}
+
+func adminDate(b *Bank, lang string, args []string) error {
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_CURRENT_DATE), b.GetDate())
+	return nil
+}
+
+func adminNext(b *Bank, lang string, args []string) error {
+	s, err := b.AdvanceClock()
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "next", map[string]any{"date": s.Date})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_ADVANCED_DATE), s.Date)
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_SETTLED), len(s.Settled))
+
+	if len(s.Failed) > 0 {
+		fmt.Println(GetAdminMessage(lang, MSG_FAILED))
+		decimals := b.GetDecimals()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID	DUE	CONCEPT	AMOUNT	FROM	TO")
+		for _, t := range s.Failed {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%d\n", t.Id, t.Date, t.Concept, formatAmount(t.Amount, decimals), t.Debitor, t.Creditor)
+		}
+		w.Flush()
+	}
+
+	for _, t := range s.Partial {
+		fmt.Printf("%s#%d (%s)\n", GetAdminMessage(lang, MSG_PARTIAL), t.Id, formatAmount(t.Amount, b.GetDecimals()))
+	}
+
+	return nil
+}
+
+func adminRewind(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil || n[0] < 0 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	unsettled, err := b.Rewind(uint64(n[0]))
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "rewind", map[string]any{"date": n[0], "unsettled": unsettled})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_REWOUND_DATE), n[0])
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_UNSETTLED), unsettled)
+	return nil
+}
+
+func adminPolicy(b *Bank, lang string, args []string) error {
+	if len(args) > 0 {
+		p := BouncePolicy{Policy: args[0]}
+		if len(args) > 2 || (len(args) == 2) != (p.Policy == POLICY_OVERDRAFT) {
+			return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+		}
+
+		if len(args) == 2 {
+			limit, err := parseAmountArg(b, args[1])
+			if err != nil {
+				return err
+			}
+			p.OverdraftLimit = limit
+		}
+
+		if err := b.SetBouncePolicy(p); err != nil {
+			return err
+		}
+
+		adminAudit(b, "policy", map[string]any{"policy": p.Policy, "limit": p.OverdraftLimit})
+	}
+
+	p, err := b.GetBouncePolicy()
+	if err != nil {
+		return err
+	}
+
+	if p.Policy == POLICY_OVERDRAFT {
+		fmt.Printf("%s%s (%s)\n", GetAdminMessage(lang, MSG_POLICY), p.Policy, formatAmount(p.OverdraftLimit, b.GetDecimals()))
+	} else {
+		fmt.Printf("%s%s\n", GetAdminMessage(lang, MSG_POLICY), p.Policy)
+	}
+	return nil
+}
+
+func adminDecimals(b *Bank, lang string, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	if len(args) == 1 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return err
+		}
+
+		if err := b.SetDecimals(int(n[0])); err != nil {
+			return err
+		}
+
+		adminAudit(b, "decimals", map[string]any{"decimals": n[0]})
+	}
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_DECIMALS), b.GetDecimals())
+	return nil
+}
+
+func adminLoan(b *Bank, lang string, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs([]string{args[0], "0", args[2], args[3]}, 4)
+	if err != nil {
+		return err
+	}
+
+	if n[1], err = parseAmountArg(b, args[1]); err != nil {
+		return err
+	}
+
+	if n[3] < 0 {
+		return fmt.Errorf(ERR_TERM_INVALID)
+	}
+
+	id, err := b.GrantLoan(n[0], n[1], n[2], uint64(n[3]))
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "loan", map[string]any{"id": id, "account": n[0], "principal": n[1], "rate": n[2], "term": n[3]})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_LOAN_GRANTED), id)
+	return printSchedule(b, id)
+}
+
+func adminLoans(b *Bank, lang string, args []string) error {
+	all := len(args) > 0 && args[len(args)-1] == "all"
+	if all {
+		args = args[:len(args)-1]
+	}
+
+	var account *int64
+	if len(args) > 0 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return err
+		}
+		account = &n[0]
+	}
+
+	loans, err := b.GetLoans(account, all)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOLDER\tACCOUNT\tDATE\tPRINCIPAL\tRATE\tTERM\tOUTSTANDING\tSTATUS")
+	for _, l := range loans {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%d\t%d\t%s\t%s\n", l.Id, l.Holder, l.Account, l.Date, formatAmount(l.Principal, decimals), l.Rate, l.Term, formatAmount(l.Outstanding, decimals), l.Status)
+	}
+	return w.Flush()
+}
+
+func adminSchedule(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	return printSchedule(b, n[0])
+}
+
+func printSchedule(b *Bank, id int64) error {
+	l, err := b.GetLoan(id)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	fmt.Printf("LOAN #%d TO %s (%d): %s AT %d BP, %s\n", l.Id, l.Holder, l.Account, formatAmount(l.Principal, decimals), l.Rate, l.Status)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "N\tDUE\tPRINCIPAL\tINTEREST\tTOTAL\tSTATUS")
+	for _, i := range l.Schedule {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", i.Number, i.Date, formatAmount(i.Principal, decimals), formatAmount(i.Interest, decimals), formatAmount(i.Amount(), decimals), i.Status)
+	}
+	w.Flush()
+
+	fmt.Printf("OUTSTANDING: %s\n", formatAmount(l.Outstanding, decimals))
+	return nil
+}
+
+func adminRestructure(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 3)
+	if err != nil {
+		return err
+	}
+
+	if n[2] < 0 {
+		return fmt.Errorf(ERR_TERM_INVALID)
+	}
+
+	if err := b.RestructureLoan(n[0], n[1], uint64(n[2])); err != nil {
+		return err
+	}
+
+	adminAudit(b, "restructure", map[string]any{"id": n[0], "rate": n[1], "term": n[2]})
+
+	return printSchedule(b, n[0])
+}
+
+func adminForgive(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.ForgiveLoan(n[0]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "forgive", map[string]any{"id": n[0]})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminPause(b *Bank, lang string, args []string) error {
+	if err := b.SetAdvancePaused(true); err != nil {
+		return err
+	}
+
+	adminAudit(b, "pause", nil)
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminResume(b *Bank, lang string, args []string) error {
+	if err := b.SetAdvancePaused(false); err != nil {
+		return err
+	}
+
+	adminAudit(b, "resume", nil)
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminStanding(b *Bank, lang string, args []string) error {
+	var account *int64
+	if len(args) > 0 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return err
+		}
+		account = &n[0]
+	}
+
+	orders, err := b.GetStandingOrders(account)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFROM\tTO\tAMOUNT\tCURRENCY\tCONCEPT\tPERIOD\tNEXT\tEND")
+	for _, o := range orders {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\t%d\t%d\t%d\n", o.Id, o.Debitor, o.Creditor, formatAmount(o.Amount, decimals), o.Currency, o.Concept, o.Period, o.Next, o.End)
+	}
+	return w.Flush()
+}
+
+func adminCancelStanding(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.CancelStandingOrder(ACCOUNT_VAULT, n[0]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "cancel-standing", map[string]any{"id": n[0]})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminEscrows(b *Bank, lang string, args []string) error {
+	all := len(args) > 0 && args[len(args)-1] == "all"
+	if all {
+		args = args[:len(args)-1]
+	}
+
+	var account *int64
+	if len(args) > 0 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return err
+		}
+		account = &n[0]
+	}
+
+	escrows, err := b.GetEscrows(account, all)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFROM\tTO\tAMOUNT\tCURRENCY\tCONCEPT\tDEADLINE\tACCEPTED\tSTATUS")
+	for _, e := range escrows {
+		accepted := "-"
+		switch {
+		case e.DebitorAccepts && e.CreditorAccepts:
+			accepted = "both"
+		case e.DebitorAccepts:
+			accepted = "from"
+		case e.CreditorAccepts:
+			accepted = "to"
+		}
+
+		status := e.Status
+		if e.Disputed && e.Status == ESCROW_HELD {
+			status = "disputed"
+		}
+
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\t%d\t%s\t%s\n", e.Id, e.Debitor, e.Creditor, formatAmount(e.Amount, decimals), e.Currency, e.Concept, e.Deadline, accepted, status)
+	}
+	return w.Flush()
+}
+
+func adminInvoices(b *Bank, lang string, args []string) error {
+	all := len(args) > 0 && args[len(args)-1] == "all"
+	if all {
+		args = args[:len(args)-1]
+	}
+
+	var account *int64
+	if len(args) > 0 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return err
+		}
+		account = &n[0]
+	}
+
+	invoices, err := b.GetInvoices(account, all)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tISSUER\tPAYER\tAMOUNT\tCURRENCY\tCONCEPT\tDUE\tSTATUS\tTRANSACTION")
+	for _, i := range invoices {
+		transaction := "-"
+		if i.Transaction != 0 {
+			transaction = fmt.Sprint(i.Transaction)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\t%s\t%d\t%s\t%s\n", i.Id, i.Issuer, i.Payer, formatAmount(i.Amount, decimals), i.Currency, i.Concept, i.Due, i.Status, transaction)
+	}
+	return w.Flush()
+}
+
+func adminUsers(b *Bank, lang string, args []string) error {
+	users, err := b.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tACCOUNT\tHOLDER\tROLE")
+	for _, u := range users {
+		if len(u.Accounts) == 0 {
+			fmt.Fprintf(w, "%d\t%s\t-\t-\t-\n", u.Id, u.Name)
+		}
+		for _, l := range u.Accounts {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", u.Id, u.Name, l.Id, l.Holder, l.Role)
+		}
+	}
+	return w.Flush()
+}
+
+func adminUser(b *Bank, lang string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	id, err := b.CreateUser(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "user", map[string]any{"id": id, "name": args[0]})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_USER_CREATED), id)
+	return nil
+}
+
+func adminLink(b *Bank, lang string, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[1:2], 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.LinkUser(args[0], n[0], args[2]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "link", map[string]any{"user": args[0], "account": n[0], "role": args[2]})
+
+	return adminUsers(b, lang, nil)
+}
+
+func adminUnlink(b *Bank, lang string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[1:], 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.UnlinkUser(args[0], n[0]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "unlink", map[string]any{"user": args[0], "account": n[0]})
+
+	return adminUsers(b, lang, nil)
+}
+
+func adminMembers(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	j, err := b.GetJointPolicy(n[0])
+	if err != nil {
+		return err
+	}
+
+	// The user linked to a member follows their name
+	var members []string
+	for _, name := range j.Members {
+		if user, ok := j.Users[name]; ok {
+			name += " (" + user + ")"
+		}
+		members = append(members, name)
+	}
+
+	fmt.Println(GetAdminMessage(lang, MSG_MEMBERS) + strings.Join(members, ", "))
+
+	if j.Threshold == nil {
+		fmt.Println(GetAdminMessage(lang, MSG_NO_APPROVALS))
+	} else {
+		fmt.Printf("%s%d/%d (> %s)\n", GetAdminMessage(lang, MSG_APPROVALS), j.Required, len(j.Members), formatAmount(*j.Threshold, b.GetDecimals()))
+	}
+	return nil
+}
+
+func adminMember(b *Bank, lang string, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[:1], 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.AddMember(n[0], args[1], args[2]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "member", map[string]any{"account": n[0], "name": args[1]})
+
+	return adminMembers(b, lang, args[:1])
+}
+
+func adminRemoveMember(b *Bank, lang string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[:1], 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.RemoveMember(n[0], args[1]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "remove-member", map[string]any{"account": n[0], "name": args[1]})
+
+	return adminMembers(b, lang, args[:1])
+}
+
+func adminMemberUser(b *Bank, lang string, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[:1], 1)
+	if err != nil {
+		return err
+	}
+
+	user := args[2]
+	if user == "none" {
+		user = ""
+	}
+
+	if err := b.LinkMember(n[0], args[1], user); err != nil {
+		return err
+	}
+
+	adminAudit(b, "member-user", map[string]any{"account": n[0], "name": args[1], "user": user})
+
+	return adminMembers(b, lang, args[:1])
+}
+
+func adminApprovals(b *Bank, lang string, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[:1], 1)
+	if err != nil {
+		return err
+	}
+
+	var threshold *int64
+	required := int64(1)
+	if args[1] != "none" {
+		amount, err := parseAmountArg(b, args[1])
+		if err != nil {
+			return err
+		}
+		threshold = &amount
+
+		if len(args) == 3 {
+			r, err := parseArgs(args[2:], 1)
+			if err != nil {
+				return err
+			}
+			required = r[0]
+		}
+	}
+
+	if err := b.SetApprovals(n[0], threshold, required); err != nil {
+		return err
+	}
+
+	adminAudit(b, "approvals", map[string]any{"account": n[0], "threshold": threshold, "required": required})
+
+	return adminMembers(b, lang, args[:1])
+}
+
+func adminRelease(b *Bank, lang string, args []string) error {
+	return arbitrateEscrow(b, lang, args, true)
+}
+
+func adminReturn(b *Bank, lang string, args []string) error {
+	return arbitrateEscrow(b, lang, args, false)
+}
+
+func arbitrateEscrow(b *Bank, lang string, args []string, release bool) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.ArbitrateEscrow(n[0], release); err != nil {
+		return err
+	}
+
+	cmd := "return"
+	if release {
+		cmd = "release"
+	}
+	adminAudit(b, cmd, map[string]any{"id": n[0]})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminInterest(b *Bank, lang string, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	if len(args) > 0 {
+		p, err := b.GetInterestPolicy()
+		if err != nil {
+			return err
+		}
+
+		n, err := parseArgs(args[:1], 1)
+		if err != nil {
+			return err
+		}
+
+		rounding := p.Rounding
+		if len(args) == 2 {
+			rounding = args[1]
+		}
+
+		if err := b.SetInterestRate(n[0], rounding); err != nil {
+			return err
+		}
+
+		adminAudit(b, "interest", map[string]any{"rate": n[0], "rounding": rounding})
+	}
+
+	p, err := b.GetInterestPolicy()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s%d (%s)\n", GetAdminMessage(lang, MSG_INTEREST), p.Rate, p.Rounding)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for class, rate := range p.ClassRates {
+		fmt.Fprintf(w, "    %s\t%d\n", class, rate)
+	}
+	return w.Flush()
+}
+
+func adminClassRate(b *Bank, lang string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	rate := int64(-1)
+	if args[1] != "none" {
+		n, err := parseArgs(args[1:], 1)
+		if err != nil {
+			return err
+		}
+
+		if n[0] < 0 {
+			return fmt.Errorf(ERR_RATE_INVALID)
+		}
+		rate = n[0]
+	}
+
+	if err := b.SetClassRate(args[0], rate); err != nil {
+		return err
+	}
+
+	adminAudit(b, "class-rate", map[string]any{"class": args[0], "rate": rate})
+
+	return adminInterest(b, lang, nil)
+}
+
+func adminFees(b *Bank, lang string, args []string) error {
+	rules, err := b.GetFeeRules()
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLASS\tTO\tFLAT\tRATE\tMIN\tMAX")
+	for _, f := range rules {
+		class, to, max := FEE_ANY, FEE_ANY, "-"
+		if f.Class != "" {
+			class = f.Class
+		}
+		if f.Counterparty != 0 {
+			to = fmt.Sprint(f.Counterparty)
+		}
+		if f.Max > 0 {
+			max = formatAmount(f.Max, decimals)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", f.Id, class, to, formatAmount(f.Flat, decimals), f.Rate, formatAmount(f.Min, decimals), max)
+	}
+	return w.Flush()
+}
+
+func adminFee(b *Bank, lang string, args []string) error {
+	if len(args) < 4 || len(args) > 6 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	var f FeeRule
+	if args[0] != FEE_ANY {
+		f.Class = args[0]
+	}
+
+	if args[1] != FEE_ANY {
+		n, err := parseArgs(args[1:2], 1)
+		if err != nil {
+			return err
+		}
+		f.Counterparty = n[0]
+	}
+
+	n, err := parseArgs(args[3:4], 1)
+	if err != nil {
+		return err
+	}
+	f.Rate = n[0]
+
+	if f.Flat, err = parseAmountArg(b, args[2]); err != nil {
+		return err
+	}
+
+	if len(args) > 4 {
+		if f.Min, err = parseAmountArg(b, args[4]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 5 {
+		if f.Max, err = parseAmountArg(b, args[5]); err != nil {
+			return err
+		}
+	}
+
+	id, err := b.AddFeeRule(f)
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "fee", map[string]any{"id": id, "class": f.Class, "to": f.Counterparty, "flat": f.Flat, "rate": f.Rate, "min": f.Min, "max": f.Max})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_FEE_RULE_ADDED), id)
+	return nil
+}
+
+func adminRemoveFee(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.RemoveFeeRule(n[0]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "remove-fee", map[string]any{"id": n[0]})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminTaxes(b *Bank, lang string, args []string) error {
+	rules, err := b.GetTaxRules()
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tNAME\tFROM\tTO\tRATE\tAMOUNT\tENABLED")
+	for _, t := range rules {
+		to := "-"
+		if t.To > 0 {
+			to = formatAmount(t.To, decimals)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%t\n", t.Id, t.Kind, t.Name, formatAmount(t.From, decimals), to, t.Rate, formatAmount(t.Amount, decimals), t.Enabled)
+	}
+	return w.Flush()
+}
+
+func adminTax(b *Bank, lang string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	t := TaxRule{Kind: args[0]}
+	var err error
+
+	switch t.Kind {
+	case TAX_POLL:
+		if t.Amount, err = parseAmountArg(b, args[1]); err != nil {
+			return err
+		}
+		t.Name = strings.Join(args[2:], " ")
+	case TAX_WEALTH, TAX_INCOME:
+		if len(args) < 4 {
+			return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+		}
+
+		if t.From, err = parseAmountArg(b, args[1]); err != nil {
+			return err
+		}
+
+		if args[2] != "none" {
+			if t.To, err = parseAmountArg(b, args[2]); err != nil {
+				return err
+			}
+		}
+
+		n, err := parseArgs(args[3:4], 1)
+		if err != nil {
+			return err
+		}
+		t.Rate = n[0]
+		t.Name = strings.Join(args[4:], " ")
+	default:
+		return fmt.Errorf(ERR_TAX_RULE_INVALID)
+	}
+
+	id, err := b.AddTaxRule(t)
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "tax", map[string]any{"id": id, "kind": t.Kind, "name": t.Name, "from": t.From, "to": t.To, "rate": t.Rate, "amount": t.Amount})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_TAX_RULE_ADDED), id)
+	return nil
+}
+
+func adminEnableTax(b *Bank, lang string, args []string) error {
+	return setTaxEnabled(b, lang, args, true)
+}
+
+func adminDisableTax(b *Bank, lang string, args []string) error {
+	return setTaxEnabled(b, lang, args, false)
+}
+
+func setTaxEnabled(b *Bank, lang string, args []string, enabled bool) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.EnableTaxRule(n[0], enabled); err != nil {
+		return err
+	}
+
+	cmd := "disable-tax"
+	if enabled {
+		cmd = "enable-tax"
+	}
+	adminAudit(b, cmd, map[string]any{"id": n[0]})
+
+	return adminTaxes(b, lang, nil)
+}
+
+func adminRemoveTax(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.RemoveTaxRule(n[0]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "remove-tax", map[string]any{"id": n[0]})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+// dryRunTaxes runs the rules given as arguments, or the enabled ones.
+func dryRunTaxes(b *Bank, args []string) ([]TaxLevy, error) {
+	ids, err := parseArgs(args, len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.DryRunTaxes(ids)
+}
+
+func adminTaxPreview(b *Bank, lang string, args []string) error {
+	levies, err := dryRunTaxes(b, args)
+	if err != nil {
+		return err
+	}
+
+	var rules []int64
+	accounts, totals := map[int64]int{}, map[int64]int64{}
+	var total int64
+	for _, l := range levies {
+		if _, seen := totals[l.Rule]; !seen {
+			rules = append(rules, l.Rule)
+		}
+		accounts[l.Rule]++
+		totals[l.Rule] += l.Amount
+		total += l.Amount
+	}
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tACCOUNTS\tTOTAL")
+	for _, id := range rules {
+		fmt.Fprintf(w, "%d\t%d\t%s\n", id, accounts[id], formatAmount(totals[id], decimals))
+	}
+	w.Flush()
+
+	fmt.Printf("%s%s\n", GetAdminMessage(lang, MSG_TAX_TOTAL), formatAmount(total, decimals))
+	return nil
+}
+
+func adminTaxDryRun(b *Bank, lang string, args []string) error {
+	levies, err := dryRunTaxes(b, args)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tACCOUNT\tHOLDER\tCONCEPT\tAMOUNT")
+	for _, l := range levies {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", l.Rule, l.Account, l.Holder, l.Concept, formatAmount(l.Amount, decimals))
+		total += l.Amount
+	}
+	w.Flush()
+
+	fmt.Printf("%s%s\n", GetAdminMessage(lang, MSG_TAX_TOTAL), formatAmount(total, decimals))
+	return nil
+}
+
+func adminClass(b *Bank, lang string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs(args[:1], 1)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		if err := b.SetAccountClass(n[0], args[1]); err != nil {
+			return err
+		}
+
+		adminAudit(b, "class", map[string]any{"account": n[0], "class": args[1]})
+	}
+
+	class, err := b.GetAccountClass(n[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(GetAdminMessage(lang, MSG_CLASS) + class)
+	return nil
+}
+
+func adminRevoke(b *Bank, lang string, args []string) error {
+	n, err := parseArgs(args, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.ForceRevoke(uint64(n[0])); err != nil {
+		return err
+	}
+
+	adminAudit(b, "revoke", map[string]any{"id": n[0]})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_REVOKED), n[0])
+	return nil
+}
+
+func adminCreate(b *Bank, lang string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	id, err := b.CreateAccount(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "create", map[string]any{"id": id, "holder": args[0]})
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_ACCOUNT_CREATED), id)
+	return nil
+}
+
+// parseCurrency splits the optional currency off the end of the arguments.
+func parseCurrency(args []string, n int) ([]string, string) {
+	if len(args) == n+1 {
+		return args[:n], args[n]
+	}
+	return args, DEFAULT_CURRENCY
+}
+
+func adminDeposit(b *Bank, lang string, args []string) error {
+	args, currency := parseCurrency(args, 2)
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs([]string{args[0], "0"}, 2)
+	if err != nil {
+		return err
+	}
+
+	if n[1], err = parseAmountArg(b, args[1]); err != nil {
+		return err
+	}
+
+	if err := b.Deposit(n[0], n[1], currency, GetAdminMessage(lang, MSG_CASH)); err != nil {
+		return err
+	}
+
+	adminAudit(b, "deposit", map[string]any{"account": n[0], "amount": n[1], "currency": currency})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminWithdraw(b *Bank, lang string, args []string) error {
+	args, currency := parseCurrency(args, 2)
+	if len(args) != 2 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs([]string{args[0], "0"}, 2)
+	if err != nil {
+		return err
+	}
+
+	if n[1], err = parseAmountArg(b, args[1]); err != nil {
+		return err
+	}
+
+	if err := b.Withdraw(n[0], n[1], currency, GetAdminMessage(lang, MSG_CASH)); err != nil {
+		return err
+	}
+
+	adminAudit(b, "withdraw", map[string]any{"account": n[0], "amount": n[1], "currency": currency})
+
+	fmt.Println(GetAdminMessage(lang, MSG_DONE))
+	return nil
+}
+
+func adminCurrency(b *Bank, lang string, args []string) error {
+	if len(args) == 1 || len(args) > 3 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	if len(args) > 0 {
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+
+		if err := b.SetCurrency(args[0], args[1], name); err != nil {
+			return err
+		}
+
+		adminAudit(b, "currency", map[string]any{"code": args[0], "symbol": args[1], "name": name})
+	}
+
+	currencies, err := b.GetCurrencies()
+	if err != nil {
+		return err
+	}
+
+	rates, err := b.GetExchangeRates()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tSYMBOL\tNAME")
+	for _, c := range currencies {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Code, c.Symbol, c.Name)
+	}
+	w.Flush()
+
+	if len(rates) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FROM\tTO\tRATE")
+		for _, r := range rates {
+			fmt.Fprintf(w, "%s\t%s\t%d:%d\n", r.Source, r.Target, r.SourceUnits, r.TargetUnits)
+		}
+		w.Flush()
+	}
+
+	return nil
+}
+
+func adminExchangeRate(b *Bank, lang string, args []string) error {
+	var units []int64
+	switch {
+	case len(args) == 3 && args[2] == "none":
+		units = []int64{0, 0}
+	case len(args) == 4:
+		n, err := parseArgs(args[2:], 2)
+		if err != nil {
+			return err
+		}
+
+		if n[0] <= 0 || n[1] <= 0 {
+			return fmt.Errorf(ERR_EXCHANGE_RATE_INVALID)
+		}
+		units = n
+	default:
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	if err := b.SetExchangeRate(args[0], args[1], units[0], units[1]); err != nil {
+		return err
+	}
+
+	adminAudit(b, "exchange-rate", map[string]any{"from": args[0], "to": args[1], "from_units": units[0], "to_units": units[1]})
+
+	return adminCurrency(b, lang, nil)
+}
+
+func adminConvert(b *Bank, lang string, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	n, err := parseArgs([]string{args[0], "0"}, 2)
+	if err != nil {
+		return err
+	}
+
+	if n[1], err = parseAmountArg(b, args[1]); err != nil {
+		return err
+	}
+
+	bought, err := b.Convert(n[0], n[1], args[2], args[3])
+	if err != nil {
+		return err
+	}
+
+	adminAudit(b, "convert", map[string]any{"account": n[0], "amount": n[1], "from": args[2], "to": args[3], "bought": bought})
+
+	fmt.Printf("%s%s %s\n", GetAdminMessage(lang, MSG_EXCHANGED), formatAmount(bought, b.GetDecimals()), args[3])
+	return nil
+}
+
+// parseAsOf parses the account and the optional date of the commands that
+// can look at the past. The date defaults to the current one.
+func parseAsOf(b *Bank, args []string) (int64, uint64, error) {
+	if len(args) == 1 {
+		n, err := parseArgs(args, 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		return n[0], b.GetDate(), nil
+	}
+
+	n, err := parseArgs(args, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if n[1] < 0 {
+		return 0, 0, fmt.Errorf(MSG_INVALID_ARGUMENTS)
+	}
+
+	if uint64(n[1]) > b.GetDate() {
+		return 0, 0, fmt.Errorf(ERR_TIME_TRAVEL_IMPOSSIBLE)
+	}
+
+	return n[0], uint64(n[1]), nil
+}
+
+func adminBalance(b *Bank, lang string, args []string) error {
+	id, date, err := parseAsOf(b, args)
+	if err != nil {
+		return err
+	}
+
+	s, err := b.StatementAsOf(id, date)
+	if err != nil {
+		return err
+	}
+
+	decimals := b.GetDecimals()
+	for _, t := range s.Totals {
+		fmt.Printf("BALANCE: %s\tCASH: %s\t%s\n", formatAmount(t.Balance, decimals), formatAmount(t.Cash, decimals), t.Currency)
+	}
+	return nil
+}
+
+func adminInfo(b *Bank, lang string, args []string) error {
+	id, date, err := parseAsOf(b, args)
+	if err != nil {
+		return err
+	}
+
+	return printStatement(b, id, date)
+}
+
+func adminAccounts(b *Bank, lang string, args []string) error {
+	accounts, err := b.GetAccounts()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, a := range accounts {
+		fmt.Fprintf(w, "%s\t%d\n", a.Holder, a.Id)
+	}
+	return w.Flush()
+}
+
+func adminVerify(b *Bank, lang string, args []string) error {
+	head, tampered, err := b.VerifyLedger()
+	if tampered != 0 {
+		fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_TAMPERED), tampered)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s%d\n", GetAdminMessage(lang, MSG_LEDGER_VERIFIED), head.Count)
+	fmt.Printf("%s%s\n", GetAdminMessage(lang, MSG_LEDGER_HEAD), head.Hash)
+	return nil
+}
+
+func adminAuditLog(b *Bank, lang string, args []string) error {
+	var f AuditFilter
+	format := ""
+
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			if arg != "csv" && arg != "json" {
+				return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+			}
+			format = arg
+			continue
+		}
+
+		if key == "action" {
+			f.Action = value
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+		}
+
+		switch {
+		case key == "account":
+			f.Actor = &n
+		case key == "from" && n >= 0:
+			f.From = uint64(n)
+		case key == "to" && n >= 0:
+			to := uint64(n)
+			f.To = &to
+		default:
+			return fmt.Errorf(MSG_INVALID_ARGUMENTS)
+		}
+	}
+
+	entries, err := b.GetAudit(f)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		return enc.Encode(entries)
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"id", "actor", "action", "params", "date", "time", "remote"})
+		for _, e := range entries {
+			w.Write([]string{fmt.Sprint(e.Id), auditActor(e), e.Action, string(e.Params), fmt.Sprint(e.Date), e.Time.Format(time.RFC3339), e.Remote})
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDATE\tTIME\tACTOR\tACTION\tPARAMS\tREMOTE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\n", e.Id, e.Date, e.Time.Format(time.DateTime), auditActor(e), e.Action, e.Params, e.Remote)
+	}
+	return w.Flush()
+}
+
+// auditActor names who did an audited action: an account, or the admin.
+func auditActor(e AuditEntry) string {
+	if e.Actor == nil {
+		return "admin"
+	}
+	return fmt.Sprint(*e.Actor)
+}
+
+func adminBank(b *Bank, lang string, args []string) error {
+	for _, id := range []int64{ACCOUNT_VAULT, ACCOUNT_DEPOSITS, ACCOUNT_WITHDRAWALS, ACCOUNT_ESCROW} {
+		if err := printStatement(b, id, b.GetDate()); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func printStatement(b *Bank, id int64, date uint64) error {
+	s, err := b.StatementAsOf(id, date)
+	if err != nil {
+		return err
+	}
+
+	a := s.Account
+	fmt.Printf("%s (%d) FINANCIAL STATEMENT (DATED %d)\n", a.Holder, a.Id, date)
+	fmt.Println("ACCOUNT HOLDER: " + a.Holder)
+	fmt.Printf("ACCOUNT ID: %d\n", a.Id)
+	fmt.Printf("DATE CREATED: %d\n", a.Date)
+	fmt.Println("-------------------------------------------------------------")
+
+	decimals := b.GetDecimals()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tDUE\tCONCEPT\tDEBIT\tCREDIT\tCURRENCY\tACCOUNT\tPAYED\tID")
+	for _, t := range s.Rows {
+		payed := fmt.Sprint(t.Payed)
+		if t.Failed {
+			payed = "FAILED"
+		}
+
+		if t.Debitor == id {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t-\t%s\t%d\t%s\t%d\n", t.Created, t.Due, t.Concept, formatAmount(t.Amount, decimals), t.Currency, t.Creditor, payed, t.Id)
+		} else {
+			fmt.Fprintf(w, "%d\t%d\t%s\t-\t%s\t%s\t%d\t%s\t%d\n", t.Created, t.Due, t.Concept, formatAmount(t.Amount, decimals), t.Currency, t.Debitor, payed, t.Id)
+		}
+	}
+	for _, t := range s.Totals {
+		fmt.Fprintf(w, "\t\tTOTAL:\t%s\t%s\t%s\t\t\t\n", formatAmount(t.DebitsTotal, decimals), formatAmount(t.CreditsTotal, decimals), t.Currency)
+	}
+	w.Flush()
+
+	for _, t := range s.Totals {
+		fmt.Println("-------------------------------------------------------------")
+		fmt.Printf("BALANCE: %s\tDEBT: %s\t%s\n", formatAmount(t.Balance, decimals), formatAmount(t.Debt, decimals), t.Currency)
+		fmt.Printf("CASH: %s\n", formatAmount(t.Cash, decimals))
+	}
+
+	return nil
+}
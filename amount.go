@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amounts are kept as integers in the minor unit of the bank: with 2
+// decimals an amount of 1234 is 12.34. Every currency of a bank uses the
+// same decimals. They are parsed and formatted at the edges, the ledger
+// never sees a fraction. Banks made before decimals existed count in
+// whole units.
+
+// MAX_DECIMALS keeps amounts well inside an int64.
+const MAX_DECIMALS = 6
+
+func loadDecimals(q dbtx) (int, error) {
+	var decimals int
+	err := q.QueryRow("SELECT decimals FROM system WHERE id = 1;").Scan(&decimals)
+	return decimals, err
+}
+
+// GetDecimals reads how many decimals the amounts of the bank have. Like
+// the date, it is read from the database every time.
+func (b *Bank) GetDecimals() int {
+	decimals, err := loadDecimals(b.db)
+	if err != nil {
+		log.Fatal("Error querying: " + err.Error())
+	}
+
+	return decimals
+}
+
+// amountColumns are every amount the bank keeps in minor units: the
+// ledger, and the loans, orders, rules and limits that make it grow.
+var amountColumns = []struct {
+	table  string
+	column string
+}{
+	{"transactions", "amount"},
+	{"system", "overdraft_limit"},
+	{"loans", "principal"},
+	{"instalments", "principal"},
+	{"instalments", "interest"},
+	{"standing_orders", "amount"},
+	{"fee_rules", "flat"},
+	{"fee_rules", "minimum"},
+	{"fee_rules", "maximum"},
+	{"tax_rules", "bracket_from"},
+	{"tax_rules", "bracket_to"},
+	{"tax_rules", "amount"},
+	{"escrows", "amount"},
+	{"invoices", "amount"},
+	{"pending_transfers", "amount"},
+	{"accounts", "approval_threshold"},
+}
+
+// SetDecimals changes the minor unit of the bank, rescaling every amount it
+// keeps at once. The hash chain hashes amounts in whole units, so it still
+// verifies. Fewer decimals are refused while an amount would lose digits,
+// and more while one would grow too large. The audit log keeps the amounts
+// as they were written.
+func (b *Bank) SetDecimals(decimals int) error {
+	if decimals < 0 || decimals > MAX_DECIMALS {
+		return fmt.Errorf(ERR_DECIMALS_INVALID)
+	}
+
+	return serializable(b.db, func(tx *sql.Tx) error {
+		old, err := loadDecimals(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range amountColumns {
+			var check, update string
+			var limit, factor int64
+			if decimals >= old {
+				factor = pow10(decimals - old)
+				limit = math.MaxInt64 / factor
+				check = fmt.Sprintf("SELECT count(*) FROM %s WHERE abs(%s) > $1;", c.table, c.column)
+				update = fmt.Sprintf("UPDATE %s SET %s = %s * $1;", c.table, c.column, c.column)
+			} else {
+				factor = pow10(old - decimals)
+				limit = factor
+				check = fmt.Sprintf("SELECT count(*) FROM %s WHERE %s %% $1 <> 0;", c.table, c.column)
+				update = fmt.Sprintf("UPDATE %s SET %s = %s / $1;", c.table, c.column, c.column)
+			}
+
+			var n int64
+			if err = tx.QueryRow(check, limit).Scan(&n); err != nil {
+				return err
+			}
+
+			if n > 0 {
+				return fmt.Errorf(ERR_DECIMALS_LOCKED)
+			}
+
+			if _, err = tx.Exec(update, factor); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec("UPDATE system SET decimals = $1 WHERE id = 1;", decimals)
+		return err
+	})
+}
+
+// wholeAmount writes an amount in minor units as whole units, with no
+// trailing zeros: the same amount reads the same whatever the decimals.
+func wholeAmount(amount int64, decimals int) string {
+	s := formatAmount(amount, decimals)
+	if decimals > 0 {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// parseAmount reads an amount written by a person, such as "12", "12.5" or
+// "-0,05", into minor units. Both a point and a comma mark the decimals,
+// and there cannot be more of them than the bank uses.
+func parseAmount(s string, decimals int) (int64, error) {
+	s = strings.TrimSpace(s)
+	whole, fraction, found := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+
+	digits, negative := strings.CutPrefix(whole, "-")
+	if (digits == "" && fraction == "") || (found && fraction == "") || len(fraction) > decimals {
+		return 0, strconv.ErrSyntax
+	}
+
+	for _, part := range []string{digits, fraction} {
+		if strings.Trim(part, "0123456789") != "" {
+			return 0, strconv.ErrSyntax
+		}
+	}
+
+	var units, minor int64
+	var err error
+	if digits != "" {
+		if units, err = strconv.ParseInt(digits, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+
+	if fraction != "" {
+		if minor, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return 0, err
+		}
+		minor *= pow10(decimals - len(fraction))
+	}
+
+	scale := pow10(decimals)
+	if units > (1<<63-1-minor)/scale {
+		return 0, strconv.ErrRange
+	}
+
+	amount := units*scale + minor
+	if negative {
+		amount = -amount
+	}
+
+	return amount, nil
+}
+
+// formatAmount writes an amount in minor units for people, with as many
+// decimals as the bank uses.
+func formatAmount(amount int64, decimals int) string {
+	if decimals == 0 {
+		return strconv.FormatInt(amount, 10)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	scale := pow10(decimals)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, decimals, amount%scale)
+}
+
+// amountStep is the step of the amount fields of the forms.
+func amountStep(decimals int) string {
+	return formatAmount(1, decimals)
+}
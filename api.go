@@ -0,0 +1,1350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API mirrors the web pages for bots and scripts. Clients log in
+// to get a token and send it back in an "Authorization: Bearer" header.
+// Errors carry a stable code, plus the message in the language asked for
+// with the "lang" query parameter.
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiCode struct {
+	code   string
+	status int
+}
+
+// apiBackendCodes maps the errors of the Bank methods to the API codes.
+var apiBackendCodes = map[string]apiCode{
+	ERR_DOC_NOT_FOUND:               {"doc_not_found", http.StatusNotFound},
+	ERR_LETTER_NOT_IN_INBOX:         {"letter_not_found", http.StatusNotFound},
+	ERR_TRANSFER_TO_SELF:            {"transfer_to_self", http.StatusBadRequest},
+	ERR_INSUFFICIENT_FUNDS:          {"insufficient_funds", http.StatusBadRequest},
+	ERR_NEGATIVE_TRANSFER_AMOUNT:    {"negative_amount", http.StatusBadRequest},
+	ERR_TIME_TRAVEL_IMPOSSIBLE:      {"date_in_past", http.StatusBadRequest},
+	ERR_RECIPIENT_ACCOUNT_NOT_FOUND: {"recipient_not_found", http.StatusNotFound},
+	ERR_REVOKE_NOT_ALLOWED:          {"revoke_not_allowed", http.StatusForbidden},
+	ERR_TRANSACTION_NOT_FOUND:       {"transaction_not_found", http.StatusNotFound},
+	ERR_TERM_INVALID:                {"period_invalid", http.StatusBadRequest},
+	ERR_STANDING_START_INVALID:      {"standing_start_invalid", http.StatusBadRequest},
+	ERR_STANDING_END_INVALID:        {"standing_end_invalid", http.StatusBadRequest},
+	ERR_STANDING_NOT_FOUND:          {"standing_order_not_found", http.StatusNotFound},
+	ERR_CURRENCY_NOT_FOUND:          {"currency_not_found", http.StatusNotFound},
+	ERR_EXCHANGE_RATE_NOT_FOUND:     {"exchange_rate_not_found", http.StatusNotFound},
+	ERR_EXCHANGE_TOO_SMALL:          {"exchange_too_small", http.StatusBadRequest},
+	ERR_EXCHANGE_TOO_LARGE:          {"exchange_too_large", http.StatusBadRequest},
+	ERR_EXCHANGE_VAULT_INSUFFICIENT: {"exchange_vault_insufficient_funds", http.StatusConflict},
+	ERR_ESCROW_NOT_FOUND:            {"escrow_not_found", http.StatusNotFound},
+	ERR_ESCROW_CLOSED:               {"escrow_closed", http.StatusConflict},
+	ERR_INVOICE_NOT_FOUND:           {"invoice_not_found", http.StatusNotFound},
+	ERR_INVOICE_CLOSED:              {"invoice_closed", http.StatusConflict},
+	ERR_INVOICE_TO_SELF:             {"invoice_to_self", http.StatusBadRequest},
+	ERR_MEMBER_NOT_FOUND:            {"member_not_found", http.StatusForbidden},
+	ERR_APPROVAL_REQUIRED:           {"approval_required", http.StatusForbidden},
+	ERR_PENDING_NOT_FOUND:           {"pending_not_found", http.StatusNotFound},
+	ERR_PENDING_CLOSED:              {"pending_closed", http.StatusConflict},
+	ERR_USER_NOT_FOUND:              {"user_not_found", http.StatusNotFound},
+	ERR_ROLE_INVALID:                {"role_invalid", http.StatusBadRequest},
+	ERR_READ_ONLY:                   {"read_only", http.StatusForbidden},
+	ERR_NOT_OWNER:                   {"not_owner", http.StatusForbidden},
+	ERR_ACCOUNT_NOT_FOUND_ADMIN:     {"account_not_found", http.StatusNotFound},
+}
+
+// apiFormCodes maps the request validation errors to the API codes.
+var apiFormCodes = map[int]apiCode{
+	ERR_ACCOUNT_NUMBER_INVALID:     {"account_number_invalid", http.StatusBadRequest},
+	ERR_ACCOUNT_NOT_FOUND:          {"account_not_found", http.StatusUnauthorized},
+	ERR_INCORRECT_PASSWORD:         {"incorrect_password", http.StatusUnauthorized},
+	ERR_TRANSFER_AMOUNT_INVALID:    {"amount_invalid", http.StatusBadRequest},
+	ERR_TRANSFER_DATE_INVALID:      {"date_invalid", http.StatusBadRequest},
+	ERR_NEW_PASSWORDS_MISMATCH:     {"new_passwords_mismatch", http.StatusBadRequest},
+	ERR_CURRENT_PASSWORD_INCORRECT: {"current_password_incorrect", http.StatusBadRequest},
+	ERR_TRANSACTION_ID_INVALID:     {"transaction_id_invalid", http.StatusBadRequest},
+	ERR_LETTER_ID_INVALID:          {"letter_id_invalid", http.StatusBadRequest},
+	ERR_PERIOD_INVALID:             {"period_invalid", http.StatusBadRequest},
+	ERR_STANDING_ORDER_ID_INVALID:  {"standing_order_id_invalid", http.StatusBadRequest},
+	ERR_REQUEST_INVALID:            {"request_invalid", http.StatusBadRequest},
+	ERR_ESCROW_ID_INVALID:          {"escrow_id_invalid", http.StatusBadRequest},
+	ERR_INVOICE_ID_INVALID:         {"invoice_id_invalid", http.StatusBadRequest},
+	ERR_PENDING_ID_INVALID:         {"pending_id_invalid", http.StatusBadRequest},
+}
+
+func apiWrite(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Println("Error encoding response: " + err.Error())
+	}
+}
+
+func apiFail(w http.ResponseWriter, status int, code string, message string) {
+	apiWrite(w, status, &struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message}})
+}
+
+// apiBackendError reports an error returned by a Bank method. Errors that
+// are not ours (database errors and the like) are internal errors.
+func apiBackendError(w http.ResponseWriter, lang string, err error) {
+	c, ok := apiBackendCodes[err.Error()]
+	if !ok {
+		log.Println("API error: " + err.Error())
+		apiFail(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+
+	apiFail(w, c.status, c.code, GetBackendError(lang, err.Error()))
+}
+
+func apiFormError(w http.ResponseWriter, lang string, e int) {
+	c := apiFormCodes[e]
+	apiFail(w, c.status, c.code, ErrorStrings[lang][e])
+}
+
+func apiUnauthorized(w http.ResponseWriter) {
+	apiFail(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+}
+
+// decodeBody reads the JSON request body into v.
+func decodeBody(w http.ResponseWriter, r *http.Request, lang string, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		apiFormError(w, lang, ERR_REQUEST_INVALID)
+		return false
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), found
+}
+
+func checkBearerToken(b *Bank, r *http.Request) (*Account, error) {
+	token, found := bearerToken(r)
+	if !found {
+		return nil, http.ErrNoCookie
+	}
+
+	a, _, err := loadSession(b, token)
+	return a, err
+}
+
+// apiAsOf loads the account as it was on the date asked for with the "asof"
+// query parameter, if any. On failure the error is already written.
+func apiAsOf(w http.ResponseWriter, r *http.Request, b *Bank, lang string, a *Account) (*Account, uint64, bool) {
+	clock := b.GetDate()
+
+	v := r.URL.Query().Get("asof")
+	if v == "" {
+		return a, clock, true
+	}
+
+	date, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_TRANSFER_DATE_INVALID)
+		return nil, 0, false
+	}
+
+	if date >= clock {
+		return a, clock, true
+	}
+
+	a, err = b.LoadAccountAsOf(a.Id, date)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return nil, 0, false
+	}
+
+	return a, date, true
+}
+
+type apiTransaction struct {
+	Id       int64  `json:"id"`
+	Due      uint64 `json:"due"`
+	Concept  string `json:"concept"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Creditor int64  `json:"creditor"`
+	Debitor  int64  `json:"debitor"`
+	Status   string `json:"status"`
+	ToFrom   string `json:"to_from"`
+}
+
+type apiLetter struct {
+	Id       uint64 `json:"id"`
+	Sender   int64  `json:"sender"`
+	Receiver int64  `json:"receiver"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Date     uint64 `json:"date"`
+	Title    string `json:"title"`
+	Public   bool   `json:"public"`
+	Body     string `json:"body,omitempty"`
+}
+
+type apiStandingOrder struct {
+	Id       int64  `json:"id"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Concept  string `json:"concept"`
+	Period   uint64 `json:"period"`
+	Next     uint64 `json:"next"`
+	End      uint64 `json:"end"`
+	ToFrom   string `json:"to_from"`
+}
+
+type apiEscrow struct {
+	Id              int64  `json:"id"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	Concept         string `json:"concept"`
+	Deadline        uint64 `json:"deadline"`
+	DebitorAccepts  bool   `json:"debitor_accepts"`
+	CreditorAccepts bool   `json:"creditor_accepts"`
+	Disputed        bool   `json:"disputed"`
+	ToFrom          string `json:"to_from"`
+}
+
+type apiInvoice struct {
+	Id          int64  `json:"id"`
+	Issuer      int64  `json:"issuer"`
+	Payer       int64  `json:"payer"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Concept     string `json:"concept"`
+	Due         uint64 `json:"due"`
+	Status      string `json:"status"`
+	Transaction int64  `json:"transaction,omitempty"`
+	ToFrom      string `json:"to_from"`
+}
+
+type apiBalance struct {
+	Currency string `json:"currency"`
+	Symbol   string `json:"symbol"`
+	Amount   int64  `json:"amount"`
+}
+
+type apiBook struct {
+	Id     int64  `json:"id"`
+	Holder string `json:"holder"`
+}
+
+func toAPITransactions(ts []Transaction) []apiTransaction {
+	res := []apiTransaction{}
+	for _, t := range ts {
+		res = append(res, apiTransaction{Id: t.Id, Due: t.Date, Concept: t.Concept, Amount: t.Amount, Currency: t.Currency, Creditor: t.Creditor, Debitor: t.Debitor, Status: t.Status, ToFrom: t.To_from})
+	}
+	return res
+}
+
+func toAPILetter(l Letter) apiLetter {
+	return apiLetter{Id: l.Timestamp, Sender: l.Sender, Receiver: l.Receiver, From: l.From, To: l.To, Date: l.Date, Title: l.Title, Public: l.Public, Body: string(l.Body)}
+}
+
+func toAPIInvoice(i Invoice) apiInvoice {
+	return apiInvoice{Id: i.Id, Issuer: i.Issuer, Payer: i.Payer, Amount: i.Amount, Currency: i.Currency, Concept: i.Concept, Due: i.Due, Status: i.Status, Transaction: i.Transaction, ToFrom: i.To_from}
+}
+
+func toAPIStandingOrders(orders []StandingOrder) []apiStandingOrder {
+	res := []apiStandingOrder{}
+	for _, o := range orders {
+		res = append(res, apiStandingOrder{Id: o.Id, Amount: o.Amount, Currency: o.Currency, Concept: o.Concept, Period: o.Period, Next: o.Next, End: o.End, ToFrom: o.To_from})
+	}
+	return res
+}
+
+func toAPIEscrow(e Escrow) apiEscrow {
+	return apiEscrow{Id: e.Id, Amount: e.Amount, Currency: e.Currency, Concept: e.Concept, Deadline: e.Deadline,
+		DebitorAccepts: e.DebitorAccepts, CreditorAccepts: e.CreditorAccepts, Disputed: e.Disputed, ToFrom: e.To_from}
+}
+
+func toAPILetters(ls []Letter) []apiLetter {
+	res := []apiLetter{}
+	for _, l := range ls {
+		res = append(res, toAPILetter(l))
+	}
+	return res
+}
+
+type apiLinkedAccount struct {
+	Id     int64  `json:"id,omitempty"`
+	Holder string `json:"holder,omitempty"`
+	User   string `json:"user,omitempty"`
+	Role   string `json:"role"`
+}
+
+type apiPending struct {
+	Id          int64    `json:"id"`
+	Creditor    int64    `json:"creditor"`
+	Amount      int64    `json:"amount"`
+	Currency    string   `json:"currency"`
+	Concept     string   `json:"concept"`
+	Due         uint64   `json:"due"`
+	Proposer    string   `json:"proposer"`
+	Approvals   []string `json:"approvals"`
+	Required    int64    `json:"required"`
+	Status      string   `json:"status"`
+	Transaction int64    `json:"transaction,omitempty"`
+	ToFrom      string   `json:"to_from"`
+}
+
+func toAPIPending(p PendingTransfer) apiPending {
+	approvals := p.Approvals
+	if approvals == nil {
+		approvals = []string{}
+	}
+	return apiPending{Id: p.Id, Creditor: p.Creditor, Amount: p.Amount, Currency: p.Currency, Concept: p.Concept, Due: p.Due, Proposer: p.Proposer, Approvals: approvals, Required: p.Required, Status: p.Status, Transaction: p.Transaction, ToFrom: p.To_from}
+}
+
+func apiLoginHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	var req struct {
+		Account  uint64 `json:"account"`
+		Name     string `json:"name"` // the user, or the member of a joint account
+		Password string `json:"password"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	// A user logs in on the account they choose, or else on their first one
+	user, isUser := b.AuthenticateUser(req.Name, req.Password)
+	if isUser && req.Account == 0 {
+		first, err := b.firstAccount(user)
+		if err != nil {
+			apiFormError(w, lang, ERR_ACCOUNT_NOT_FOUND)
+			return
+		}
+		req.Account = uint64(first)
+	}
+
+	holder, err := b.GetAccountHolder(int64(req.Account))
+	if err != nil {
+		apiFormError(w, lang, ERR_ACCOUNT_NOT_FOUND)
+		return
+	}
+
+	if isUser {
+		if _, err := b.userRole(user, int64(req.Account)); err != nil {
+			apiFormError(w, lang, ERR_ACCOUNT_NOT_FOUND)
+			return
+		}
+		holder = req.Name
+	} else {
+		member, ok := b.Authenticate(int64(req.Account), req.Name, req.Password)
+		if !ok {
+			apiFormError(w, lang, ERR_INCORRECT_PASSWORD)
+			return
+		}
+
+		if member != "" {
+			holder = member
+		}
+		user = 0
+	}
+
+	token, expiresAt, err := sessions.New(req.Account, holder, user)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, &struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{token, expiresAt})
+}
+
+func apiLogoutHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	token, found := bearerToken(r)
+	if !found {
+		apiUnauthorized(w)
+		return
+	}
+
+	if err := sessions.Delete(token); err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiLogoutAllHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	if err = logoutAll(b, a); err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) logged out of every device\n", a.Holder, a.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiAccountHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	res := struct {
+		Id          int64      `json:"id"`
+		Holder      string     `json:"holder"`
+		Member      string     `json:"member,omitempty"`
+		User        string     `json:"user,omitempty"`
+		Role        string     `json:"role"`
+		Date        uint64     `json:"date"`
+		Balance     int64      `json:"balance"`
+		Clock       uint64     `json:"clock"`
+		Decimals    int        `json:"decimals"`
+		NextAdvance *time.Time `json:"next_advance,omitempty"`
+		Paused      bool       `json:"paused,omitempty"`
+	}{Id: a.Id, Holder: a.Holder, Member: a.Member, User: a.User, Role: a.Role, Date: a.Date, Balance: a.Balance, Clock: b.GetDate(), Decimals: b.GetDecimals()}
+
+	if next, paused := scheduler.Status(); !next.IsZero() {
+		res.NextAdvance, res.Paused = &next, paused
+	}
+
+	apiWrite(w, http.StatusOK, &res)
+}
+
+func apiBalanceHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	a, date, ok := apiAsOf(w, r, b, lang, a)
+	if !ok {
+		return
+	}
+
+	balances := []apiBalance{}
+	for _, c := range a.Balances {
+		balances = append(balances, apiBalance{Currency: c.Code, Symbol: c.Symbol, Amount: c.Amount})
+	}
+
+	apiWrite(w, http.StatusOK, &struct {
+		Balance  int64        `json:"balance"`
+		Balances []apiBalance `json:"balances"`
+		Clock    uint64       `json:"clock"`
+	}{a.Balance, balances, date})
+}
+
+func apiTransactionsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	a, _, ok := apiAsOf(w, r, b, lang, a)
+	if !ok {
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPITransactions(a.Transactions))
+}
+
+func apiTransferHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To       uint64 `json:"to"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Due      uint64 `json:"due"`
+		Concept  string `json:"concept"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = DEFAULT_CURRENCY
+	}
+
+	pending, err := b.ProposeTransfer(a.Id, a.Member, int64(req.To), req.Amount, req.Currency, req.Due, req.Concept)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	// Above the threshold of a joint account, the transfer waits for the
+	// approval of its members
+	if pending != 0 {
+		log.Printf("Transfer #%d from %s (%d) to %d waits for approvals\n", pending, a.Holder, a.Id, req.To)
+		auditRequest(b, r, a, "propose", map[string]any{"id": pending, "to": req.To, "amount": req.Amount, "currency": req.Currency, "due": req.Due, "concept": req.Concept})
+		apiWrite(w, http.StatusAccepted, &struct {
+			Pending int64 `json:"pending"`
+		}{pending})
+		return
+	}
+
+	log.Printf("Transfer Ordered from %s (%d) to %d due on %d for %d %s\n", a.Holder, a.Id, req.To, req.Due, req.Amount, req.Currency)
+	auditRequest(b, r, a, "transfer", map[string]any{"to": req.To, "amount": req.Amount, "currency": req.Currency, "due": req.Due, "concept": req.Concept})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPreviewHandler tells what a transfer would cost, fees included,
+// without ordering it.
+func apiPreviewHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To       uint64 `json:"to"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Due      uint64 `json:"due"`
+		Concept  string `json:"concept"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = DEFAULT_CURRENCY
+	}
+
+	p, err := b.PreviewTransfer(uint64(a.Id), req.To, req.Amount, req.Currency, req.Due, req.Concept)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, &struct {
+		Amount    int64  `json:"amount"`
+		Fee       int64  `json:"fee"`
+		Total     int64  `json:"total"`
+		Currency  string `json:"currency"`
+		Approvals int64  `json:"approvals,omitempty"`
+	}{p.Amount, p.Fee, p.Total(), p.Currency, p.Approvals})
+}
+
+func apiConvertHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		Amount int64  `json:"amount"`
+		From   string `json:"from"`
+		To     string `json:"to"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	bought, err := b.Convert(a.Id, req.Amount, req.From, req.To)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) exchanged %d %s for %d %s\n", a.Holder, a.Id, req.Amount, req.From, bought, req.To)
+	auditRequest(b, r, a, "convert", map[string]any{"amount": req.Amount, "from": req.From, "to": req.To, "bought": bought})
+	apiWrite(w, http.StatusOK, &struct {
+		Bought int64 `json:"bought"`
+	}{bought})
+}
+
+func apiRevokeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	transaction_id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_TRANSACTION_ID_INVALID)
+		return
+	}
+
+	err = b.RevokeTransaction(a.Id, transaction_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) revoked transaction #%d\n", a.Holder, a.Id, transaction_id)
+	auditRequest(b, r, a, "revoke", map[string]any{"id": transaction_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiStandingOrdersHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPIStandingOrders(a.StandingOrders))
+}
+
+func apiStandingHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To       int64  `json:"to"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Concept  string `json:"concept"`
+		Start    uint64 `json:"start"`
+		Period   uint64 `json:"period"`
+		End      uint64 `json:"end"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if req.Period == 0 {
+		apiFormError(w, lang, ERR_PERIOD_INVALID)
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = DEFAULT_CURRENCY
+	}
+
+	id, err := b.CreateStandingOrder(a.Id, req.To, req.Amount, req.Currency, req.Concept, req.Start, req.Period, req.End)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("Standing order #%d from %s (%d) to %d every %d dates from %d for %d %s\n", id, a.Holder, a.Id, req.To, req.Period, req.Start, req.Amount, req.Currency)
+	auditRequest(b, r, a, "standing", map[string]any{"id": id, "to": req.To, "amount": req.Amount, "currency": req.Currency, "concept": req.Concept, "start": req.Start, "period": req.Period, "end": req.End})
+	apiWrite(w, http.StatusCreated, &struct {
+		Id int64 `json:"id"`
+	}{id})
+}
+
+func apiCancelHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	order_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_STANDING_ORDER_ID_INVALID)
+		return
+	}
+
+	err = b.CancelStandingOrder(a.Id, order_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) cancelled standing order #%d\n", a.Holder, a.Id, order_id)
+	auditRequest(b, r, a, "cancel", map[string]any{"id": order_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiEscrowsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	escrows := []apiEscrow{}
+	for _, e := range a.Escrows {
+		escrows = append(escrows, toAPIEscrow(e))
+	}
+
+	apiWrite(w, http.StatusOK, escrows)
+}
+
+func apiEscrowHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To       uint64 `json:"to"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Deadline uint64 `json:"deadline"`
+		Concept  string `json:"concept"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = DEFAULT_CURRENCY
+	}
+
+	id, err := b.OpenEscrow(uint64(a.Id), req.To, req.Amount, req.Currency, req.Deadline, req.Concept)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("Escrow #%d from %s (%d) to %d until %d for %d %s\n", id, a.Holder, a.Id, req.To, req.Deadline, req.Amount, req.Currency)
+	auditRequest(b, r, a, "escrow", map[string]any{"id": id, "to": req.To, "amount": req.Amount, "currency": req.Currency, "deadline": req.Deadline, "concept": req.Concept})
+	apiWrite(w, http.StatusCreated, &struct {
+		Id int64 `json:"id"`
+	}{id})
+}
+
+func apiAcceptHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	escrow_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_ESCROW_ID_INVALID)
+		return
+	}
+
+	err = b.AcceptEscrow(a.Id, escrow_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) accepted escrow #%d\n", a.Holder, a.Id, escrow_id)
+	auditRequest(b, r, a, "accept", map[string]any{"id": escrow_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiDisputeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	escrow_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_ESCROW_ID_INVALID)
+		return
+	}
+
+	err = b.DisputeEscrow(a.Id, escrow_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) disputed escrow #%d\n", a.Holder, a.Id, escrow_id)
+	auditRequest(b, r, a, "dispute", map[string]any{"id": escrow_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiInvoicesHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	invoices := []apiInvoice{}
+	for _, i := range a.Invoices {
+		invoices = append(invoices, toAPIInvoice(i))
+	}
+
+	apiWrite(w, http.StatusOK, invoices)
+}
+
+func apiInvoiceHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To       int64  `json:"to"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Due      uint64 `json:"due"`
+		Concept  string `json:"concept"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = DEFAULT_CURRENCY
+	}
+
+	id, err := b.IssueInvoice(a.Id, req.To, req.Amount, req.Currency, req.Due, req.Concept)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("Invoice #%d from %s (%d) to %d due on %d for %d %s\n", id, a.Holder, a.Id, req.To, req.Due, req.Amount, req.Currency)
+	auditRequest(b, r, a, "invoice", map[string]any{"id": id, "to": req.To, "amount": req.Amount, "currency": req.Currency, "due": req.Due, "concept": req.Concept})
+	apiWrite(w, http.StatusCreated, &struct {
+		Id int64 `json:"id"`
+	}{id})
+}
+
+func apiPayHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	invoice_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_INVOICE_ID_INVALID)
+		return
+	}
+
+	id, err := b.PayInvoice(a.Id, invoice_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) paid invoice #%d with transaction #%d\n", a.Holder, a.Id, invoice_id, id)
+	auditRequest(b, r, a, "pay", map[string]any{"id": invoice_id, "transaction": id})
+	apiWrite(w, http.StatusOK, &struct {
+		Transaction int64 `json:"transaction"`
+	}{id})
+}
+
+func apiDeclineHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	invoice_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_INVOICE_ID_INVALID)
+		return
+	}
+
+	err = b.DeclineInvoice(a.Id, invoice_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) declined invoice #%d\n", a.Holder, a.Id, invoice_id)
+	auditRequest(b, r, a, "decline", map[string]any{"id": invoice_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiApprovalsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	pending := []apiPending{}
+	for _, p := range a.Pending {
+		pending = append(pending, toAPIPending(p))
+	}
+
+	apiWrite(w, http.StatusOK, pending)
+}
+
+func apiApproveHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	pending_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_PENDING_ID_INVALID)
+		return
+	}
+
+	id, err := b.ApproveTransfer(a.Id, a.Member, pending_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) approved transfer #%d\n", a.Member, a.Id, pending_id)
+	auditRequest(b, r, a, "approve", map[string]any{"id": pending_id, "transaction": id})
+	apiWrite(w, http.StatusOK, &struct {
+		Transaction int64 `json:"transaction,omitempty"`
+	}{id})
+}
+
+func apiRejectHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	pending_id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_PENDING_ID_INVALID)
+		return
+	}
+
+	err = b.RejectTransfer(a.Id, a.Member, pending_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) rejected transfer #%d\n", a.Member, a.Id, pending_id)
+	auditRequest(b, r, a, "reject", map[string]any{"id": pending_id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiChangepasswdHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		Current string `json:"current"`
+		New     string `json:"new"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if !b.checkSessionPass(a, req.Current) {
+		apiFormError(w, lang, ERR_CURRENT_PASSWORD_INCORRECT)
+		return
+	}
+
+	if err = b.changeSessionPass(a, req.New); err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	auditRequest(b, r, a, "changepasswd", nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiAccountsHandler lists the accounts the user logged in can switch to,
+// and for owners the users the account is shared with.
+func apiAccountsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	res := struct {
+		Active   int64              `json:"active"`
+		Role     string             `json:"role"`
+		Accounts []apiLinkedAccount `json:"accounts"`
+		Users    []apiLinkedAccount `json:"users,omitempty"`
+	}{Active: a.Id, Role: a.Role, Accounts: []apiLinkedAccount{}}
+
+	for _, l := range a.Linked {
+		res.Accounts = append(res.Accounts, apiLinkedAccount{Id: l.Id, Holder: l.Holder, Role: l.Role})
+	}
+	for _, l := range a.Users {
+		res.Users = append(res.Users, apiLinkedAccount{User: l.User, Role: l.Role})
+	}
+
+	apiWrite(w, http.StatusOK, &res)
+}
+
+func apiSwitchHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_ACCOUNT_NUMBER_INVALID)
+		return
+	}
+
+	if !a.linkedTo(id) {
+		apiBackendError(w, lang, fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN))
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if err = sessions.Switch(token, uint64(id)); err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s switched from %d to %d\n", a.User, a.Id, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiShareHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		User string `json:"user"`
+		Role string `json:"role"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	err = fmt.Errorf(ERR_NOT_OWNER)
+	if a.Role == ROLE_OWNER {
+		err = b.LinkUser(req.User, a.Id, req.Role)
+	}
+
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) shared the account with %s as %s\n", a.Holder, a.Id, req.User, req.Role)
+	auditRequest(b, r, a, "share", map[string]any{"with": req.User, "role": req.Role})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiUnshareHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		User string `json:"user"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	err = fmt.Errorf(ERR_NOT_OWNER)
+	if a.Role == ROLE_OWNER {
+		err = b.UnlinkUser(req.User, a.Id)
+	}
+
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Printf("%s (%d) stopped sharing the account with %s\n", a.Holder, a.Id, req.User)
+	auditRequest(b, r, a, "unshare", map[string]any{"with": req.User})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiLettersHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPILetters(a.Letters))
+}
+
+func apiReadHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	letter_id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_LETTER_ID_INVALID)
+		return
+	}
+
+	l, err := a.LoadLetter(letter_id, b)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPILetter(l))
+}
+
+func apiSendHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	var req struct {
+		To      int64  `json:"to"`
+		Title   string `json:"title"`
+		Body    string `json:"body"`
+		Publish bool   `json:"publish"`
+	}
+
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+
+	if _, err = b.GetAccountHolder(req.To); err != nil {
+		apiBackendError(w, lang, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND))
+		return
+	}
+
+	l, err := b.NewLetter(a, req.To, req.Title, req.Body)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	if req.Publish {
+		err = l.Publish(b)
+	} else {
+		err = l.Send(b)
+	}
+
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	log.Println("Received letter from " + a.Holder + " at date " + strconv.FormatUint(b.GetDate(), 10) + ": " + req.Title)
+
+	action := "send"
+	if req.Publish {
+		action = "publish"
+	}
+	auditRequest(b, r, a, action, map[string]any{"id": l.Timestamp, "to": req.To, "title": req.Title})
+
+	apiWrite(w, http.StatusCreated, &struct {
+		Id uint64 `json:"id"`
+	}{l.Timestamp})
+}
+
+func apiBookHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	_, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	book, err := b.GetBook()
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	res := []apiBook{}
+	for _, bo := range book {
+		res = append(res, apiBook{Id: bo.Id, Holder: bo.Holder})
+	}
+
+	apiWrite(w, http.StatusOK, res)
+}
+
+func apiArchiveHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	archive, err := b.GetArchive()
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPILetters(archive))
+}
+
+func apiLedgerHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	head, err := b.GetLedgerHead()
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, &struct {
+		Clock        uint64 `json:"clock"`
+		Transactions int64  `json:"transactions"`
+		Last         int64  `json:"last"`
+		Head         string `json:"head"`
+	}{b.GetDate(), head.Count, head.Last, head.Hash})
+}
+
+func apiCurrenciesHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	currencies, err := b.GetCurrencies()
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	rates, err := b.GetExchangeRates()
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	type apiCurrency struct {
+		Code   string `json:"code"`
+		Symbol string `json:"symbol"`
+		Name   string `json:"name"`
+	}
+
+	type apiRate struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		FromUnits int64  `json:"from_units"`
+		ToUnits   int64  `json:"to_units"`
+	}
+
+	res := struct {
+		Decimals   int           `json:"decimals"`
+		Currencies []apiCurrency `json:"currencies"`
+		Rates      []apiRate     `json:"rates"`
+	}{b.GetDecimals(), []apiCurrency{}, []apiRate{}}
+
+	for _, c := range currencies {
+		res.Currencies = append(res.Currencies, apiCurrency{c.Code, c.Symbol, c.Name})
+	}
+
+	for _, rate := range rates {
+		res.Rates = append(res.Rates, apiRate{rate.Source, rate.Target, rate.SourceUnits, rate.TargetUnits})
+	}
+
+	apiWrite(w, http.StatusOK, &res)
+}
+
+func apiDocHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	doc_id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiFormError(w, lang, ERR_LETTER_ID_INVALID)
+		return
+	}
+
+	l, err := b.LoadDoc(doc_id)
+	if err != nil {
+		apiBackendError(w, lang, err)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, toAPILetter(l))
+}
+
+// apiSignerOnly runs fn only for the sessions that can use the funds of the
+// account, not for viewers.
+func apiSignerOnly(fn func(http.ResponseWriter, *http.Request, *Bank, string)) func(http.ResponseWriter, *http.Request, *Bank, string) {
+	return func(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+		a, err := checkBearerToken(b, r)
+		if err == nil && a.Role == ROLE_VIEWER {
+			apiBackendError(w, lang, fmt.Errorf(ERR_READ_ONLY))
+			return
+		}
+		fn(w, r, b, lang)
+	}
+}
+
+// makeAPIHandler picks the language of the error messages, english unless
+// the client asks for another one.
+func makeAPIHandler(fn func(http.ResponseWriter, *http.Request, *Bank, string), b *Bank) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang := r.URL.Query().Get("lang")
+		if _, ok := ErrorStrings[lang]; !ok {
+			lang = LANG_ENGLISH
+		}
+		fn(w, r, b, lang)
+	}
+}
+
+func registerAPI(b *Bank) {
+	http.HandleFunc("POST /api/v1/login", makeAPIHandler(apiLoginHandler, b))
+	http.HandleFunc("POST /api/v1/logout", makeAPIHandler(apiLogoutHandler, b))
+	http.HandleFunc("POST /api/v1/logoutall", makeAPIHandler(apiLogoutAllHandler, b))
+	http.HandleFunc("GET /api/v1/account", makeAPIHandler(apiAccountHandler, b))
+	http.HandleFunc("GET /api/v1/balance", makeAPIHandler(apiBalanceHandler, b))
+	http.HandleFunc("GET /api/v1/events", makeAPIHandler(apiEventsHandler, b))
+	http.HandleFunc("GET /api/v1/transactions", makeAPIHandler(apiTransactionsHandler, b))
+	http.HandleFunc("POST /api/v1/transfer", makeAPIHandler(apiSignerOnly(apiTransferHandler), b))
+	http.HandleFunc("POST /api/v1/transfer/preview", makeAPIHandler(apiPreviewHandler, b))
+	http.HandleFunc("POST /api/v1/convert", makeAPIHandler(apiSignerOnly(apiConvertHandler), b))
+	http.HandleFunc("POST /api/v1/revoke/{id}", makeAPIHandler(apiSignerOnly(apiRevokeHandler), b))
+	http.HandleFunc("GET /api/v1/standing", makeAPIHandler(apiStandingOrdersHandler, b))
+	http.HandleFunc("POST /api/v1/standing", makeAPIHandler(apiSignerOnly(apiStandingHandler), b))
+	http.HandleFunc("POST /api/v1/cancel/{id}", makeAPIHandler(apiSignerOnly(apiCancelHandler), b))
+	http.HandleFunc("GET /api/v1/escrows", makeAPIHandler(apiEscrowsHandler, b))
+	http.HandleFunc("POST /api/v1/escrow", makeAPIHandler(apiSignerOnly(apiEscrowHandler), b))
+	http.HandleFunc("POST /api/v1/accept/{id}", makeAPIHandler(apiSignerOnly(apiAcceptHandler), b))
+	http.HandleFunc("POST /api/v1/dispute/{id}", makeAPIHandler(apiSignerOnly(apiDisputeHandler), b))
+	http.HandleFunc("GET /api/v1/invoices", makeAPIHandler(apiInvoicesHandler, b))
+	http.HandleFunc("POST /api/v1/invoice", makeAPIHandler(apiSignerOnly(apiInvoiceHandler), b))
+	http.HandleFunc("POST /api/v1/pay/{id}", makeAPIHandler(apiSignerOnly(apiPayHandler), b))
+	http.HandleFunc("POST /api/v1/decline/{id}", makeAPIHandler(apiSignerOnly(apiDeclineHandler), b))
+	http.HandleFunc("GET /api/v1/approvals", makeAPIHandler(apiApprovalsHandler, b))
+	http.HandleFunc("POST /api/v1/approve/{id}", makeAPIHandler(apiSignerOnly(apiApproveHandler), b))
+	http.HandleFunc("POST /api/v1/reject/{id}", makeAPIHandler(apiSignerOnly(apiRejectHandler), b))
+	http.HandleFunc("POST /api/v1/changepasswd", makeAPIHandler(apiChangepasswdHandler, b))
+	http.HandleFunc("GET /api/v1/accounts", makeAPIHandler(apiAccountsHandler, b))
+	http.HandleFunc("POST /api/v1/switch/{id}", makeAPIHandler(apiSwitchHandler, b))
+	http.HandleFunc("POST /api/v1/share", makeAPIHandler(apiShareHandler, b))
+	http.HandleFunc("POST /api/v1/unshare", makeAPIHandler(apiUnshareHandler, b))
+	http.HandleFunc("GET /api/v1/letters", makeAPIHandler(apiLettersHandler, b))
+	http.HandleFunc("GET /api/v1/letters/{id}", makeAPIHandler(apiReadHandler, b))
+	http.HandleFunc("POST /api/v1/send", makeAPIHandler(apiSignerOnly(apiSendHandler), b))
+	http.HandleFunc("GET /api/v1/book", makeAPIHandler(apiBookHandler, b))
+	http.HandleFunc("GET /api/v1/archive", makeAPIHandler(apiArchiveHandler, b))
+	http.HandleFunc("GET /api/v1/doc/{id}", makeAPIHandler(apiDocHandler, b))
+	http.HandleFunc("GET /api/v1/ledger", makeAPIHandler(apiLedgerHandler, b))
+	http.HandleFunc("GET /api/v1/currencies", makeAPIHandler(apiCurrenciesHandler, b))
+}
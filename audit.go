@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The audit log records every action that changes the bank: who did it, on
+// which date, and from where. The database refuses to change or delete its
+// entries. Actions are named after the admin commands and the web routes.
+type AuditEntry struct {
+	Id     int64           `json:"id"`
+	Actor  *int64          `json:"actor"` // nil for the bank administrator
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params"`
+	Date   uint64          `json:"date"`
+	Time   time.Time       `json:"time"`
+	Remote string          `json:"remote,omitempty"`
+}
+
+// An AuditFilter selects entries of the audit log. The zero value selects
+// every entry.
+type AuditFilter struct {
+	Actor  *int64
+	Action string
+	From   uint64
+	To     *uint64
+}
+
+// Audit appends an action to the audit log. The action already happened,
+// so failing to record it is logged but not reported.
+func (b *Bank) Audit(actor *int64, action string, params map[string]any, remote string) {
+	if params == nil {
+		params = map[string]any{}
+	}
+
+	var p bytes.Buffer
+	enc := json.NewEncoder(&p)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(params); err != nil {
+		log.Printf("Could not audit %s: %s\n", action, err.Error())
+		return
+	}
+
+	_, err := b.db.Exec("INSERT INTO audit (actor, action, params, date, time, remote) VALUES ($1, $2, $3, (SELECT clock FROM system WHERE id = 1), $4, $5);",
+		actor, action, strings.TrimSpace(p.String()), time.Now().Unix(), remote)
+	if err != nil {
+		log.Printf("Could not audit %s: %s\n", action, err.Error())
+	}
+}
+
+// auditRequest records an action of the account logged in to a web page or
+// the API, with the address the request came from.
+func auditRequest(b *Bank, r *http.Request, a *Account, action string, params map[string]any) {
+	// On a joint account or a shared one, who did it is the member or the
+	// user
+	if a.Member != "" || a.User != "" {
+		if params == nil {
+			params = map[string]any{}
+		}
+		if a.Member != "" {
+			params["member"] = a.Member
+		}
+		if a.User != "" {
+			params["user"] = a.User
+		}
+	}
+
+	b.Audit(&a.Id, action, params, r.RemoteAddr)
+}
+
+// consoleAudit records a command given from the admin web console: the
+// administrator has no account, but the request has an address.
+func consoleAudit(b *Bank, r *http.Request, cmd string, params map[string]any) {
+	b.Audit(nil, cmd, params, r.RemoteAddr)
+}
+
+// GetAudit lists the entries of the audit log that match f, oldest first.
+func (b *Bank) GetAudit(f AuditFilter) ([]AuditEntry, error) {
+	rows, err := b.db.Query(`
+		SELECT id, actor, action, params, date, time, coalesce(remote, '')
+		FROM audit
+		WHERE ($1 IS NULL OR actor = $1) AND ($2 = '' OR action = $2) AND date >= $3 AND ($4 IS NULL OR date <= $4)
+		ORDER BY id ASC;`, f.Actor, f.Action, f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var params string
+		var unix int64
+		if err := rows.Scan(&e.Id, &e.Actor, &e.Action, &params, &e.Date, &unix, &e.Remote); err != nil {
+			return nil, err
+		}
+
+		e.Params = json.RawMessage(params)
+		e.Time = time.Unix(unix, 0)
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
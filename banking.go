@@ -7,11 +7,13 @@ import (
 	"database/sql"
 	"fmt"
 	"path"
+	"path/filepath"
 	"os"
 	"bytes"
 	"html/template"
+	"time"
 
-
+	"github.com/flytam/filenamify"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/extension"
@@ -24,8 +26,19 @@ type Account struct {
 	Holder string
 	Date uint64
 	Balance int64
+	Balances []CurrencyBalance
 	Transactions []Transaction
 	Letters []Letter
+	Loans []Loan
+	StandingOrders []StandingOrder
+	Escrows []Escrow
+	Invoices []Invoice
+	Member string // the member logged in to a joint account
+	Pending []PendingTransfer
+	User string // the user logged in, if not the account itself
+	Role string
+	Linked []LinkedAccount // the accounts the user can switch to
+	Users []LinkedAccount // the users the account is shared with, for its owners
 }
 
 type Transaction struct {
@@ -33,13 +46,34 @@ type Transaction struct {
 	Date uint64
 	Concept string
 	Amount int64
+	Currency string
+	Symbol string
 	Creditor int64
 	Debitor int64
 	Payed bool
 	Revoked bool
+	Failed bool
+	Status string
 	To_from string
 }
 
+// Transaction status, as shown to the account holders
+const (
+	TX_PENDING = "pending"
+	TX_PAYED = "payed"
+	TX_BOUNCED = "bounced"
+)
+
+func (t *Transaction) setStatus() {
+	if t.Failed {
+		t.Status = TX_BOUNCED
+	} else if t.Payed {
+		t.Status = TX_PAYED
+	} else {
+		t.Status = TX_PENDING
+	}
+}
+
 type Letter struct {
 	Timestamp uint64
 	Sender int64
@@ -56,7 +90,13 @@ type Letter struct {
 
 type Bank struct {
 	db *sql.DB
-	clock uint64
+	letters string // where letter files are written, next to the database
+}
+
+// lettersDir is the directory letters are written to: bank/letters beside
+// the database file, wherever the server runs from.
+func lettersDir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "bank", "letters")
 }
 
 var md goldmark.Markdown =  goldmark.New(
@@ -67,7 +107,7 @@ func (b *Bank) LoadDoc(letter_id uint64) (Letter, error) {
 	// Load document and its metadata (the same as a Letter)
 	var l Letter
 	err := b.db.QueryRow(
-		"SELECT sender, Path, Title, date, coalesce(public, 0), id FROM letters WHERE id = $1 and public = 1 ORDER BY id ASC;",
+		"SELECT sender, Path, Title, date, coalesce(public, 0), id FROM letters WHERE id = $1 and public = 1 and Date <= (SELECT clock FROM system WHERE id = 1) ORDER BY id ASC;",
 		letter_id).Scan(&l.Sender, &l.Path, &l.Title, &l.Date, &l.Public, &l.Timestamp)
 
 
@@ -145,6 +185,26 @@ func (a *Account) LoadLetter(letter_id uint64, b *Bank) (Letter, error) {
 }
 
 
+// NewLetter writes a letter from an account, ready to be sent or published.
+// Letters are identified by the time they were written.
+func (b *Bank) NewLetter(a *Account, receiver int64, title string, body string) (*Letter, error) {
+	now := time.Now()
+	directory := fmt.Sprintf("%d-%s", a.Id, a.Holder)
+	date := b.GetDate()
+	clock := fmt.Sprintf("%d", date)
+	name, err := filenamify.Filenamify(title, filenamify.Options{
+		Replacement: "_",
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(b.letters, directory, fmt.Sprintf("%s-%s_%s_to_%d.txt", clock, now.Format("2006_01_02"), name, receiver))
+
+	return &Letter{Timestamp: uint64(now.Unix()), Sender: a.Id, Receiver: receiver, Date: date, Path: path, Title: title, Body: []byte(body)}, nil
+}
+
 func (l *Letter) Send(b *Bank) error {
 	insert := `
 	INSERT INTO letters 
@@ -164,7 +224,7 @@ func (l *Letter) Send(b *Bank) error {
 		return err
 	}
 
-	err = os.MkdirAll(path.Dir(l.Path), 0600)
+	err = os.MkdirAll(filepath.Dir(l.Path), 0700)
 
 	if err != nil {
 		log.Println("Error creatinG directories: " + err.Error())
@@ -193,14 +253,14 @@ func (l *Letter) Publish(b *Bank) error {
 		return err
 	}
 
-	err = os.MkdirAll(path.Dir(l.Path), 0600)
+	err = os.MkdirAll(filepath.Dir(l.Path), 0700)
 
 	if err != nil {
 		log.Println("Error creatin directories: " + err.Error())
 		return err
 	}
 
-	err = os.MkdirAll("static/archive", 0600)
+	err = os.MkdirAll("static/archive", 0700)
 
 	err = os.WriteFile(l.Path, l.Body, 0600)
 	if err != nil {
@@ -217,27 +277,36 @@ func OpenBank(filename string) (*Bank, error) {
 	if err != nil {
 		return nil, err
 	}
-	
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	var clock uint64
 	err = db.QueryRow("SELECT clock FROM system WHERE id = 1;").Scan(&clock)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &Bank{db: db, clock: clock}, nil
+	return &Bank{db: db, letters: lettersDir(filename)}, nil
 }
 
 func (b *Bank) Close() error {
 	return b.db.Close()
 }
 
+// GetDate reads the current date. The admin command line can advance the
+// clock while the server runs, so it is always read from the database.
 func (b *Bank) GetDate() uint64 {
-	err := b.db.QueryRow("SELECT clock FROM system WHERE id = 1;").Scan(&b.clock)
+	clock, err := readClock(b.db)
 	if err != nil {
 		log.Fatal("Error querying: " + err.Error())
 	}
 
-	return b.clock
+	return clock
 }
 
 type Book struct {
@@ -272,7 +341,7 @@ func (b *Bank) GetBook() ([]Book, error){
 
 
 func (b *Bank) GetArchive() ([]Letter, error){
-	rows, err := b.db.Query("SELECT id, sender, receiver, Title, Path, Date FROM letters WHERE public = 1;")
+	rows, err := b.db.Query("SELECT id, sender, receiver, Title, Path, Date FROM letters WHERE public = 1 AND Date <= (SELECT clock FROM system WHERE id = 1);")
 
 	if err != nil {
 		return nil, err
@@ -340,14 +409,46 @@ func (b *Bank) LoadAccountById(id int64) (*Account, error) {
 		return nil, err
 	}
 
-	a.Balance = b.balance(id)
-	a.Transactions, err = b.getTransactions(id)
+	date := b.GetDate()
+	a.Balance = b.balance(id, DEFAULT_CURRENCY)
+	a.Balances = b.balances(id)
+	a.Transactions, err = b.getTransactions(id, date)
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+		return nil, err
+	}
+
+	a.Letters, err = b.getLetters(id, date)
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+		return nil, err
+	}
+
+	a.Loans, err = b.GetLoans(&id, false)
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+		return nil, err
+	}
+
+	a.StandingOrders, err = b.GetStandingOrders(&id)
 	if err != nil {
 		log.Println("Error querying: " + err.Error())
 		return nil, err
 	}
 
-	a.Letters, err = b.getLetters(id)
+	a.Escrows, err = b.GetEscrows(&id, false)
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+		return nil, err
+	}
+
+	a.Invoices, err = b.GetInvoices(&id, true)
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+		return nil, err
+	}
+
+	a.Pending, err = b.GetPendingTransfers(id, true)
 	if err != nil {
 		log.Println("Error querying: " + err.Error())
 		return nil, err
@@ -381,96 +482,101 @@ func (b *Bank) LoadAccount(credentials string) (*Account) {
 	}
 
 
-	balance := b.balance(int64(id))
+	balance := b.balance(int64(id), DEFAULT_CURRENCY)
 
-	transactions, err := b.getTransactions(int64(id))
+	transactions, err := b.getTransactions(int64(id), b.GetDate())
 	
 	if err != nil {
 		log.Println("Error querying: " + err.Error())
 		return nil
 	}
 	
-	letters, err := b.getLetters(int64(id))
+	letters, err := b.getLetters(int64(id), b.GetDate())
 	if err != nil {
 		log.Println("Error querying: " + err.Error())
 		return nil
 	}
 
-	return &Account{Id: int64(id), Holder: holder, Date: date, Balance: balance, Transactions: transactions, Letters: letters}
+	return &Account{Id: int64(id), Holder: holder, Date: date, Balance: balance, Balances: b.balances(int64(id)), Transactions: transactions, Letters: letters}
 } 
 
-func (b *Bank) Transfer(from uint64, to uint64, amount int64, due uint64, concept string) error {
-	insert := `
-		INSERT INTO transactions 
-		(creditor, debitor, amount, concept, date_created, date_due, payed, revoked)
-		VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8)
-	`
+func (b *Bank) Transfer(from uint64, to uint64, amount int64, currency string, due uint64, concept string) error {
+	// The checks and the insert run in one transaction, so two orders made
+	// at the same time cannot both spend the same funds
+	return serializable(b.db, func(tx *sql.Tx) error {
+		// Above its threshold, a joint account transfers once its members
+		// approve, see ProposeTransfer
+		if err := checkApproval(tx, int64(from), amount); err != nil {
+			return err
+		}
 
-	// TODO: check if transaction is valid, and tidy up error messages
-	// cannot transfer to self!
-	if from == to {
-		return fmt.Errorf(ERR_TRANSFER_TO_SELF)
-	}
+		_, err := transfer(tx, int64(from), int64(to), amount, currency, due, concept)
+		return err
+	})
+}
 
-	// cannot transfer if balance is lesser than amount
-	if amount > b.balance(int64(from)) {
-		return fmt.Errorf(ERR_INSUFFICIENT_FUNDS)
+// transfer checks and orders a transfer, with its fee, and returns its id.
+func transfer(q dbtx, from int64, to int64, amount int64, currency string, due uint64, concept string) (int64, error) {
+	p, err := checkTransfer(q, from, to, amount, currency, due, concept)
+	if err != nil {
+		return 0, err
 	}
 
-	// cannot transfer negative moneys
-	if amount < 0 {
-		return fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	policy, err := loadBouncePolicy(q)
+	if err != nil {
+		return 0, err
 	}
 
-	// cannot transfer in the past!
-	if due < b.clock {
-		return fmt.Errorf(ERR_TIME_TRAVEL_IMPOSSIBLE)
+	date, err := readClock(q)
+	if err != nil {
+		return 0, err
 	}
 
-	// cannot transfer to no one or a non existing account
-	_, err := b.GetAccountHolder(int64(to))
+	id, feeId, err := orderTransfer(q, from, to, amount, p.Fee, currency, concept, date, due)
 	if err != nil {
-		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+		log.Println("Error inserting: " + err.Error())
+		return 0, err
 	}
 
+	// Transfers due today settle right away, the same way the clock settles them
+	if due == date {
+		t := Transaction{Id: id, Date: due, Concept: concept, Amount: amount, Currency: currency, Creditor: to, Debitor: from}
+		if _, err = settleTransaction(q, t, date, policy); err != nil {
+			return 0, err
+		}
 
-	payed := due == b.GetDate() 
-
-	// Sanitize input and checks put in banking
-	_, err = b.db.Exec(insert, to, from, amount, concept, b.clock, due, payed, false)
-	if err != nil {
-		log.Println("Error inserting: " + err.Error())
-		return err
+		if feeId != 0 {
+			t = Transaction{Id: feeId, Date: due, Amount: p.Fee, Currency: currency, Creditor: ACCOUNT_VAULT, Debitor: from}
+			if _, err = settleTransaction(q, t, date, policy); err != nil {
+				return 0, err
+			}
+		}
 	}
-	return nil
+
+	return id, nil
 }
 
-func (b *Bank) balance(id int64) int64 {
-	// error handling
-	debits_query := "select coalesce(sum(amount), 0) from transactions where debitor = $1 and payed = 1 and revoked = 0;"
-	credits_query := "select coalesce(sum(amount), 0) from transactions where creditor = $1 and payed = 1 and revoked = 0;"
-	
-	_ = b.GetDate()
-	
-	var credits, debits int64
-	err := b.db.QueryRow(debits_query, id).Scan(&debits)
-	if err != nil {
-		log.Println("Error querying for debits: " + err.Error())
-		return 0
-	}
-	err = b.db.QueryRow(credits_query, id).Scan(&credits)
+func (b *Bank) balance(id int64, currency string) int64 {
+	balance, err := ledgerBalance(b.db, id, currency)
 	if err != nil {
-		log.Println("Error querying for credits: " + err.Error())
+		log.Println("Error querying for balance: " + err.Error())
 		return 0
 	}
-	return credits - debits
+	return balance
 }
 
 
 
-func (b *Bank) getTransactions(id int64) ([]Transaction, error) {
-	rows, err := b.db.Query("SELECT id, date_due, concept, amount, creditor, debitor, payed FROM transactions WHERE (debitor = $1 or creditor = $2) and revoked = 0 ORDER BY id DESC;", id, id)
+// getTransactions lists the transactions of an account as they stood on
+// date: the ones created later are left out, and the ones settled later are
+// still pending.
+func (b *Bank) getTransactions(id int64, date uint64) ([]Transaction, error) {
+	rows, err := b.db.Query(`
+		SELECT id, date_due, concept, amount, currency, symbol, creditor, debitor,
+		payed = 1 AND coalesce(date_settled, date_due) <= $1,
+		failed = 1 AND coalesce(date_settled, date_due) <= $1
+		FROM transactions JOIN currencies ON currencies.code = transactions.currency
+		WHERE (debitor = $2 or creditor = $3) and revoked = 0 and date_created <= $1 ORDER BY id DESC;`, date, id, id)
 
 	if err != nil {
 		return nil, err
@@ -480,10 +586,11 @@ func (b *Bank) getTransactions(id int64) ([]Transaction, error) {
 
 	for rows.Next() {
 		var t Transaction
-		if err := rows.Scan(&t.Id, &t.Date, &t.Concept, &t.Amount, &t.Creditor, &t.Debitor, &t.Payed); err != nil {
+		if err := rows.Scan(&t.Id, &t.Date, &t.Concept, &t.Amount, &t.Currency, &t.Symbol, &t.Creditor, &t.Debitor, &t.Payed, &t.Failed); err != nil {
 			return nil, err
 		}
-		
+
+		t.setStatus()
 		transactions = append(transactions, t)
 	}
 
@@ -524,8 +631,9 @@ func (b *Bank) getTransactions(id int64) ([]Transaction, error) {
 }
 
 
-func (b *Bank) getLetters(id int64) ([]Letter, error) {
-	rows, err := b.db.Query("SELECT id, sender, receiver, Title, Path, date, coalesce(public, 0) FROM letters WHERE sender = $1 or receiver = $2 or public = 1 ORDER BY id ASC;", id, id)
+// getLetters lists the letters of an account dated on or before date.
+func (b *Bank) getLetters(id int64, date uint64) ([]Letter, error) {
+	rows, err := b.db.Query("SELECT id, sender, receiver, Title, Path, date, coalesce(public, 0) FROM letters WHERE (sender = $1 or receiver = $2 or public = 1) and coalesce(date, 0) <= $3 ORDER BY id ASC;", id, id, date)
 
 	if err != nil {
 		return nil, err
@@ -569,12 +677,14 @@ func (b *Bank) getLetters(id int64) ([]Letter, error) {
 
 func (b *Bank) getTransaction(id uint64) (Transaction, error) {
 	var t Transaction
-	err := b.db.QueryRow("SELECT id, date_due, concept, amount, creditor, debitor, payed FROM transactions WHERE id = $1;", id).Scan(&t.Id, &t.Date, &t.Concept, &t.Amount, &t.Creditor, &t.Debitor, &t.Payed)
+	err := b.db.QueryRow("SELECT id, date_due, concept, amount, currency, creditor, debitor, payed, failed FROM transactions WHERE id = $1;", id).Scan(&t.Id, &t.Date, &t.Concept, &t.Amount, &t.Currency, &t.Creditor, &t.Debitor, &t.Payed, &t.Failed)
 
 	if err != nil {
 		return t, err
 	}
 
+	t.setStatus()
+
 	return t, nil
 }
 
@@ -595,18 +705,31 @@ func (b *Bank) RevokeTransaction(account_id int64, transaction_id uint64) error
 	t, err := b.getTransaction(transaction_id)
 
 	if err != nil {
+		return fmt.Errorf(ERR_TRANSACTION_NOT_FOUND)
+	}
+
+	date := b.GetDate()
+
+	// A fee cannot be revoked on its own, it goes with its transfer
+	var feeOf sql.NullInt64
+	if err = b.db.QueryRow("SELECT fee_of FROM transactions WHERE id = $1;", t.Id).Scan(&feeOf); err != nil {
 		return err
 	}
 
-	_ = b.GetDate()
+	if (t.Creditor == account_id || t.Debitor == account_id) && !t.Payed && (t.Date > date) && !feeOf.Valid {
+		err = serializable(b.db, func(tx *sql.Tx) error {
+			ids, err := transactionIds(tx, "id = $1 OR fee_of = $1", t.Id)
+			if err != nil {
+				return err
+			}
 
-	if (t.Creditor == account_id || t.Debitor == account_id) && !t.Payed && (t.Date > b.clock) {
-		_, err = b.db.Exec("UPDATE transactions SET revoked = $1 WHERE id = $2;", true, t.Id)
+			return setStatus(tx, ids, "revoked = 1")
+		})
 		if err != nil {
 			return err
 		}
 	} else {
-		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+		return fmt.Errorf(ERR_REVOKE_NOT_ALLOWED)
 	}
 
 	return nil
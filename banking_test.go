@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// Transfers made at the same time from one account must not spend the same
+// funds twice: as many succeed as the balance pays for, the rest are refused.
+func TestTransferConcurrent(t *testing.T) {
+	const (
+		funds   = 1000
+		amount  = 100
+		workers = 20
+	)
+
+	b := newTestBank(t)
+
+	from, err := b.CreateAccount("payer", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := b.CreateAccount("payee", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Deposit(from, funds, DEFAULT_CURRENCY, "funds"); err != nil {
+		t.Fatal(err)
+	}
+
+	date := b.GetDate()
+
+	// The fee, if any, is spent along with the amount
+	p, err := b.PreviewTransfer(uint64(from), uint64(to), amount, DEFAULT_CURRENCY, date, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid := int(funds / p.Total())
+
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		ok, refused int
+		unexpected  []error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := b.Transfer(uint64(from), uint64(to), amount, DEFAULT_CURRENCY, date, "test")
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err == nil:
+				ok++
+			case err.Error() == ERR_INSUFFICIENT_FUNDS:
+				refused++
+			default:
+				unexpected = append(unexpected, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range unexpected {
+		t.Error(err)
+	}
+
+	if ok != paid || refused != workers-paid {
+		t.Errorf("%d transfers made and %d refused, want %d and %d", ok, refused, paid, workers-paid)
+	}
+
+	balance, err := ledgerBalance(b.db, from, DEFAULT_CURRENCY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance < 0 {
+		t.Errorf("balance went below zero: %d", balance)
+	}
+
+	if want := int64(funds) - int64(paid)*p.Total(); balance != want {
+		t.Errorf("balance is %d, want %d", balance, want)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The admin web console does from the browser what the Lua console did on
+// the host machine: open accounts, reset their passwords, take cash in and
+// out through the deposits, withdrawals and vault accounts, advance the
+// clock, revoke any transaction and show the bank summary. It is open to
+// the admin who logs in to it with the master password. Its session has a
+// cookie of its own, never sent from other sites, and does not open the
+// account pages, nor do theirs open the console. Its actions are only taken
+// from forms posted to them.
+type ConsolePage struct {
+	Lang        string
+	Title       string
+	Clock       uint64
+	Decimals    int
+	NextAdvance time.Time
+	Paused      bool
+	Admin       bool
+	Errors      []string
+	Notices     []string
+	Accounts    []Book
+	Currencies  []Currency
+	Statements  []*Statement
+}
+
+// checkConsole loads the session of the admin, and tells if there is one.
+func checkConsole(w http.ResponseWriter, r *http.Request) bool {
+	c, err := r.Cookie(CONSOLE_COOKIE_NAME)
+	if err != nil {
+		return false
+	}
+
+	s, err := sessions.Touch(c.Value)
+	if err != nil || !s.console {
+		return false
+	}
+
+	setConsoleCookie(w, c.Value, s.expiry)
+	return true
+}
+
+func setConsoleCookie(w http.ResponseWriter, sessionToken string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CONSOLE_COOKIE_NAME,
+		Value:    sessionToken,
+		Expires:  expiresAt,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// renderConsole shows the console with the accounts and the summary of the
+// reserved ones, as the Lua bank command printed it.
+func renderConsole(w http.ResponseWriter, b *Bank, lang string, admin bool, errors []string, notices []string) {
+	d := &ConsolePage{Lang: lang, Title: TITLE_PROVISIONAL, Clock: b.GetDate(), Decimals: b.GetDecimals(), Admin: admin, Errors: errors, Notices: notices}
+	d.NextAdvance, d.Paused = scheduler.Status()
+
+	var err error
+	if admin {
+		if d.Accounts, err = b.GetAccounts(); err != nil {
+			log.Println("Error querying: " + err.Error())
+		}
+
+		if d.Currencies, err = b.GetCurrencies(); err != nil {
+			log.Println("Error querying: " + err.Error())
+		}
+
+		for _, id := range []int64{ACCOUNT_VAULT, ACCOUNT_DEPOSITS, ACCOUNT_WITHDRAWALS, ACCOUNT_ESCROW} {
+			s, err := b.Statement(id)
+			if err != nil {
+				log.Println("Error querying: " + err.Error())
+				continue
+			}
+			d.Statements = append(d.Statements, s)
+		}
+	}
+
+	if err = templates.ExecuteTemplate(w, "admin.html", d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// adminOnly runs fn only for the admin logged in to the console.
+func adminOnly(fn func(http.ResponseWriter, *http.Request, *Bank, string)) func(http.ResponseWriter, *http.Request, *Bank, string) {
+	return func(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+		if !checkConsole(w, r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fn(w, r, b, lang)
+	}
+}
+
+func consoleHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	admin := checkConsole(w, r)
+
+	var notices []string
+	if id := r.URL.Query().Get("created"); admin && id != "" {
+		notices = append(notices, GetAdminMessage(lang, MSG_ACCOUNT_CREATED)+id)
+	}
+
+	renderConsole(w, b, lang, admin, nil, notices)
+}
+
+func consoleLoginHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	if _, ok := b.Authenticate(ACCOUNT_VAULT, "", r.FormValue("password")); !ok {
+		renderConsole(w, b, lang, false, []string{ErrorStrings[lang][ERR_INCORRECT_PASSWORD]}, nil)
+		return
+	}
+
+	sessionToken, expiresAt, err := sessions.NewConsole()
+	if err != nil {
+		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Admin logged in to the console")
+	setConsoleCookie(w, sessionToken, expiresAt)
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
+
+func consoleLogoutHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	if c, err := r.Cookie(CONSOLE_COOKIE_NAME); err == nil {
+		sessions.Delete(c.Value)
+	}
+
+	setConsoleCookie(w, "", time.Now())
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
+
+func consoleCreateHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	holder := r.FormValue("holder")
+
+	id, err := b.CreateAccount(holder, r.FormValue("password"))
+	if err != nil {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, err.Error())}, nil)
+		return
+	}
+
+	log.Printf("Admin opened account %d for %s\n", id, holder)
+	consoleAudit(b, r, "create", map[string]any{"id": id, "holder": holder})
+	http.Redirect(w, r, fmt.Sprintf("/a/%s/admin/?created=%d", lang, id), http.StatusFound)
+}
+
+func consolePasswdHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	id, err := strconv.ParseInt(r.FormValue("account"), 10, 64)
+	if err != nil {
+		renderConsole(w, b, lang, true, []string{ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID]}, nil)
+		return
+	}
+
+	// The reserved accounts share the master password, it is not reset here
+	if _, err := b.GetAccountHolder(id); err != nil || id < ACCOUNT_MIN {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, ERR_ACCOUNT_NOT_FOUND_ADMIN)}, nil)
+		return
+	}
+
+	if err := b.ChangePass(id, r.FormValue("password")); err != nil {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, err.Error())}, nil)
+		return
+	}
+
+	log.Printf("Admin reset the password of account %d\n", id)
+	consoleAudit(b, r, "passwd", map[string]any{"account": id})
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
+
+// consoleCash deposits or withdraws cash, as the form asks.
+func consoleCash(w http.ResponseWriter, r *http.Request, b *Bank, lang string, cmd string, move func(int64, int64, string, string) error) {
+	var errors []string
+
+	id, err := strconv.ParseInt(r.FormValue("account"), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
+	}
+
+	amount, err := parseAmount(r.FormValue("amount"), b.GetDecimals())
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_AMOUNT_INVALID])
+	}
+
+	if len(errors) > 0 {
+		renderConsole(w, b, lang, true, errors, nil)
+		return
+	}
+
+	currency := r.FormValue("currency")
+	if currency == "" {
+		currency = DEFAULT_CURRENCY
+	}
+
+	if err := move(id, amount, currency, GetAdminMessage(lang, MSG_CASH)); err != nil {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, err.Error())}, nil)
+		return
+	}
+
+	log.Printf("Admin %s %d %s on account %d\n", cmd, amount, currency, id)
+	consoleAudit(b, r, cmd, map[string]any{"account": id, "amount": amount, "currency": currency})
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
+
+func consoleDepositHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	consoleCash(w, r, b, lang, "deposit", b.Deposit)
+}
+
+func consoleWithdrawHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	consoleCash(w, r, b, lang, "withdraw", b.Withdraw)
+}
+
+func consoleNextHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	s, err := b.AdvanceClock()
+	if err != nil {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, err.Error())}, nil)
+		return
+	}
+
+	log.Printf("Admin advanced the date to %d\n", s.Date)
+	consoleAudit(b, r, "next", map[string]any{"date": s.Date})
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
+
+func consoleRevokeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		renderConsole(w, b, lang, true, []string{ErrorStrings[lang][ERR_TRANSACTION_ID_INVALID]}, nil)
+		return
+	}
+
+	if err := b.ForceRevoke(id); err != nil {
+		renderConsole(w, b, lang, true, []string{GetBackendError(lang, err.Error())}, nil)
+		return
+	}
+
+	log.Printf("Admin revoked transaction #%d\n", id)
+	consoleAudit(b, r, "revoke", map[string]any{"id": id})
+	http.Redirect(w, r, "/a/"+lang+"/admin/", http.StatusFound)
+}
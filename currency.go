@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Every bank starts with a single currency, and the admin can define more:
+// gold and grain, or the money of each nation in the game. Balances are
+// kept apart per currency, the ledger never adds up amounts of different
+// currencies. Loans and interest are always in the default currency.
+const DEFAULT_CURRENCY = "money"
+
+const EXCHANGE_CONCEPT = "Exchange"
+
+type Currency struct {
+	Code   string
+	Symbol string
+	Name   string
+}
+
+// A CurrencyBalance is the balance of an account in one currency.
+type CurrencyBalance struct {
+	Currency
+	Amount int64
+}
+
+// An ExchangeRate tells how many units of the target currency the vault
+// gives for a number of units of the source currency. Rates are one way:
+// the bank may buy gold cheaper than it sells it.
+type ExchangeRate struct {
+	Source      string
+	Target      string
+	SourceUnits int64
+	TargetUnits int64
+}
+
+// convert is what the vault gives for amount of the source currency,
+// rounded down. It is false if the amount is too large to convert.
+func (r ExchangeRate) convert(amount int64) (int64, bool) {
+	if amount > math.MaxInt64/r.TargetUnits {
+		return 0, false
+	}
+	return amount * r.TargetUnits / r.SourceUnits, true
+}
+
+var validCurrencyCode = regexp.MustCompile("^[a-z][a-z0-9_-]*$")
+
+// loadCurrencies lists every currency, the default one first.
+func loadCurrencies(q dbtx) ([]Currency, error) {
+	rows, err := q.Query("SELECT code, symbol, name FROM currencies ORDER BY code <> $1, code ASC;", DEFAULT_CURRENCY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currencies []Currency
+	for rows.Next() {
+		var c Currency
+		if err := rows.Scan(&c.Code, &c.Symbol, &c.Name); err != nil {
+			return nil, err
+		}
+		currencies = append(currencies, c)
+	}
+
+	return currencies, rows.Err()
+}
+
+func loadCurrency(q dbtx, code string) (Currency, error) {
+	var c Currency
+	err := q.QueryRow("SELECT code, symbol, name FROM currencies WHERE code = $1;", code).Scan(&c.Code, &c.Symbol, &c.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, fmt.Errorf(ERR_CURRENCY_NOT_FOUND)
+	}
+	return c, err
+}
+
+func (b *Bank) GetCurrencies() ([]Currency, error) {
+	return loadCurrencies(b.db)
+}
+
+// SetCurrency defines a new currency, or changes how an existing one is
+// shown. Codes cannot change, the ledger refers to them.
+func (b *Bank) SetCurrency(code string, symbol string, name string) error {
+	symbol = strings.TrimSpace(symbol)
+	name = strings.TrimSpace(name)
+	if !validCurrencyCode.MatchString(code) || symbol == "" {
+		return fmt.Errorf(ERR_CURRENCY_INVALID)
+	}
+
+	if name == "" {
+		name = code
+	}
+
+	_, err := b.db.Exec("INSERT INTO currencies (code, symbol, name) VALUES ($1, $2, $3) ON CONFLICT (code) DO UPDATE SET symbol = excluded.symbol, name = excluded.name;", code, symbol, name)
+	return err
+}
+
+func (b *Bank) balances(id int64) []CurrencyBalance {
+	balances, err := ledgerBalances(b.db, id)
+	if err != nil {
+		log.Println("Error querying for balance: " + err.Error())
+		return nil
+	}
+	return balances
+}
+
+// ledgerBalances computes the balance of an account in every currency.
+func ledgerBalances(q dbtx, id int64) ([]CurrencyBalance, error) {
+	currencies, err := loadCurrencies(q)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]CurrencyBalance, len(currencies))
+	for i, c := range currencies {
+		balances[i].Currency = c
+		if balances[i].Amount, err = ledgerBalance(q, id, c.Code); err != nil {
+			return nil, err
+		}
+	}
+
+	return balances, nil
+}
+
+func loadExchangeRate(q dbtx, source string, target string) (ExchangeRate, error) {
+	r := ExchangeRate{Source: source, Target: target}
+	err := q.QueryRow("SELECT source_units, target_units FROM exchange_rates WHERE source = $1 AND target = $2;", source, target).Scan(&r.SourceUnits, &r.TargetUnits)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, fmt.Errorf(ERR_EXCHANGE_RATE_NOT_FOUND)
+	}
+	return r, err
+}
+
+func (b *Bank) GetExchangeRates() ([]ExchangeRate, error) {
+	rows, err := b.db.Query("SELECT source, target, source_units, target_units FROM exchange_rates ORDER BY source ASC, target ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []ExchangeRate
+	for rows.Next() {
+		var r ExchangeRate
+		if err := rows.Scan(&r.Source, &r.Target, &r.SourceUnits, &r.TargetUnits); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+
+	return rates, rows.Err()
+}
+
+// SetExchangeRate sets the rate from one currency to another. Zero units
+// remove the rate, so that currency cannot be bought with the other.
+func (b *Bank) SetExchangeRate(source string, target string, sourceUnits int64, targetUnits int64) error {
+	if source == target || sourceUnits < 0 || targetUnits < 0 || (sourceUnits == 0) != (targetUnits == 0) {
+		return fmt.Errorf(ERR_EXCHANGE_RATE_INVALID)
+	}
+
+	for _, code := range []string{source, target} {
+		if _, err := loadCurrency(b.db, code); err != nil {
+			return err
+		}
+	}
+
+	if sourceUnits == 0 {
+		_, err := b.db.Exec("DELETE FROM exchange_rates WHERE source = $1 AND target = $2;", source, target)
+		return err
+	}
+
+	_, err := b.db.Exec("INSERT INTO exchange_rates (source, target, source_units, target_units) VALUES ($1, $2, $3, $4) ON CONFLICT (source, target) DO UPDATE SET source_units = excluded.source_units, target_units = excluded.target_units;",
+		source, target, sourceUnits, targetUnits)
+	return err
+}
+
+// Convert exchanges amount of one currency for another at the bank's rate.
+// The account pays the vault in the source currency and the vault pays the
+// account in the target one, both right away. The vault is the other side
+// of every exchange and cannot pay out more of a currency than it holds, the
+// admin decides how much of it is in circulation. It returns the amount
+// bought.
+func (b *Bank) Convert(id int64, amount int64, source string, target string) (int64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	}
+
+	if id < ACCOUNT_MIN {
+		return 0, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	var bought int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		var holder string
+		if err := tx.QueryRow("SELECT holder FROM accounts WHERE id = $1;", id).Scan(&holder); err != nil {
+			return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+		}
+
+		rate, err := loadExchangeRate(tx, source, target)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		if bought, ok = rate.convert(amount); !ok {
+			return fmt.Errorf(ERR_EXCHANGE_TOO_LARGE)
+		}
+
+		if bought <= 0 {
+			return fmt.Errorf(ERR_EXCHANGE_TOO_SMALL)
+		}
+
+		balance, err := ledgerBalance(tx, id, source)
+		if err != nil {
+			return err
+		}
+
+		if balance < amount {
+			return fmt.Errorf(ERR_INSUFFICIENT_FUNDS)
+		}
+
+		vault, err := ledgerBalance(tx, ACCOUNT_VAULT, target)
+		if err != nil {
+			return err
+		}
+
+		if vault < bought {
+			return fmt.Errorf(ERR_EXCHANGE_VAULT_INSUFFICIENT)
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		concept := fmt.Sprintf("%s %s -> %s", EXCHANGE_CONCEPT, source, target)
+		if _, err = insertTransaction(tx, ACCOUNT_VAULT, id, amount, source, concept, date, date, true); err != nil {
+			return err
+		}
+
+		_, err = insertTransaction(tx, id, ACCOUNT_VAULT, bought, target, concept, date, date, true)
+		return err
+	})
+
+	return bought, err
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// An escrow holds a transfer until the condition of a deal is met: "pay X
+// if Y happens". The funds leave the debitor right away for the escrow
+// account, a reserved account like the vault, and wait there. They are
+// released to the creditor once both parties accept, or returned to the
+// debitor when the deadline passes with nobody disputing. A disputed
+// escrow waits for the admin, who can release or return any escrow. The
+// fee of the transfer, if any, is charged when the funds go into escrow.
+const (
+	ESCROW_HELD     = "held"
+	ESCROW_RELEASED = "released"
+	ESCROW_RETURNED = "returned"
+)
+
+type Escrow struct {
+	Id              int64
+	Debitor         int64
+	Creditor        int64
+	Amount          int64
+	Currency        string
+	Symbol          string
+	Concept         string
+	Deadline        uint64
+	Created         uint64
+	Status          string
+	DebitorAccepts  bool
+	CreditorAccepts bool
+	Disputed        bool
+	To_from         string
+}
+
+// state tells apart the changes of an escrow a page must show: accepted by
+// either party, or disputed.
+func (e Escrow) state() string {
+	return fmt.Sprintf("%s %t %t %t", e.Status, e.DebitorAccepts, e.CreditorAccepts, e.Disputed)
+}
+
+const escrowColumns = `
+	e.id, e.debitor, e.creditor, e.amount, e.currency, c.symbol, coalesce(e.concept, ''), e.deadline, e.date_created,
+	e.status, e.debitor_accepts, e.creditor_accepts, e.disputed
+	FROM escrows e JOIN currencies c ON c.code = e.currency`
+
+func scanEscrow(row interface{ Scan(...any) error }) (Escrow, error) {
+	var e Escrow
+	err := row.Scan(&e.Id, &e.Debitor, &e.Creditor, &e.Amount, &e.Currency, &e.Symbol, &e.Concept, &e.Deadline, &e.Created,
+		&e.Status, &e.DebitorAccepts, &e.CreditorAccepts, &e.Disputed)
+	return e, err
+}
+
+func loadEscrow(q dbtx, id int64) (Escrow, error) {
+	e, err := scanEscrow(q.QueryRow("SELECT "+escrowColumns+" WHERE e.id = $1;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, fmt.Errorf(ERR_ESCROW_NOT_FOUND)
+	}
+	return e, err
+}
+
+// GetEscrows lists the escrows still held that an account takes part in,
+// or every one if account is nil. With all, the closed ones are listed too.
+func (b *Bank) GetEscrows(account *int64, all bool) ([]Escrow, error) {
+	rows, err := b.db.Query("SELECT "+escrowColumns+" WHERE ($1 IS NULL OR e.debitor = $1 OR e.creditor = $1) AND ($2 OR e.status = $3) ORDER BY e.id ASC;",
+		account, all, ESCROW_HELD)
+	if err != nil {
+		return nil, err
+	}
+
+	escrows := []Escrow{}
+	for rows.Next() {
+		e, err := scanEscrow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		escrows = append(escrows, e)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return escrows, nil
+	}
+
+	for i := range escrows {
+		if escrows[i].Creditor == *account {
+			debitor, err := b.GetAccountHolder(escrows[i].Debitor)
+			if err != nil {
+				return nil, err
+			}
+			escrows[i].To_from = fmt.Sprintf("<-- %s [%04d]", debitor, escrows[i].Debitor)
+		} else {
+			creditor, err := b.GetAccountHolder(escrows[i].Creditor)
+			if err != nil {
+				return nil, err
+			}
+			escrows[i].To_from = fmt.Sprintf("--> %s [%04d]", creditor, escrows[i].Creditor)
+		}
+	}
+
+	return escrows, nil
+}
+
+// OpenEscrow moves amount from one account into escrow, to be released to
+// the other one. It is checked like a transfer due on the deadline, and
+// returns the id of the escrow.
+func (b *Bank) OpenEscrow(from uint64, to uint64, amount int64, currency string, deadline uint64, concept string) (int64, error) {
+	var id int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		p, err := checkTransfer(tx, int64(from), int64(to), amount, currency, deadline, concept)
+		if err != nil {
+			return err
+		}
+
+		if err = checkApproval(tx, int64(from), amount); err != nil {
+			return err
+		}
+
+		policy, err := loadBouncePolicy(tx)
+		if err != nil {
+			return err
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec("INSERT INTO escrows (debitor, creditor, amount, currency, concept, deadline, date_created) VALUES ($1, $2, $3, $4, $5, $6, $7);",
+			from, to, amount, currency, concept, deadline, date)
+		if err != nil {
+			return err
+		}
+
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		hold, err := insertTransaction(tx, ACCOUNT_ESCROW, int64(from), amount, currency, fmt.Sprintf("%s (escrow #%d)", concept, id), date, date, true)
+		if err != nil {
+			return err
+		}
+
+		if p.Fee > 0 {
+			feeId, err := insertFee(tx, hold, int64(from), p.Fee, currency, date, date)
+			if err != nil {
+				return err
+			}
+
+			t := Transaction{Id: feeId, Date: date, Amount: p.Fee, Currency: currency, Creditor: ACCOUNT_VAULT, Debitor: int64(from)}
+			if _, err = settleTransaction(tx, t, date, policy); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return id, err
+}
+
+// closeEscrow pays what an escrow holds to the creditor, if released, or
+// back to the debitor.
+func closeEscrow(q dbtx, e Escrow, status string, date uint64) error {
+	to := e.Debitor
+	if status == ESCROW_RELEASED {
+		to = e.Creditor
+	}
+
+	concept := fmt.Sprintf("%s (escrow #%d %s)", e.Concept, e.Id, status)
+	if _, err := insertTransaction(q, to, ACCOUNT_ESCROW, e.Amount, e.Currency, concept, date, date, true); err != nil {
+		return err
+	}
+
+	_, err := q.Exec("UPDATE escrows SET status = $1, date_closed = $2 WHERE id = $3;", status, date, e.Id)
+	return err
+}
+
+// updateEscrow loads an escrow still held for one of its parties, and lets
+// fn change it in the same transaction. The vault is never a party: the
+// admin decides with ArbitrateEscrow instead.
+func (b *Bank) updateEscrow(account int64, id int64, fn func(tx *sql.Tx, e Escrow, date uint64) error) error {
+	if account == ACCOUNT_VAULT {
+		return fmt.Errorf(ERR_ESCROW_NOT_FOUND)
+	}
+
+	party := func(e Escrow) bool {
+		return account == e.Debitor || account == e.Creditor
+	}
+	return b.heldEscrow(id, party, fn)
+}
+
+// heldEscrow loads an escrow still held, if allowed to see it, and lets fn
+// change it in the same transaction.
+func (b *Bank) heldEscrow(id int64, allowed func(e Escrow) bool, fn func(tx *sql.Tx, e Escrow, date uint64) error) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		e, err := loadEscrow(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !allowed(e) {
+			return fmt.Errorf(ERR_ESCROW_NOT_FOUND)
+		}
+
+		if e.Status != ESCROW_HELD {
+			return fmt.Errorf(ERR_ESCROW_CLOSED)
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		return fn(tx, e, date)
+	})
+}
+
+// AcceptEscrow records that one party agrees to release the escrow. Once
+// both have, the creditor is payed.
+func (b *Bank) AcceptEscrow(account int64, id int64) error {
+	return b.updateEscrow(account, id, func(tx *sql.Tx, e Escrow, date uint64) error {
+		if account == e.Debitor {
+			e.DebitorAccepts = true
+		} else {
+			e.CreditorAccepts = true
+		}
+
+		_, err := tx.Exec("UPDATE escrows SET debitor_accepts = $1, creditor_accepts = $2 WHERE id = $3;", e.DebitorAccepts, e.CreditorAccepts, e.Id)
+		if err != nil || !e.DebitorAccepts || !e.CreditorAccepts {
+			return err
+		}
+
+		return closeEscrow(tx, e, ESCROW_RELEASED, date)
+	})
+}
+
+// DisputeEscrow withdraws the acceptance of one party and leaves the
+// escrow for the admin to decide: it is no longer returned on its
+// deadline. Both parties can still agree to release it.
+func (b *Bank) DisputeEscrow(account int64, id int64) error {
+	return b.updateEscrow(account, id, func(tx *sql.Tx, e Escrow, date uint64) error {
+		column := "creditor_accepts"
+		if account == e.Debitor {
+			column = "debitor_accepts"
+		}
+
+		_, err := tx.Exec("UPDATE escrows SET disputed = 1, "+column+" = 0 WHERE id = $1;", e.Id)
+		return err
+	})
+}
+
+// ArbitrateEscrow is the admin releasing an escrow to the creditor, or
+// returning it to the debitor, whatever the parties said.
+func (b *Bank) ArbitrateEscrow(id int64, release bool) error {
+	anyone := func(e Escrow) bool { return true }
+	return b.heldEscrow(id, anyone, func(tx *sql.Tx, e Escrow, date uint64) error {
+		status := ESCROW_RETURNED
+		if release {
+			status = ESCROW_RELEASED
+		}
+		return closeEscrow(tx, e, status, date)
+	})
+}
+
+// expireEscrows returns to the debitor every undisputed escrow whose
+// deadline is before date.
+func expireEscrows(q dbtx, date uint64) error {
+	rows, err := q.Query("SELECT "+escrowColumns+" WHERE e.status = $1 AND e.disputed = 0 AND e.deadline < $2 ORDER BY e.id ASC;", ESCROW_HELD, date)
+	if err != nil {
+		return err
+	}
+
+	var expired []Escrow
+	for rows.Next() {
+		e, err := scanEscrow(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		if err := closeEscrow(q, e, ESCROW_RETURNED, date); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The live feed pushes what changes in an account to its open pages, with
+// Server-Sent Events. The clock can be advanced by the admin command line
+// from another process, so the feed watches the database instead of waiting
+// to be told.
+
+const (
+	FEED_POLL_INTERVAL = time.Second
+	FEED_KEEPALIVE     = 30 * time.Second
+)
+
+// A feedVersion changes whenever anything an account page shows may have
+// changed: the date, new transactions, settled or revoked ones, letters,
+// invoices, transfers waiting for approvals, escrows accepted or disputed,
+// or standing orders created or cancelled.
+type feedVersion struct {
+	clock       uint64
+	transaction int64
+	closed      int64
+	letter      int64
+	invoice     int64
+	answered    int64
+	pending     int64
+	approved    int64
+	decided     int64
+	escrow      int64
+	escrowed    int64
+	standing    int64
+	cancelled   int64
+}
+
+func readFeedVersion(q dbtx) (feedVersion, error) {
+	var v feedVersion
+	err := q.QueryRow(`
+		SELECT clock,
+		(SELECT coalesce(max(id), 0) FROM transactions),
+		(SELECT count(*) FROM transactions WHERE payed = 1 OR failed = 1 OR revoked = 1),
+		(SELECT coalesce(max(id), 0) FROM letters),
+		(SELECT coalesce(max(id), 0) FROM invoices),
+		(SELECT count(*) FROM invoices WHERE status <> 'open'),
+		(SELECT coalesce(max(id), 0) FROM pending_transfers),
+		(SELECT count(*) FROM approvals),
+		(SELECT count(*) FROM pending_transfers WHERE status <> 'pending'),
+		(SELECT coalesce(max(id), 0) FROM escrows),
+		(SELECT coalesce(sum(debitor_accepts + creditor_accepts + disputed + (status <> 'held')), 0) FROM escrows),
+		(SELECT coalesce(max(id), 0) FROM standing_orders),
+		(SELECT count(*) FROM standing_orders WHERE cancelled = 1)
+		FROM system WHERE id = 1;`).Scan(&v.clock, &v.transaction, &v.closed, &v.letter, &v.invoice, &v.answered, &v.pending, &v.approved, &v.decided,
+		&v.escrow, &v.escrowed, &v.standing, &v.cancelled)
+	return v, err
+}
+
+// A Feed wakes up every subscribed stream when the bank changes.
+type Feed struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]bool
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: map[chan struct{}]bool{}}
+}
+
+func (f *Feed) Subscribe() chan struct{} {
+	c := make(chan struct{}, 1)
+
+	f.mu.Lock()
+	f.subs[c] = true
+	f.mu.Unlock()
+
+	return c
+}
+
+func (f *Feed) Unsubscribe(c chan struct{}) {
+	f.mu.Lock()
+	delete(f.subs, c)
+	f.mu.Unlock()
+}
+
+// Notify wakes up every stream. A stream that has not caught up with the
+// last change yet is not woken twice.
+func (f *Feed) Notify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for c := range f.subs {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watch polls the database every interval and notifies the streams when it
+// changes, until the program ends.
+func (f *Feed) Watch(b *Bank, interval time.Duration) {
+	last, err := readFeedVersion(b.db)
+	if err != nil {
+		log.Println("Error watching the bank: " + err.Error())
+	}
+
+	for range time.Tick(interval) {
+		v, err := readFeedVersion(b.db)
+		if err != nil {
+			log.Println("Error watching the bank: " + err.Error())
+			continue
+		}
+
+		if v != last {
+			last = v
+			f.Notify()
+		}
+	}
+}
+
+// feedState is what a stream last told its page about the account.
+type feedState struct {
+	clock        uint64
+	balances     map[string]int64
+	transactions map[int64]string
+	letters      map[uint64]bool
+	invoices     map[int64]string
+	pending      map[int64]string
+	escrows      map[int64]string
+	standing     string
+}
+
+func newFeedState(clock uint64, a *Account) *feedState {
+	s := &feedState{clock: clock, balances: map[string]int64{}, transactions: map[int64]string{}, letters: map[uint64]bool{}, invoices: map[int64]string{}, pending: map[int64]string{}, escrows: map[int64]string{}}
+	for _, c := range a.Balances {
+		s.balances[c.Code] = c.Amount
+	}
+	for _, t := range a.Transactions {
+		s.transactions[t.Id] = t.Status
+	}
+	for _, l := range a.Letters {
+		s.letters[l.Timestamp] = true
+	}
+	for _, i := range a.Invoices {
+		s.invoices[i.Id] = i.Status
+	}
+	for _, p := range a.Pending {
+		s.pending[p.Id] = p.state()
+	}
+	for _, e := range a.Escrows {
+		s.escrows[e.Id] = e.state()
+	}
+	s.standing = standingState(a.StandingOrders)
+	return s
+}
+
+// standingState tells apart the standing orders a page shows: which are
+// active, and when each pays next.
+func standingState(orders []StandingOrder) string {
+	var b strings.Builder
+	for _, o := range orders {
+		fmt.Fprintf(&b, "%d %d,", o.Id, o.Next)
+	}
+	return b.String()
+}
+
+func sendEvent(w http.ResponseWriter, event string, v any) error {
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: ", event); err != nil {
+		return err
+	}
+
+	// The encoder ends the data with a new line, one more ends the event
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
+// update sends the events that take the page from s to the account a, and
+// remembers them. Transactions are sent oldest first.
+func (s *feedState) update(w http.ResponseWriter, clock uint64, a *Account) error {
+	if clock != s.clock {
+		s.clock = clock
+		if err := sendEvent(w, "clock", &struct {
+			Clock uint64 `json:"clock"`
+		}{clock}); err != nil {
+			return err
+		}
+	}
+
+	for i := len(a.Transactions) - 1; i >= 0; i-- {
+		t := a.Transactions[i]
+		status, seen := s.transactions[t.Id]
+		s.transactions[t.Id] = t.Status
+
+		event := "transaction"
+		if seen {
+			if status == t.Status {
+				continue
+			}
+			event = "settlement"
+		}
+
+		if err := sendEvent(w, event, toAPITransactions([]Transaction{t})[0]); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range a.Letters {
+		if s.letters[l.Timestamp] {
+			continue
+		}
+		s.letters[l.Timestamp] = true
+
+		if err := sendEvent(w, "letter", toAPILetter(l)); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range a.Invoices {
+		if status, seen := s.invoices[i.Id]; seen && status == i.Status {
+			continue
+		}
+		s.invoices[i.Id] = i.Status
+
+		if err := sendEvent(w, "invoice", toAPIInvoice(i)); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range a.Pending {
+		if state, seen := s.pending[p.Id]; seen && state == p.state() {
+			continue
+		}
+		s.pending[p.Id] = p.state()
+
+		if err := sendEvent(w, "approval", toAPIPending(p)); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range a.Escrows {
+		if state, seen := s.escrows[e.Id]; seen && state == e.state() {
+			continue
+		}
+		s.escrows[e.Id] = e.state()
+
+		if err := sendEvent(w, "escrow", toAPIEscrow(e)); err != nil {
+			return err
+		}
+	}
+
+	// A cancelled or ended order leaves the list, so the whole list is sent
+	if standing := standingState(a.StandingOrders); standing != s.standing {
+		s.standing = standing
+		if err := sendEvent(w, "standing", toAPIStandingOrders(a.StandingOrders)); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range a.Balances {
+		if amount, seen := s.balances[c.Code]; seen && amount == c.Amount {
+			continue
+		}
+		s.balances[c.Code] = c.Amount
+
+		if err := sendEvent(w, "balance", &struct {
+			Balance  int64  `json:"balance"`
+			Currency string `json:"currency"`
+		}{c.Amount, c.Code}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// streamEvents keeps sending the changes of the account logged in with the
+// session token, until the client leaves or the session ends.
+func streamEvents(w http.ResponseWriter, r *http.Request, b *Bank, sessionToken string, a *Account) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	updates := feed.Subscribe()
+	defer feed.Unsubscribe(updates)
+
+	state := newFeedState(b.GetDate(), a)
+
+	fmt.Fprint(w, "retry: 5000\n\n")
+	rc.Flush()
+
+	keepalive := time.NewTicker(FEED_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case <-updates:
+			// Only requests keep the session alive, not the stream
+			next, err := peekSession(b, sessionToken)
+			if err != nil {
+				sendEvent(w, "logout", &struct{}{})
+				rc.Flush()
+				return
+			}
+
+			// A user switched the session to another of their accounts:
+			// the page starts over with it
+			if next.Id != a.Id {
+				a = next
+				state = newFeedState(b.GetDate(), a)
+				if err = sendEvent(w, "account", &struct {
+					Account int64 `json:"account"`
+				}{a.Id}); err != nil {
+					return
+				}
+				break
+			}
+
+			if err = state.update(w, b.GetDate(), next); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	streamEvents(w, r, b, c.Value, a)
+}
+
+func apiEventsHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkBearerToken(b, r)
+	if err != nil {
+		apiUnauthorized(w)
+		return
+	}
+
+	token, _ := bearerToken(r)
+	streamEvents(w, r, b, token, a)
+}
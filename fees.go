@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The bank may charge a fee on the transfers players order. A fee rule is
+// a flat amount plus a rate in basis points of the amount, kept between a
+// minimum and a maximum. A rule can be for the accounts of one class, for
+// the transfers to one account, or for both; the most specific rule that
+// matches a transfer is the one that applies. The fee is charged in the
+// currency of the transfer, in a transaction to the vault linked to it: it
+// falls due with the transfer, and bounces or is revoked along with it.
+// Transfers to the vault pay the bank already and carry no fee.
+
+const FEE_CONCEPT = "Fee"
+
+// FEE_ANY is the class or counterparty of a rule that matches any.
+const FEE_ANY = "any"
+
+type FeeRule struct {
+	Id           int64
+	Class        string // empty for every class
+	Counterparty int64  // 0 for every account
+	Flat         int64
+	Rate         int64 // basis points of the amount
+	Min          int64
+	Max          int64 // 0 for no maximum
+}
+
+// fee computes what the rule charges on amount, the rate rounded down.
+func (f FeeRule) fee(amount int64) int64 {
+	fee := f.Flat + amount*f.Rate/10000
+	if fee < f.Min {
+		fee = f.Min
+	}
+	if f.Max > 0 && fee > f.Max {
+		fee = f.Max
+	}
+	return fee
+}
+
+// A TransferPreview is a transfer checked the way Transfer checks it, with
+// what it will cost the debitor, before it is ordered.
+type TransferPreview struct {
+	To        int64
+	Amount    int64
+	Currency  string
+	Symbol    string
+	Due       uint64
+	Concept   string
+	Fee       int64
+	Escrow    bool  // held in escrow, due being its deadline
+	Invoice   int64 // the invoice it pays, if any
+	Approvals int64 // the members of a joint account that must approve it, if any
+}
+
+// Total is everything the transfer takes from the debitor.
+func (p TransferPreview) Total() int64 {
+	return p.Amount + p.Fee
+}
+
+func (b *Bank) GetFeeRules() ([]FeeRule, error) {
+	rows, err := b.db.Query("SELECT id, class, counterparty, flat, rate, minimum, maximum FROM fee_rules ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []FeeRule
+	for rows.Next() {
+		var f FeeRule
+		if err := rows.Scan(&f.Id, &f.Class, &f.Counterparty, &f.Flat, &f.Rate, &f.Min, &f.Max); err != nil {
+			return nil, err
+		}
+		rules = append(rules, f)
+	}
+
+	return rules, rows.Err()
+}
+
+// AddFeeRule adds a rule and returns its id.
+func (b *Bank) AddFeeRule(f FeeRule) (int64, error) {
+	f.Class = strings.TrimSpace(f.Class)
+	if f.Flat < 0 || f.Rate < 0 || f.Min < 0 || f.Max < 0 || (f.Max > 0 && f.Max < f.Min) {
+		return 0, fmt.Errorf(ERR_FEE_RULE_INVALID)
+	}
+
+	if f.Counterparty != 0 {
+		if _, err := b.GetAccountHolder(f.Counterparty); err != nil {
+			return 0, fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+		}
+	}
+
+	res, err := b.db.Exec("INSERT INTO fee_rules (class, counterparty, flat, rate, minimum, maximum) VALUES ($1, $2, $3, $4, $5, $6);",
+		f.Class, f.Counterparty, f.Flat, f.Rate, f.Min, f.Max)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (b *Bank) RemoveFeeRule(id int64) error {
+	res, err := b.db.Exec("DELETE FROM fee_rules WHERE id = $1;", id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf(ERR_FEE_RULE_NOT_FOUND)
+	}
+	return nil
+}
+
+// transferFee is the fee on a transfer of amount from one account to
+// another, under the most specific rule that matches it.
+func transferFee(q dbtx, from int64, to int64, amount int64) (int64, error) {
+	if to == ACCOUNT_VAULT {
+		return 0, nil
+	}
+
+	var f FeeRule
+	err := q.QueryRow(`
+		SELECT flat, rate, minimum, maximum FROM fee_rules
+		WHERE (class = '' OR class = (SELECT class FROM accounts WHERE id = $1))
+		AND (counterparty = 0 OR counterparty = $2)
+		ORDER BY counterparty <> 0 DESC, class <> '' DESC, id ASC LIMIT 1;`, from, to).Scan(&f.Flat, &f.Rate, &f.Min, &f.Max)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return f.fee(amount), nil
+}
+
+// checkTransfer runs every check of a transfer and works out its fee,
+// without ordering it.
+func checkTransfer(q dbtx, from int64, to int64, amount int64, currency string, due uint64, concept string) (TransferPreview, error) {
+	p := TransferPreview{To: to, Amount: amount, Currency: currency, Due: due, Concept: concept}
+
+	// cannot transfer to self!
+	if from == to {
+		return p, fmt.Errorf(ERR_TRANSFER_TO_SELF)
+	}
+
+	// cannot transfer negative moneys
+	if amount < 0 {
+		return p, fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	}
+
+	policy, err := loadBouncePolicy(q)
+	if err != nil {
+		return p, err
+	}
+
+	// cannot transfer in a currency the bank does not have
+	c, err := loadCurrency(q, currency)
+	if err != nil {
+		return p, err
+	}
+	p.Symbol = c.Symbol
+
+	// cannot transfer to no one or a non existing account
+	var holder string
+	if err = q.QueryRow("SELECT holder FROM accounts WHERE id = $1;", to).Scan(&holder); err != nil {
+		return p, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if p.Fee, err = transferFee(q, from, to, amount); err != nil {
+		return p, err
+	}
+
+	balance, err := ledgerBalance(q, from, currency)
+	if err != nil {
+		return p, err
+	}
+
+	// cannot transfer if balance (plus overdraft, if allowed) is lesser than amount and fee
+	if p.Total() > policy.available(balance, currency) {
+		return p, fmt.Errorf(ERR_INSUFFICIENT_FUNDS)
+	}
+
+	date, err := readClock(q)
+	if err != nil {
+		return p, err
+	}
+
+	// cannot transfer in the past!
+	if due < date {
+		return p, fmt.Errorf(ERR_TIME_TRAVEL_IMPOSSIBLE)
+	}
+
+	return p, nil
+}
+
+// PreviewTransfer tells what a transfer would cost, or why it would be
+// refused, without ordering it.
+func (b *Bank) PreviewTransfer(from uint64, to uint64, amount int64, currency string, due uint64, concept string) (TransferPreview, error) {
+	p, err := checkTransfer(b.db, int64(from), int64(to), amount, currency, due, concept)
+	if err != nil {
+		return p, err
+	}
+
+	j, err := loadJointPolicy(b.db, int64(from))
+	if j.needsApproval(amount) {
+		p.Approvals = j.Required
+	}
+	return p, err
+}
+
+// orderTransfer inserts a transfer and its fee, if there is one, and returns
+// the ids of both. Neither is checked nor settled here.
+func orderTransfer(q dbtx, from int64, to int64, amount int64, fee int64, currency string, concept string, created uint64, due uint64) (int64, int64, error) {
+	id, err := insertTransaction(q, to, from, amount, currency, concept, created, due, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var feeId int64
+	if fee > 0 {
+		if feeId, err = insertFee(q, id, from, fee, currency, created, due); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return id, feeId, nil
+}
+
+// insertFee orders the fee of transfer id, due along with it.
+func insertFee(q dbtx, id int64, debitor int64, fee int64, currency string, created uint64, due uint64) (int64, error) {
+	concept := fmt.Sprintf("%s (#%d)", FEE_CONCEPT, id)
+	feeId, err := insertTransaction(q, ACCOUNT_VAULT, debitor, fee, currency, concept, created, due, false)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = q.Exec("UPDATE transactions SET fee_of = $1 WHERE id = $2;", id, feeId)
+	return feeId, err
+}
@@ -3,12 +3,15 @@ module github.com/uri-nyx/eco-nomic
 go 1.24.6
 
 require (
-	github.com/flytam/filenamify v1.2.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/ncruces/go-sqlite3 v0.27.1 // indirect
+	github.com/flytam/filenamify v1.2.0
+	github.com/google/uuid v1.6.0
+	github.com/ncruces/go-sqlite3 v0.27.1
+	github.com/yuin/goldmark v1.7.13
+	golang.org/x/crypto v0.41.0
+)
+
+require (
 	github.com/ncruces/julianday v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.9.0 // indirect
-	github.com/yuin/goldmark v1.7.13 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 )
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Savings interest is payed from the vault to every player account with a
+// positive balance each time the clock advances. Rates are in basis points
+// per date; an account class may have its own rate instead of the bank's.
+const (
+	ROUND_FLOOR   = "floor"
+	ROUND_NEAREST = "round"
+	ROUND_CEIL    = "ceil"
+)
+
+const INTEREST_CONCEPT = "Interest"
+
+// MAX_INTEREST_RATE is a hundred times the balance per date, in basis points
+const MAX_INTEREST_RATE = 1000000
+
+type InterestPolicy struct {
+	Rate       int64
+	Rounding   string
+	ClassRates map[string]int64
+}
+
+// rateFor is the rate that applies to an account of the given class.
+func (p InterestPolicy) rateFor(class string) int64 {
+	if r, ok := p.ClassRates[class]; ok {
+		return r
+	}
+	return p.Rate
+}
+
+// interest computes balance * rate / 10000 rounded as the policy says,
+// without overflowing for any balance the vault can pay.
+func (p InterestPolicy) interest(balance int64, rate int64) int64 {
+	// Rates set before they were checked never pay more than the most
+	rate = min(rate, MAX_INTEREST_RATE)
+	n := balance % 10000 * rate
+	q, r := balance/10000*rate+n/10000, n%10000
+
+	switch p.Rounding {
+	case ROUND_CEIL:
+		if r > 0 {
+			q++
+		}
+	case ROUND_NEAREST:
+		if r*2 >= 10000 {
+			q++
+		}
+	}
+
+	return q
+}
+
+func loadInterestPolicy(q dbtx) (InterestPolicy, error) {
+	p := InterestPolicy{ClassRates: map[string]int64{}}
+
+	err := q.QueryRow("SELECT interest_rate, interest_rounding FROM system WHERE id = 1;").Scan(&p.Rate, &p.Rounding)
+	if err != nil {
+		return p, err
+	}
+
+	rows, err := q.Query("SELECT class, rate FROM interest_rates;")
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var class string
+		var rate int64
+		if err := rows.Scan(&class, &rate); err != nil {
+			return p, err
+		}
+		p.ClassRates[class] = rate
+	}
+
+	return p, rows.Err()
+}
+
+func (b *Bank) GetInterestPolicy() (InterestPolicy, error) {
+	return loadInterestPolicy(b.db)
+}
+
+func (b *Bank) SetInterestRate(rate int64, rounding string) error {
+	if rate < 0 || rate > MAX_INTEREST_RATE {
+		return fmt.Errorf(ERR_RATE_INVALID)
+	}
+
+	switch rounding {
+	case ROUND_FLOOR, ROUND_NEAREST, ROUND_CEIL:
+	default:
+		return fmt.Errorf(ERR_ROUNDING_INVALID)
+	}
+
+	_, err := b.db.Exec("UPDATE system SET interest_rate = $1, interest_rounding = $2 WHERE id = 1;", rate, rounding)
+	return err
+}
+
+// SetClassRate sets the interest rate of an account class. A negative
+// rate removes it, so the class gets the bank's rate again.
+func (b *Bank) SetClassRate(class string, rate int64) error {
+	class = strings.TrimSpace(class)
+	if class == "" {
+		return fmt.Errorf(ERR_CLASS_INVALID)
+	}
+
+	if rate < 0 {
+		_, err := b.db.Exec("DELETE FROM interest_rates WHERE class = $1;", class)
+		return err
+	}
+
+	if rate > MAX_INTEREST_RATE {
+		return fmt.Errorf(ERR_RATE_INVALID)
+	}
+
+	_, err := b.db.Exec("INSERT INTO interest_rates (class, rate) VALUES ($1, $2) ON CONFLICT (class) DO UPDATE SET rate = excluded.rate;", class, rate)
+	return err
+}
+
+func (b *Bank) GetAccountClass(id int64) (string, error) {
+	var class string
+	err := b.db.QueryRow("SELECT class FROM accounts WHERE id = $1;", id).Scan(&class)
+	if err != nil {
+		return "", fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+	return class, nil
+}
+
+func (b *Bank) SetAccountClass(id int64, class string) error {
+	class = strings.TrimSpace(class)
+	if class == "" {
+		return fmt.Errorf(ERR_CLASS_INVALID)
+	}
+
+	if _, err := b.GetAccountClass(id); err != nil {
+		return err
+	}
+
+	_, err := b.db.Exec("UPDATE accounts SET class = $1 WHERE id = $2;", class, id)
+	return err
+}
+
+// accrueInterest posts, once per date, the interest earned by every player
+// account on the balance it held coming into date. The transactions are
+// left for settlement, so an empty vault bounces them like any other.
+func accrueInterest(q dbtx, date uint64) error {
+	var last uint64
+	if err := q.QueryRow("SELECT interest_date FROM system WHERE id = 1;").Scan(&last); err != nil {
+		return err
+	}
+
+	if date <= last {
+		return nil
+	}
+
+	p, err := loadInterestPolicy(q)
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.Query("SELECT id, class FROM accounts WHERE id >= $1 ORDER BY id ASC;", ACCOUNT_MIN)
+	if err != nil {
+		return err
+	}
+
+	type holder struct {
+		id    int64
+		class string
+	}
+
+	var accounts []holder
+	for rows.Next() {
+		var h holder
+		if err := rows.Scan(&h.id, &h.class); err != nil {
+			rows.Close()
+			return err
+		}
+		accounts = append(accounts, h)
+	}
+	rows.Close()
+
+	for _, a := range accounts {
+		rate := p.rateFor(a.class)
+		if rate == 0 {
+			continue
+		}
+
+		balance, err := ledgerBalance(q, a.id, DEFAULT_CURRENCY)
+		if err != nil {
+			return err
+		}
+
+		if balance <= 0 {
+			continue
+		}
+
+		amount := p.interest(balance, rate)
+		if amount <= 0 {
+			continue
+		}
+
+		if _, err = insertTransaction(q, a.id, ACCOUNT_VAULT, amount, DEFAULT_CURRENCY, INTEREST_CONCEPT, date, date, false); err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec("UPDATE system SET interest_date = $1 WHERE id = 1;", date)
+	return err
+}
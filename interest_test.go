@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Interest on large balances and rates is what the exact product gives,
+// rounded as the policy says, not an overflow.
+func TestInterestLarge(t *testing.T) {
+	cases := []struct{ balance, rate int64 }{
+		{10000000000000, MAX_INTEREST_RATE},
+		{9223372036854, 123457},
+		{12345, 77},
+		{9999, 1},
+	}
+
+	for _, rounding := range []string{ROUND_FLOOR, ROUND_NEAREST, ROUND_CEIL} {
+		p := InterestPolicy{Rounding: rounding}
+
+		for _, c := range cases {
+			n := new(big.Int).Mul(big.NewInt(c.balance), big.NewInt(c.rate))
+			q, r := new(big.Int).QuoRem(n, big.NewInt(10000), new(big.Int))
+
+			want := q.Int64()
+			switch {
+			case rounding == ROUND_CEIL && r.Sign() > 0,
+				rounding == ROUND_NEAREST && r.Int64()*2 >= 10000:
+				want++
+			}
+
+			if got := p.interest(c.balance, c.rate); got != want {
+				t.Errorf("%s interest on %d at %d is %d, want %d", rounding, c.balance, c.rate, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// An invoice is an account asking another one to pay it, for rent and the
+// like. The payer finds it in their inbox and pays or declines it. Paying
+// orders a transfer to the issuer, due on the date of the invoice (or at
+// once, if that has passed), and records its id in the invoice. Should that
+// transfer bounce or be revoked, the invoice is open again.
+const (
+	INVOICE_OPEN     = "open"
+	INVOICE_PAID     = "paid"
+	INVOICE_DECLINED = "declined"
+)
+
+type Invoice struct {
+	Id          int64
+	Issuer      int64
+	Payer       int64
+	Amount      int64
+	Currency    string
+	Symbol      string
+	Concept     string
+	Due         uint64
+	Created     uint64
+	Status      string
+	Transaction int64
+	To_from     string
+}
+
+// A paid invoice whose transfer bounced or was revoked is open again.
+const invoiceColumns = `
+	i.id, i.issuer, i.payer, i.amount, i.currency, c.symbol, coalesce(i.concept, ''), i.date_due, i.date_created,
+	CASE WHEN t.revoked = 1 OR t.failed = 1 THEN 'open' ELSE i.status END, coalesce(i.transaction_id, 0)
+	FROM invoices i JOIN currencies c ON c.code = i.currency LEFT JOIN transactions t ON t.id = i.transaction_id`
+
+func scanInvoice(row interface{ Scan(...any) error }) (Invoice, error) {
+	var i Invoice
+	err := row.Scan(&i.Id, &i.Issuer, &i.Payer, &i.Amount, &i.Currency, &i.Symbol, &i.Concept, &i.Due, &i.Created, &i.Status, &i.Transaction)
+	return i, err
+}
+
+// loadInvoice loads an invoice addressed to payer.
+func loadInvoice(q dbtx, payer int64, id int64) (Invoice, error) {
+	i, err := scanInvoice(q.QueryRow("SELECT "+invoiceColumns+" WHERE i.id = $1 AND i.payer = $2;", id, payer))
+	if errors.Is(err, sql.ErrNoRows) {
+		return i, fmt.Errorf(ERR_INVOICE_NOT_FOUND)
+	}
+	return i, err
+}
+
+// GetInvoices lists the invoices an account issued or has to pay, the
+// newest first, or every one if account is nil. With all, the paid and
+// declined ones are listed too.
+func (b *Bank) GetInvoices(account *int64, all bool) ([]Invoice, error) {
+	rows, err := b.db.Query("SELECT "+invoiceColumns+" WHERE ($1 IS NULL OR i.issuer = $1 OR i.payer = $1) ORDER BY i.id DESC;", account)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := []Invoice{}
+	for rows.Next() {
+		i, err := scanInvoice(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if all || i.Status == INVOICE_OPEN {
+			invoices = append(invoices, i)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return invoices, nil
+	}
+
+	for n := range invoices {
+		if invoices[n].Issuer == *account {
+			payer, err := b.GetAccountHolder(invoices[n].Payer)
+			if err != nil {
+				return nil, err
+			}
+			invoices[n].To_from = fmt.Sprintf("<-- %s [%04d]", payer, invoices[n].Payer)
+		} else {
+			issuer, err := b.GetAccountHolder(invoices[n].Issuer)
+			if err != nil {
+				return nil, err
+			}
+			invoices[n].To_from = fmt.Sprintf("--> %s [%04d]", issuer, invoices[n].Issuer)
+		}
+	}
+
+	return invoices, nil
+}
+
+// IssueInvoice asks payer to pay amount to issuer by due, and returns the
+// id of the invoice.
+func (b *Bank) IssueInvoice(issuer int64, payer int64, amount int64, currency string, due uint64, concept string) (int64, error) {
+	var id int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		if issuer == payer {
+			return fmt.Errorf(ERR_INVOICE_TO_SELF)
+		}
+
+		if amount < 0 {
+			return fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+		}
+
+		if _, err := loadCurrency(tx, currency); err != nil {
+			return err
+		}
+
+		// only players can be asked to pay, the bank has no one to click
+		var holder string
+		if payer <= ACCOUNT_VAULT || tx.QueryRow("SELECT holder FROM accounts WHERE id = $1;", payer).Scan(&holder) != nil {
+			return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		if due < date {
+			return fmt.Errorf(ERR_TIME_TRAVEL_IMPOSSIBLE)
+		}
+
+		res, err := tx.Exec("INSERT INTO invoices (issuer, payer, amount, currency, concept, date_due, date_created) VALUES ($1, $2, $3, $4, $5, $6, $7);",
+			issuer, payer, amount, currency, concept, due, date)
+		if err != nil {
+			return err
+		}
+
+		id, err = res.LastInsertId()
+		return err
+	})
+
+	return id, err
+}
+
+// invoiceTransfer checks that an invoice can be paid, and works out when.
+func invoiceTransfer(q dbtx, payer int64, id int64) (Invoice, uint64, error) {
+	i, err := loadInvoice(q, payer, id)
+	if err != nil {
+		return i, 0, err
+	}
+
+	if i.Status != INVOICE_OPEN {
+		return i, 0, fmt.Errorf(ERR_INVOICE_CLOSED)
+	}
+
+	date, err := readClock(q)
+	if err != nil {
+		return i, 0, err
+	}
+
+	return i, max(i.Due, date), nil
+}
+
+func (i Invoice) transferConcept() string {
+	return fmt.Sprintf("%s (invoice #%d)", i.Concept, i.Id)
+}
+
+// PreviewInvoice tells what paying an invoice would cost, fees included.
+func (b *Bank) PreviewInvoice(payer int64, id int64) (TransferPreview, error) {
+	i, due, err := invoiceTransfer(b.db, payer, id)
+	if err != nil {
+		return TransferPreview{}, err
+	}
+
+	p, err := checkTransfer(b.db, payer, i.Issuer, i.Amount, i.Currency, due, i.transferConcept())
+	p.Invoice = i.Id
+	return p, err
+}
+
+// PayInvoice orders the transfer that pays an invoice, and returns its id.
+func (b *Bank) PayInvoice(payer int64, id int64) (int64, error) {
+	var t int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		i, due, err := invoiceTransfer(tx, payer, id)
+		if err != nil {
+			return err
+		}
+
+		if err = checkApproval(tx, payer, i.Amount); err != nil {
+			return err
+		}
+
+		if t, err = transfer(tx, payer, i.Issuer, i.Amount, i.Currency, due, i.transferConcept()); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE invoices SET status = $1, transaction_id = $2 WHERE id = $3;", INVOICE_PAID, t, i.Id)
+		return err
+	})
+
+	return t, err
+}
+
+// DeclineInvoice refuses to pay an invoice.
+func (b *Bank) DeclineInvoice(payer int64, id int64) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		i, err := loadInvoice(tx, payer, id)
+		if err != nil {
+			return err
+		}
+
+		if i.Status != INVOICE_OPEN {
+			return fmt.Errorf(ERR_INVOICE_CLOSED)
+		}
+
+		_, err = tx.Exec("UPDATE invoices SET status = $1, transaction_id = NULL WHERE id = $2;", INVOICE_DECLINED, i.Id)
+		return err
+	})
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A joint account belongs to a team or a company. Each of its members logs
+// in with the account number, their own name and their own password, so
+// nobody has to share one; once an account has members, its own password
+// no longer logs in. Transfers from it above a threshold are not ordered
+// right away: they wait, as pending transfers, until enough members approve
+// them. The member who orders one approves it, and any member can reject
+// it. Escrows, invoice payments and standing orders above the threshold are
+// refused, to be ordered as transfers instead.
+const (
+	PENDING_WAITING  = "pending"
+	PENDING_ORDERED  = "ordered"
+	PENDING_REJECTED = "rejected"
+)
+
+// A JointPolicy is who shares an account and how many of them must approve
+// a transfer above the threshold.
+type JointPolicy struct {
+	Members   []string
+	Users     map[string]string // the user linked to each member, if any
+	Threshold *int64 // nil for no approvals at all
+	Required  int64
+}
+
+// needsApproval tells if a transfer of amount needs the approval of the
+// members.
+func (j JointPolicy) needsApproval(amount int64) bool {
+	return len(j.Members) > 0 && j.Threshold != nil && amount > *j.Threshold
+}
+
+type PendingTransfer struct {
+	Id          int64
+	Debitor     int64
+	Creditor    int64
+	Amount      int64
+	Currency    string
+	Symbol      string
+	Concept     string
+	Due         uint64
+	Created     uint64
+	Proposer    string
+	Status      string
+	Transaction int64
+	Approvals   []string
+	Required    int64
+	To_from     string
+}
+
+// ApprovedBy tells if member already approved the transfer.
+func (p PendingTransfer) ApprovedBy(member string) bool {
+	return slices.Contains(p.Approvals, member)
+}
+
+// state tells apart the changes of a pending transfer a page must show:
+// a new approval, or being ordered or rejected.
+func (p PendingTransfer) state() string {
+	return fmt.Sprintf("%s %d", p.Status, len(p.Approvals))
+}
+
+func loadJointPolicy(q dbtx, account int64) (JointPolicy, error) {
+	var j JointPolicy
+	err := q.QueryRow("SELECT approval_threshold, approvals_required FROM accounts WHERE id = $1;", account).Scan(&j.Threshold, &j.Required)
+	if errors.Is(err, sql.ErrNoRows) {
+		return j, fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+	if err != nil {
+		return j, err
+	}
+
+	rows, err := q.Query("SELECT m.name, coalesce(u.name, '') FROM members m LEFT JOIN users u ON u.id = m.user_id WHERE m.account = $1 ORDER BY m.name ASC;", account)
+	if err != nil {
+		return j, err
+	}
+	defer rows.Close()
+
+	j.Users = map[string]string{}
+	for rows.Next() {
+		var name, user string
+		if err := rows.Scan(&name, &user); err != nil {
+			return j, err
+		}
+		j.Members = append(j.Members, name)
+		if user != "" {
+			j.Users[name] = user
+		}
+	}
+
+	return j, rows.Err()
+}
+
+func (b *Bank) GetJointPolicy(account int64) (JointPolicy, error) {
+	return loadJointPolicy(b.db, account)
+}
+
+// checkApproval refuses a payment of amount from an account whose members
+// must approve it, for the ways of paying that cannot wait for them.
+func checkApproval(q dbtx, account int64, amount int64) error {
+	j, err := loadJointPolicy(q, account)
+	if err != nil {
+		return err
+	}
+
+	if j.needsApproval(amount) {
+		return fmt.Errorf(ERR_APPROVAL_REQUIRED)
+	}
+	return nil
+}
+
+// AddMember lets name log in to a joint account with password, or changes
+// the password of a member.
+func (b *Bank) AddMember(account int64, name string, password string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || account <= ACCOUNT_VAULT {
+		return fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+	}
+
+	if _, err := b.GetAccountHolder(account); err != nil {
+		return fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+
+	hash, err := CreateHash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec("INSERT INTO members (account, name, password) VALUES ($1, $2, $3) ON CONFLICT (account, name) DO UPDATE SET password = excluded.password;",
+		account, name, hash)
+	return err
+}
+
+// RemoveMember stops a member from logging in. An account cannot be left
+// with fewer members than the approvals it needs.
+func (b *Bank) RemoveMember(account int64, name string) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		j, err := loadJointPolicy(tx, account)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(j.Members, name) {
+			return fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+		}
+
+		if j.Threshold != nil && int64(len(j.Members)-1) < j.Required {
+			return fmt.Errorf(ERR_APPROVALS_INVALID)
+		}
+
+		_, err = tx.Exec("DELETE FROM members WHERE account = $1 AND name = $2;", account, name)
+		return err
+	})
+}
+
+// LinkMember lets a user approve the transfers of a joint account as one of
+// its members, or stops them if user is empty. A user is at most one member
+// of each account: linking them again moves the link.
+func (b *Bank) LinkMember(account int64, name string, user string) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		j, err := loadJointPolicy(tx, account)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(j.Members, name) {
+			return fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+		}
+
+		if user == "" {
+			_, err = tx.Exec("UPDATE members SET user_id = NULL WHERE account = $1 AND name = $2;", account, name)
+			return err
+		}
+
+		var id int64
+		err = tx.QueryRow("SELECT id FROM users WHERE name = $1;", user).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf(ERR_USER_NOT_FOUND)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("UPDATE members SET user_id = NULL WHERE account = $1 AND user_id = $2;", account, id); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE members SET user_id = $1 WHERE account = $2 AND name = $3;", id, account, name)
+		return err
+	})
+}
+
+// SetApprovals makes transfers above threshold need the approval of
+// required members, or none if threshold is nil.
+func (b *Bank) SetApprovals(account int64, threshold *int64, required int64) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		j, err := loadJointPolicy(tx, account)
+		if err != nil {
+			return err
+		}
+
+		if threshold != nil && (*threshold < 0 || required < 1 || required > int64(len(j.Members))) {
+			return fmt.Errorf(ERR_APPROVALS_INVALID)
+		}
+
+		if threshold == nil {
+			required = 1
+		}
+
+		_, err = tx.Exec("UPDATE accounts SET approval_threshold = $1, approvals_required = $2 WHERE id = $3;", threshold, required, account)
+		return err
+	})
+}
+
+// memberHash is the password of a member of a joint account. joint is
+// false if the account has no members.
+func (b *Bank) memberHash(account int64, name string) (hash []byte, joint bool, err error) {
+	err = b.db.QueryRow("SELECT count(*) > 0, coalesce(max(CASE WHEN name = $1 THEN password END), '') FROM members WHERE account = $2;", name, account).Scan(&joint, &hash)
+	return hash, joint, err
+}
+
+// Authenticate checks the password of an account, or of one of its members
+// if it is a joint account. member is the member that logged in, or empty
+// if the account is not joint.
+func (b *Bank) Authenticate(account int64, name string, password string) (member string, ok bool) {
+	hash, joint, err := b.memberHash(account, name)
+	if err != nil {
+		return "", false
+	}
+
+	if !joint {
+		hash, err = b.GetHash(account)
+		return "", err == nil && CheckPassword(password, hash)
+	}
+
+	return name, len(hash) > 0 && CheckPassword(password, hash)
+}
+
+// userMember is the member of a joint account a user is linked to, or empty
+// if they are none.
+func (b *Bank) userMember(account int64, user int64) (string, error) {
+	var name string
+	err := b.db.QueryRow("SELECT name FROM members WHERE account = $1 AND user_id = $2;", account, user).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return name, err
+}
+
+// sessionMember checks that the name a session logged in with is still a
+// member of the account, if it is a joint one, and returns it.
+func (b *Bank) sessionMember(account int64, name string) (string, error) {
+	hash, joint, err := b.memberHash(account, name)
+	if err != nil || !joint {
+		return "", err
+	}
+
+	if len(hash) == 0 {
+		return "", fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+	}
+	return name, nil
+}
+
+const pendingColumns = `
+	p.id, p.debitor, p.creditor, p.amount, p.currency, c.symbol, coalesce(p.concept, ''), p.date_due, p.date_created,
+	p.proposer, p.status, coalesce(p.transaction_id, 0)
+	FROM pending_transfers p JOIN currencies c ON c.code = p.currency`
+
+func scanPending(row interface{ Scan(...any) error }) (PendingTransfer, error) {
+	var p PendingTransfer
+	err := row.Scan(&p.Id, &p.Debitor, &p.Creditor, &p.Amount, &p.Currency, &p.Symbol, &p.Concept, &p.Due, &p.Created,
+		&p.Proposer, &p.Status, &p.Transaction)
+	return p, err
+}
+
+func loadApprovals(q dbtx, id int64) ([]string, error) {
+	rows, err := q.Query("SELECT member FROM approvals WHERE pending = $1 ORDER BY member ASC;", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// GetPendingTransfers lists the transfers from an account still waiting
+// for approvals, the newest first. With all, the ordered and rejected ones
+// are listed too.
+func (b *Bank) GetPendingTransfers(account int64, all bool) ([]PendingTransfer, error) {
+	j, err := loadJointPolicy(b.db, account)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.db.Query("SELECT "+pendingColumns+" WHERE p.debitor = $1 AND ($2 OR p.status = $3) ORDER BY p.id DESC;", account, all, PENDING_WAITING)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []PendingTransfer{}
+	for rows.Next() {
+		p, err := scanPending(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range pending {
+		if pending[i].Approvals, err = loadApprovals(b.db, pending[i].Id); err != nil {
+			return nil, err
+		}
+		pending[i].Required = j.Required
+
+		creditor, err := b.GetAccountHolder(pending[i].Creditor)
+		if err != nil {
+			return nil, err
+		}
+		pending[i].To_from = fmt.Sprintf("--> %s [%04d]", creditor, pending[i].Creditor)
+	}
+
+	return pending, nil
+}
+
+// orderPending orders a pending transfer once it has the approvals it
+// needs, due when it was meant to be or today if that has passed.
+func orderPending(q dbtx, p PendingTransfer, required int64) (int64, error) {
+	approvals, err := loadApprovals(q, p.Id)
+	if err != nil || int64(len(approvals)) < required {
+		return 0, err
+	}
+
+	date, err := readClock(q)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := transfer(q, p.Debitor, p.Creditor, p.Amount, p.Currency, max(p.Due, date), p.Concept)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = q.Exec("UPDATE pending_transfers SET status = $1, transaction_id = $2 WHERE id = $3;", PENDING_ORDERED, id, p.Id)
+	return id, err
+}
+
+// ProposeTransfer is a member ordering a transfer from a joint account. If
+// it needs approvals it waits for them, approved by the member already, and
+// the id of the pending transfer is returned; otherwise it is ordered.
+func (b *Bank) ProposeTransfer(from int64, member string, to int64, amount int64, currency string, due uint64, concept string) (int64, error) {
+	var id int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		j, err := loadJointPolicy(tx, from)
+		if err != nil {
+			return err
+		}
+
+		if !j.needsApproval(amount) {
+			_, err = transfer(tx, from, to, amount, currency, due, concept)
+			return err
+		}
+
+		// A user using the account who is not a member cannot approve
+		if member == "" {
+			return fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+		}
+
+		// The transfer is checked now, so nobody approves one that cannot
+		// be made, and again when it is ordered
+		if _, err = checkTransfer(tx, from, to, amount, currency, due, concept); err != nil {
+			return err
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec("INSERT INTO pending_transfers (debitor, creditor, amount, currency, concept, date_due, date_created, proposer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+			from, to, amount, currency, concept, due, date, member)
+		if err != nil {
+			return err
+		}
+
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("INSERT INTO approvals (pending, member) VALUES ($1, $2);", id, member); err != nil {
+			return err
+		}
+
+		p := PendingTransfer{Id: id, Debitor: from, Creditor: to, Amount: amount, Currency: currency, Concept: concept, Due: due}
+		_, err = orderPending(tx, p, j.Required)
+		return err
+	})
+
+	return id, err
+}
+
+// updatePending loads a transfer of an account still waiting for
+// approvals, for one of its members, and lets fn change it in the same
+// transaction.
+func (b *Bank) updatePending(account int64, member string, id int64, fn func(tx *sql.Tx, p PendingTransfer, j JointPolicy) error) error {
+	if member == "" {
+		return fmt.Errorf(ERR_MEMBER_NOT_FOUND)
+	}
+
+	return serializable(b.db, func(tx *sql.Tx) error {
+		p, err := scanPending(tx.QueryRow("SELECT "+pendingColumns+" WHERE p.id = $1 AND p.debitor = $2;", id, account))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf(ERR_PENDING_NOT_FOUND)
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.Status != PENDING_WAITING {
+			return fmt.Errorf(ERR_PENDING_CLOSED)
+		}
+
+		j, err := loadJointPolicy(tx, account)
+		if err != nil {
+			return err
+		}
+
+		return fn(tx, p, j)
+	})
+}
+
+// ApproveTransfer records the approval of a member, and orders the transfer
+// once it has enough. It returns the id of the transaction, or 0 if the
+// transfer still waits.
+func (b *Bank) ApproveTransfer(account int64, member string, id int64) (int64, error) {
+	var t int64
+	err := b.updatePending(account, member, id, func(tx *sql.Tx, p PendingTransfer, j JointPolicy) error {
+		_, err := tx.Exec("INSERT OR IGNORE INTO approvals (pending, member) VALUES ($1, $2);", p.Id, member)
+		if err != nil {
+			return err
+		}
+
+		t, err = orderPending(tx, p, j.Required)
+		return err
+	})
+
+	return t, err
+}
+
+// RejectTransfer is a member refusing a transfer waiting for approvals.
+func (b *Bank) RejectTransfer(account int64, member string, id int64) error {
+	return b.updatePending(account, member, id, func(tx *sql.Tx, p PendingTransfer, j JointPolicy) error {
+		_, err := tx.Exec("UPDATE pending_transfers SET status = $1 WHERE id = $2;", PENDING_REJECTED, p.Id)
+		return err
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+// A user approves as a member of a joint account only once the admin links
+// them, whatever their names.
+func TestUserMemberLinked(t *testing.T) {
+	b := newTestBank(t)
+
+	id, err := b.CreateAccount("company", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.AddMember(id, "alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := b.CreateUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.LinkUser("alice", id, ROLE_SIGNER); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := func() string {
+		a, err := b.LoadAccountById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = b.loadIdentity(a, session{id: uint64(id), holder: "alice", user: user}); err != nil {
+			t.Fatal(err)
+		}
+		return a.Member
+	}
+
+	if member := identity(); member != "" {
+		t.Errorf("user alice approves as %q before being linked", member)
+	}
+
+	if err = b.LinkMember(id, "alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if member := identity(); member != "alice" {
+		t.Errorf("linked user approves as %q", member)
+	}
+
+	if err = b.LinkMember(id, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if member := identity(); member != "" {
+		t.Errorf("unlinked user approves as %q", member)
+	}
+}
@@ -17,6 +17,12 @@ const (
 	ERR_CURRENT_PASSWORD_INCORRECT
 	ERR_TRANSACTION_ID_INVALID
 	ERR_LETTER_ID_INVALID
+	ERR_PERIOD_INVALID
+	ERR_STANDING_ORDER_ID_INVALID
+	ERR_REQUEST_INVALID
+	ERR_ESCROW_ID_INVALID
+	ERR_INVOICE_ID_INVALID
+	ERR_PENDING_ID_INVALID
 )
 
 const (
@@ -28,6 +34,52 @@ const (
 	ERR_TIME_TRAVEL_IMPOSSIBLE = "time travel"
 	ERR_RECIPIENT_ACCOUNT_NOT_FOUND = "no recipient"
 	ERR_REVOKE_NOT_ALLOWED = "no revoke"
+	ERR_BANK_EXISTS = "bank exists"
+	ERR_HOLDER_INVALID = "holder invalid"
+	ERR_NO_FREE_ACCOUNTS = "no free accounts"
+	ERR_VAULT_INSUFFICIENT_FUNDS = "vault no funds"
+	ERR_TRANSACTION_NOT_FOUND = "no transaction"
+	ERR_ACCOUNT_NOT_FOUND_ADMIN = "no account"
+	ERR_POLICY_INVALID = "policy invalid"
+	ERR_TRANSFER_AMOUNT_INVALID_ADMIN = "amount invalid"
+	ERR_RATE_INVALID = "rate invalid"
+	ERR_TERM_INVALID = "term invalid"
+	ERR_LOAN_NOT_FOUND = "no loan"
+	ERR_LOAN_NOT_ACTIVE = "loan not active"
+	ERR_ROUNDING_INVALID = "rounding invalid"
+	ERR_CLASS_INVALID = "class invalid"
+	ERR_STANDING_START_INVALID = "standing start invalid"
+	ERR_STANDING_END_INVALID = "standing end invalid"
+	ERR_STANDING_NOT_FOUND = "no standing order"
+	ERR_REWIND_NOT_PAST = "rewind not past"
+	ERR_LEDGER_TAMPERED = "ledger tampered"
+	ERR_CURRENCY_NOT_FOUND = "no currency"
+	ERR_CURRENCY_INVALID = "currency invalid"
+	ERR_EXCHANGE_RATE_NOT_FOUND = "no exchange rate"
+	ERR_EXCHANGE_TOO_SMALL = "exchange too small"
+	ERR_EXCHANGE_TOO_LARGE = "exchange too large"
+	ERR_EXCHANGE_VAULT_INSUFFICIENT = "exchange vault no funds"
+	ERR_EXCHANGE_RATE_INVALID = "exchange rate invalid"
+	ERR_DECIMALS_INVALID = "decimals invalid"
+	ERR_DECIMALS_LOCKED = "decimals locked"
+	ERR_FEE_RULE_INVALID = "fee rule invalid"
+	ERR_FEE_RULE_NOT_FOUND = "no fee rule"
+	ERR_TAX_RULE_INVALID = "tax rule invalid"
+	ERR_TAX_RULE_NOT_FOUND = "no tax rule"
+	ERR_ESCROW_NOT_FOUND = "no escrow"
+	ERR_ESCROW_CLOSED = "escrow closed"
+	ERR_INVOICE_NOT_FOUND = "no invoice"
+	ERR_INVOICE_CLOSED = "invoice closed"
+	ERR_INVOICE_TO_SELF = "invoice to self"
+	ERR_MEMBER_NOT_FOUND = "no member"
+	ERR_APPROVALS_INVALID = "approvals invalid"
+	ERR_APPROVAL_REQUIRED = "approval required"
+	ERR_PENDING_NOT_FOUND = "no pending transfer"
+	ERR_PENDING_CLOSED = "pending transfer closed"
+	ERR_USER_NOT_FOUND = "no user"
+	ERR_ROLE_INVALID = "role invalid"
+	ERR_READ_ONLY = "read only"
+	ERR_NOT_OWNER = "not owner"
 )
 
 // SpanishErrors holds the Spanish translations for the error codes.
@@ -35,12 +87,18 @@ var SpanishErrors = []string{
 	"El número de cuenta debe ser un entero positivo",
 	"Cuenta no encontrada (debe darse de alta)",
 	"Introduzca sus datos correctamente.",
-	"El importe a transferir debe ser un entero positivo",
+	"El importe a transferir debe ser un número positivo, sin más decimales que los del banco",
 	"La fecha debe ser un entero positivo",
 	"Las nuevas contraseñas no coinciden",
 	"La contraseña actual no es correcta",
 	"Identificador de transacción erróneo",
 	"Identificador de carta erróneo",
+	"La periodicidad debe ser un entero positivo",
+	"Identificador de orden permanente erróneo",
+	"La petición no es válida",
+	"Identificador de custodia erróneo",
+	"Identificador de factura erróneo",
+	"Identificador de transferencia pendiente erróneo",
 }
 
 // EnglishErrors holds the English translations for the error codes.
@@ -48,12 +106,18 @@ var EnglishErrors = []string{
 	"The account number must be a positive integer",
 	"Account not found (you must register)",
 	"Please enter your details correctly.",
-	"The amount to transfer must be a positive integer",
+	"The amount to transfer must be a positive number, with no more decimals than the bank uses",
 	"The date must be a positive integer",
 	"The new passwords do not match",
 	"The current password is not correct",
 	"Incorrect transaction identifier",
 	"Incorrect letter identifier",
+	"The period must be a positive integer",
+	"Incorrect standing order identifier",
+	"The request is not valid",
+	"Incorrect escrow identifier",
+	"Incorrect invoice identifier",
+	"Incorrect pending transfer identifier",
 }
 
 var ErrorStrings = map[string][]string {
@@ -71,6 +135,52 @@ var BackendErrors = map[string]map[string]string {
 		ERR_TIME_TRAVEL_IMPOSSIBLE : 	"Time travel is not possible...",
 		ERR_RECIPIENT_ACCOUNT_NOT_FOUND : 	"The account you are trying to transfer to does not exist",
 		ERR_REVOKE_NOT_ALLOWED : 	"The transaction does not meet the requirements to be revoked by you. Please contact the Bank to resolve the issue.",
+		ERR_BANK_EXISTS : 	"A bank database with that name already exists",
+		ERR_HOLDER_INVALID : 	"The account holder name cannot be empty",
+		ERR_NO_FREE_ACCOUNTS : 	"There are no free account numbers left",
+		ERR_VAULT_INSUFFICIENT_FUNDS : 	"The bank vault does not have enough cash for this withdrawal",
+		ERR_TRANSACTION_NOT_FOUND : 	"Transaction not found",
+		ERR_ACCOUNT_NOT_FOUND_ADMIN : 	"Account ID not found in the database",
+		ERR_POLICY_INVALID : 	"The policy must be one of: reject, overdraft, partial",
+		ERR_TRANSFER_AMOUNT_INVALID_ADMIN : 	"The amount must be a positive integer",
+		ERR_RATE_INVALID : 	"The interest rate must be between 0 and 1000000 basis points",
+		ERR_TERM_INVALID : 	"The term must be at least one date",
+		ERR_LOAN_NOT_FOUND : 	"Loan not found",
+		ERR_LOAN_NOT_ACTIVE : 	"The loan is no longer active",
+		ERR_ROUNDING_INVALID : 	"The rounding must be one of: floor, round, ceil",
+		ERR_CLASS_INVALID : 	"The account class cannot be empty",
+		ERR_STANDING_START_INVALID : 	"The first payment of a standing order must be on a future date",
+		ERR_STANDING_END_INVALID : 	"The standing order cannot end before its first payment",
+		ERR_STANDING_NOT_FOUND : 	"Standing order not found",
+		ERR_REWIND_NOT_PAST : 	"The bank can only be rewound to a past date",
+		ERR_LEDGER_TAMPERED : 	"The ledger has been tampered with",
+		ERR_CURRENCY_NOT_FOUND : 	"The bank does not have that currency",
+		ERR_CURRENCY_INVALID : 	"The currency code must be lowercase letters, digits, - or _, and the symbol cannot be empty",
+		ERR_EXCHANGE_RATE_NOT_FOUND : 	"The bank does not exchange those currencies",
+		ERR_EXCHANGE_TOO_SMALL : 	"The amount is too small to buy anything at the exchange rate",
+		ERR_EXCHANGE_TOO_LARGE : 	"The amount is too large to exchange at the exchange rate",
+		ERR_EXCHANGE_VAULT_INSUFFICIENT : 	"The bank vault does not have enough of that currency for this exchange",
+		ERR_EXCHANGE_RATE_INVALID : 	"An exchange rate is two positive amounts of two different currencies",
+		ERR_DECIMALS_INVALID : 	"The decimals must be between 0 and 6",
+		ERR_DECIMALS_LOCKED : 	"The decimals cannot change: an amount of the bank would lose digits or grow too large",
+		ERR_FEE_RULE_INVALID : 	"The amounts and rate of a fee cannot be negative, and its maximum cannot be lower than its minimum",
+		ERR_FEE_RULE_NOT_FOUND : 	"Fee rule not found",
+		ERR_TAX_RULE_INVALID : 	"A tax is wealth, income or poll, its amounts and rate cannot be negative, its rate cannot be above 10000 basis points, and its bracket must end above where it starts",
+		ERR_TAX_RULE_NOT_FOUND : 	"Tax rule not found",
+		ERR_ESCROW_NOT_FOUND : 	"Escrow not found",
+		ERR_ESCROW_CLOSED : 	"The escrow was already released or returned",
+		ERR_INVOICE_NOT_FOUND : 	"Invoice not found",
+		ERR_INVOICE_CLOSED : 	"The invoice was already paid or declined",
+		ERR_INVOICE_TO_SELF : 	"You cannot ask your own account to pay you",
+		ERR_MEMBER_NOT_FOUND : 	"Member not found in the joint account",
+		ERR_APPROVALS_INVALID : 	"The approvals required must be between 1 and the number of members",
+		ERR_APPROVAL_REQUIRED : 	"This amount needs the approval of the members of the account, order it as a transfer",
+		ERR_PENDING_NOT_FOUND : 	"Pending transfer not found",
+		ERR_PENDING_CLOSED : 	"The transfer was already ordered or rejected",
+		ERR_USER_NOT_FOUND : 	"User not found",
+		ERR_ROLE_INVALID : 	"The role must be one of: owner, signer, viewer",
+		ERR_READ_ONLY : 	"You can only view this account",
+		ERR_NOT_OWNER : 	"Only the owners of the account can share it",
 	},
 	LANG_SPANISH: {
 		ERR_DOC_NOT_FOUND : "No se encontró el documento", 
@@ -81,6 +191,52 @@ var BackendErrors = map[string]map[string]string {
 		ERR_TIME_TRAVEL_IMPOSSIBLE : 	"No es posible viajar en el tiempo...", 	
 		ERR_RECIPIENT_ACCOUNT_NOT_FOUND : 	"La cuenta a la que está intentando ordernar la transferencia no existe", 	
 		ERR_REVOKE_NOT_ALLOWED : 	"La transacción no cumple los requerimientos para ser revocada por usted. Contacte con el Banco para resolver el problema.", 
+		ERR_BANK_EXISTS : 	"Ya existe una base de datos de banco con ese nombre",
+		ERR_HOLDER_INVALID : 	"El nombre del titular no puede estar vacío",
+		ERR_NO_FREE_ACCOUNTS : 	"No quedan números de cuenta libres",
+		ERR_VAULT_INSUFFICIENT_FUNDS : 	"La caja fuerte del banco no tiene suficiente efectivo para este retiro",
+		ERR_TRANSACTION_NOT_FOUND : 	"Transacción no encontrada",
+		ERR_ACCOUNT_NOT_FOUND_ADMIN : 	"El ID de cuenta no se encontró en la base de datos",
+		ERR_POLICY_INVALID : 	"La política debe ser una de: reject, overdraft, partial",
+		ERR_TRANSFER_AMOUNT_INVALID_ADMIN : 	"El importe debe ser un entero positivo",
+		ERR_RATE_INVALID : 	"El tipo de interés debe estar entre 0 y 1000000 puntos básicos",
+		ERR_TERM_INVALID : 	"El plazo debe ser de al menos una fecha",
+		ERR_LOAN_NOT_FOUND : 	"Préstamo no encontrado",
+		ERR_LOAN_NOT_ACTIVE : 	"El préstamo ya no está activo",
+		ERR_ROUNDING_INVALID : 	"El redondeo debe ser uno de: floor, round, ceil",
+		ERR_CLASS_INVALID : 	"La clase de cuenta no puede estar vacía",
+		ERR_STANDING_START_INVALID : 	"El primer pago de una orden permanente debe ser en una fecha futura",
+		ERR_STANDING_END_INVALID : 	"La orden permanente no puede terminar antes de su primer pago",
+		ERR_STANDING_NOT_FOUND : 	"Orden permanente no encontrada",
+		ERR_REWIND_NOT_PAST : 	"El banco solo puede retroceder a una fecha pasada",
+		ERR_LEDGER_TAMPERED : 	"El libro de cuentas ha sido manipulado",
+		ERR_CURRENCY_NOT_FOUND : 	"El banco no tiene esa moneda",
+		ERR_CURRENCY_INVALID : 	"El código de la moneda debe ser letras minúsculas, dígitos, - o _, y el símbolo no puede estar vacío",
+		ERR_EXCHANGE_RATE_NOT_FOUND : 	"El banco no cambia esas monedas",
+		ERR_EXCHANGE_TOO_SMALL : 	"El importe es demasiado pequeño para comprar algo al tipo de cambio",
+		ERR_EXCHANGE_TOO_LARGE : 	"El importe es demasiado grande para cambiarlo al tipo de cambio",
+		ERR_EXCHANGE_VAULT_INSUFFICIENT : 	"La caja fuerte del banco no tiene suficiente de esa moneda para este cambio",
+		ERR_EXCHANGE_RATE_INVALID : 	"Un tipo de cambio son dos importes positivos de dos monedas distintas",
+		ERR_DECIMALS_INVALID : 	"Los decimales deben estar entre 0 y 6",
+		ERR_DECIMALS_LOCKED : 	"Los decimales no pueden cambiar: un importe del banco perdería cifras o crecería demasiado",
+		ERR_FEE_RULE_INVALID : 	"Los importes y el tipo de una comisión no pueden ser negativos, y su máximo no puede ser menor que su mínimo",
+		ERR_FEE_RULE_NOT_FOUND : 	"Regla de comisión no encontrada",
+		ERR_TAX_RULE_INVALID : 	"Un impuesto es wealth, income o poll, sus importes y su tipo no pueden ser negativos, su tipo no puede pasar de 10000 puntos básicos, y su tramo debe terminar por encima de donde empieza",
+		ERR_TAX_RULE_NOT_FOUND : 	"Regla de impuesto no encontrada",
+		ERR_ESCROW_NOT_FOUND : 	"Custodia no encontrada",
+		ERR_ESCROW_CLOSED : 	"La custodia ya fue liberada o devuelta",
+		ERR_INVOICE_NOT_FOUND : 	"Factura no encontrada",
+		ERR_INVOICE_CLOSED : 	"La factura ya fue pagada o rechazada",
+		ERR_INVOICE_TO_SELF : 	"No puede pedirle a su propia cuenta que le pague",
+		ERR_MEMBER_NOT_FOUND : 	"Miembro no encontrado en la cuenta conjunta",
+		ERR_APPROVALS_INVALID : 	"Las aprobaciones necesarias deben estar entre 1 y el número de miembros",
+		ERR_APPROVAL_REQUIRED : 	"Este importe necesita la aprobación de los miembros de la cuenta, ordénelo como transferencia",
+		ERR_PENDING_NOT_FOUND : 	"Transferencia pendiente no encontrada",
+		ERR_PENDING_CLOSED : 	"La transferencia ya fue ordenada o rechazada",
+		ERR_USER_NOT_FOUND : 	"Usuario no encontrado",
+		ERR_ROLE_INVALID : 	"El rol debe ser uno de: owner, signer, viewer",
+		ERR_READ_ONLY : 	"Solo puede consultar esta cuenta",
+		ERR_NOT_OWNER : 	"Solo los titulares de la cuenta pueden compartirla",
 	},
 }
 
@@ -91,4 +247,125 @@ func GetBackendError(lang string, e string) string {
 	} else {
 		return e
 	}
-}
\ No newline at end of file
+}
+// Messages printed by the admin command line.
+const (
+	MSG_WITHDRAWALS = "withdrawals"
+	MSG_DEPOSITS = "deposits"
+	MSG_VAULT = "vault"
+	MSG_ESCROW = "escrow"
+	MSG_CASH = "cash"
+	MSG_BANK_CREATED = "bank created"
+	MSG_CURRENT_DATE = "current date"
+	MSG_ADVANCED_DATE = "advanced date"
+	MSG_REWOUND_DATE = "rewound date"
+	MSG_UNSETTLED = "unsettled"
+	MSG_LEDGER_VERIFIED = "ledger verified"
+	MSG_LEDGER_HEAD = "ledger head"
+	MSG_TAMPERED = "tampered"
+	MSG_SETTLED = "settled"
+	MSG_FAILED = "failed"
+	MSG_PARTIAL = "partial"
+	MSG_POLICY = "policy"
+	MSG_LOAN_GRANTED = "loan granted"
+	MSG_INTEREST = "interest"
+	MSG_CLASS = "class"
+	MSG_EXCHANGED = "exchanged"
+	MSG_DECIMALS = "decimals"
+	MSG_FEE_RULE_ADDED = "fee rule added"
+	MSG_TAX_RULE_ADDED = "tax rule added"
+	MSG_TAX_TOTAL = "tax total"
+	MSG_MEMBERS = "members"
+	MSG_APPROVALS = "approvals"
+	MSG_NO_APPROVALS = "no approvals"
+	MSG_USER_CREATED = "user created"
+	MSG_ACCOUNT_CREATED = "account created"
+	MSG_REVOKED = "revoked"
+	MSG_DONE = "done"
+	MSG_NOT_A_VALID_COMMAND = "not a valid command"
+	MSG_INVALID_ARGUMENTS = "invalid arguments"
+)
+
+var AdminMessages = map[string]map[string]string {
+	LANG_ENGLISH: {
+		MSG_WITHDRAWALS : "WITHDRAWALS",
+		MSG_DEPOSITS : "DEPOSITS",
+		MSG_VAULT : "VAULT",
+		MSG_ESCROW : "ESCROW",
+		MSG_CASH : "CASH",
+		MSG_BANK_CREATED : "Bank created: ",
+		MSG_CURRENT_DATE : "Current date: ",
+		MSG_ADVANCED_DATE : "Date advanced to: ",
+		MSG_REWOUND_DATE : "Date rewound to: ",
+		MSG_UNSETTLED : "Transactions pending again: ",
+		MSG_LEDGER_VERIFIED : "Transactions verified: ",
+		MSG_LEDGER_HEAD : "Head of the chain: ",
+		MSG_TAMPERED : "First tampered transaction: #",
+		MSG_SETTLED : "Transactions settled: ",
+		MSG_FAILED : "These transactions could not be covered and failed:",
+		MSG_PARTIAL : "Partially payed: ",
+		MSG_POLICY : "Bounce policy: ",
+		MSG_LOAN_GRANTED : "Loan granted with ID ",
+		MSG_INTEREST : "Interest rate (basis points per date): ",
+		MSG_CLASS : "Account class: ",
+		MSG_EXCHANGED : "Bought: ",
+		MSG_DECIMALS : "Decimals of the amounts: ",
+		MSG_FEE_RULE_ADDED : "Fee rule added with ID ",
+		MSG_TAX_RULE_ADDED : "Tax rule added, disabled until enabled, with ID ",
+		MSG_TAX_TOTAL : "Total the next date would levy: ",
+		MSG_MEMBERS : "Members: ",
+		MSG_APPROVALS : "Approvals required: ",
+		MSG_NO_APPROVALS : "No approvals required",
+		MSG_USER_CREATED : "User saved with ID ",
+		MSG_ACCOUNT_CREATED : "New account successfully created with ID ",
+		MSG_REVOKED : "Transaction revoked: ",
+		MSG_DONE : "Done.",
+		MSG_NOT_A_VALID_COMMAND : "Not a valid command. Use 'help' to see available commands.",
+		MSG_INVALID_ARGUMENTS : "Invalid arguments. Use 'help' to see the usage of each command.",
+	},
+	LANG_SPANISH: {
+		MSG_WITHDRAWALS : "RETIRADAS",
+		MSG_DEPOSITS : "DEPOSITOS",
+		MSG_VAULT : "CAJA",
+		MSG_ESCROW : "CUSTODIA",
+		MSG_CASH : "EFECTIVO",
+		MSG_BANK_CREATED : "Banco creado: ",
+		MSG_CURRENT_DATE : "Fecha actual: ",
+		MSG_ADVANCED_DATE : "Fecha avanzada a: ",
+		MSG_REWOUND_DATE : "Fecha retrocedida a: ",
+		MSG_UNSETTLED : "Transacciones pendientes de nuevo: ",
+		MSG_LEDGER_VERIFIED : "Transacciones verificadas: ",
+		MSG_LEDGER_HEAD : "Cabeza de la cadena: ",
+		MSG_TAMPERED : "Primera transacción manipulada: #",
+		MSG_SETTLED : "Transacciones liquidadas: ",
+		MSG_FAILED : "Estas transacciones no tenían fondos y fallaron:",
+		MSG_PARTIAL : "Pagadas parcialmente: ",
+		MSG_POLICY : "Política de devoluciones: ",
+		MSG_LOAN_GRANTED : "Préstamo concedido con el ID ",
+		MSG_INTEREST : "Tipo de interés (puntos básicos por fecha): ",
+		MSG_CLASS : "Clase de cuenta: ",
+		MSG_EXCHANGED : "Comprado: ",
+		MSG_DECIMALS : "Decimales de los importes: ",
+		MSG_FEE_RULE_ADDED : "Regla de comisión añadida con el ID ",
+		MSG_TAX_RULE_ADDED : "Regla de impuesto añadida, desactivada hasta que se active, con el ID ",
+		MSG_TAX_TOTAL : "Total que recaudaría la siguiente fecha: ",
+		MSG_MEMBERS : "Miembros: ",
+		MSG_APPROVALS : "Aprobaciones necesarias: ",
+		MSG_NO_APPROVALS : "No se necesitan aprobaciones",
+		MSG_USER_CREATED : "Usuario guardado con el ID ",
+		MSG_ACCOUNT_CREATED : "Nueva cuenta creada con éxito, con el ID ",
+		MSG_REVOKED : "Transacción revocada: ",
+		MSG_DONE : "Hecho.",
+		MSG_NOT_A_VALID_COMMAND : "Comando no válido. Usa 'help' para ver los comandos disponibles.",
+		MSG_INVALID_ARGUMENTS : "Argumentos no válidos. Usa 'help' para ver el uso de cada comando.",
+	},
+}
+
+func GetAdminMessage(lang string, m string) string {
+	s, ok := AdminMessages[lang][m]
+	if ok {
+		return s
+	} else {
+		return m
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The ledger is hash chained, so that editing the database by hand shows.
+// Every transaction carries a hash over the fields that never change once it
+// is ordered, and over the hash of the link before it. Whether it got payed,
+// bounced or revoked changes with the clock, so every change of status is
+// appended to the chain as a link of its own, and the status a transaction
+// has must be the last one chained for it.
+// Players can write down the head of the chain every turn: rewriting any
+// past transaction or status changes every hash after it, the head included.
+// Transactions in the default currency hash as they did before there were
+// other currencies, and amounts in whole units as they did before there
+// were decimals, so chains sealed back then still verify and the decimals
+// can change. Transactions from before there was a chain are left
+// unsealed, and so are the statuses from before they were chained.
+
+// A LedgerHead is the last link of the chain.
+type LedgerHead struct {
+	Count int64
+	Last  int64
+	Hash  string
+}
+
+// chainHash hashes a transaction onto the hash of the link before it.
+func chainHash(prev string, id int64, creditor int64, debitor int64, amount int64, decimals int, currency string, concept string, created uint64, due uint64) string {
+	link := fmt.Sprintf("%s|%d|%d|%d|%s|%q|%d|%d", prev, id, creditor, debitor, wholeAmount(amount, decimals), concept, created, due)
+	if currency != DEFAULT_CURRENCY {
+		link += "|" + currency
+	}
+
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:])
+}
+
+// statusHash hashes a change of status of a transaction onto the hash of the
+// link before it.
+func statusHash(prev string, id int64, transaction int64, status transactionStatus) string {
+	link := fmt.Sprintf("%s|status|%d|%d|%t|%t|%t|", prev, id, transaction, status.payed, status.failed, status.revoked)
+	if status.settled.Valid {
+		link += strconv.FormatInt(status.settled.Int64, 10)
+	}
+
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:])
+}
+
+// previousHash is the hash of the last link before transaction id: the
+// transaction before it, or a change of status chained after that one. It is
+// empty for the first link.
+func previousHash(q dbtx, id int64) (string, error) {
+	var prev string
+	var last int64
+	err := q.QueryRow("SELECT id, coalesce(hash, '') FROM transactions WHERE id < $1 ORDER BY id DESC LIMIT 1;", id).Scan(&last, &prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	err = q.QueryRow("SELECT hash FROM transaction_status WHERE chained_after >= $1 AND chained_after < $2 ORDER BY id DESC LIMIT 1;", last, id).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return prev, nil
+}
+
+// chainTransaction links a newly inserted transaction to the chain. It must
+// run in the same database transaction as the insert, which holds the write
+// lock, so no other transaction can take the same place in the chain.
+func chainTransaction(q dbtx, id int64, creditor int64, debitor int64, amount int64, currency string, concept string, created uint64, due uint64) error {
+	prev, err := previousHash(q, id)
+	if err != nil {
+		return err
+	}
+
+	decimals, err := loadDecimals(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec("UPDATE transactions SET hash = $1 WHERE id = $2;", chainHash(prev, id, creditor, debitor, amount, decimals, currency, concept, created, due), id)
+	return err
+}
+
+// chainStatus appends the status transaction has now to the chain. Like
+// chainTransaction, it must run in the database transaction that changed it.
+func chainStatus(q dbtx, transaction int64) error {
+	var status transactionStatus
+	err := q.QueryRow("SELECT payed, failed, revoked, date_settled FROM transactions WHERE id = $1;", transaction).Scan(&status.payed, &status.failed, &status.revoked, &status.settled)
+	if err != nil {
+		return err
+	}
+
+	var id, last int64
+	if err = q.QueryRow("SELECT coalesce(max(id), 0) + 1, (SELECT coalesce(max(id), 0) FROM transactions) FROM transaction_status;").Scan(&id, &last); err != nil {
+		return err
+	}
+
+	prev, err := previousHash(q, last+1)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec("INSERT INTO transaction_status (id, transaction_id, chained_after, payed, failed, revoked, date_settled, hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+		id, transaction, last, status.payed, status.failed, status.revoked, status.settled, statusHash(prev, id, transaction, status))
+	return err
+}
+
+// transactionIds lists the transactions that match where, in order.
+func transactionIds(q dbtx, where string, args ...any) ([]int64, error) {
+	rows, err := q.Query("SELECT id FROM transactions WHERE "+where+" ORDER BY id ASC;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// setStatus changes whether the transactions ids are payed, failed or
+// revoked, and chains every change. set is the SET clause of the update and
+// args its parameters; every change of status goes through here.
+func setStatus(q dbtx, ids []int64, set string, args ...any) error {
+	update := fmt.Sprintf("UPDATE transactions SET %s WHERE id = $%d;", set, len(args)+1)
+	for _, id := range ids {
+		if _, err := q.Exec(update, append(args[:len(args):len(args)], id)...); err != nil {
+			return err
+		}
+
+		if err := chainStatus(q, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A transactionStatus is what changes of a transaction once it is ordered.
+type transactionStatus struct {
+	payed   bool
+	failed  bool
+	revoked bool
+	settled sql.NullInt64
+}
+
+type chainRow struct {
+	id       int64
+	creditor int64
+	debitor  int64
+	amount   int64
+	currency string
+	concept  string
+	created  uint64
+	due      uint64
+	hash     sql.NullString
+	status   transactionStatus
+}
+
+func loadChain(q dbtx) ([]chainRow, error) {
+	rows, err := q.Query("SELECT id, creditor, debitor, amount, currency, coalesce(concept, ''), date_created, date_due, hash, payed, failed, revoked, date_settled FROM transactions ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chain []chainRow
+	for rows.Next() {
+		var r chainRow
+		if err := rows.Scan(&r.id, &r.creditor, &r.debitor, &r.amount, &r.currency, &r.concept, &r.created, &r.due, &r.hash, &r.status.payed, &r.status.failed, &r.status.revoked, &r.status.settled); err != nil {
+			return nil, err
+		}
+		chain = append(chain, r)
+	}
+
+	return chain, rows.Err()
+}
+
+type statusRow struct {
+	id          int64
+	transaction int64
+	after       int64
+	status      transactionStatus
+	hash        string
+}
+
+func loadStatusChain(q dbtx) ([]statusRow, error) {
+	rows, err := q.Query("SELECT id, transaction_id, chained_after, payed, failed, revoked, date_settled, hash FROM transaction_status ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chain []statusRow
+	for rows.Next() {
+		var r statusRow
+		if err := rows.Scan(&r.id, &r.transaction, &r.after, &r.status.payed, &r.status.failed, &r.status.revoked, &r.status.settled, &r.hash); err != nil {
+			return nil, err
+		}
+		chain = append(chain, r)
+	}
+
+	return chain, rows.Err()
+}
+
+// VerifyLedger walks the whole chain. It returns the head if every hash
+// matches and every transaction has the last status chained for it, or the
+// id of the first transaction that does not.
+func (b *Bank) VerifyLedger() (LedgerHead, int64, error) {
+	var head LedgerHead
+
+	chain, err := loadChain(b.db)
+	if err != nil {
+		return head, 0, err
+	}
+
+	statuses, err := loadStatusChain(b.db)
+	if err != nil {
+		return head, 0, err
+	}
+
+	var unchained int64
+	var decimals int
+	if err = b.db.QueryRow("SELECT status_chained_after, decimals FROM system WHERE id = 1;").Scan(&unchained, &decimals); err != nil {
+		return head, 0, err
+	}
+
+	prev := ""
+	sealed := false
+	last := map[int64]transactionStatus{}
+
+	// The changes of status chained before transaction id
+	next := 0
+	linkStatuses := func(id int64) int64 {
+		for ; next < len(statuses) && statuses[next].after < id; next++ {
+			s := statuses[next]
+			hash := statusHash(prev, s.id, s.transaction, s.status)
+			if s.hash != hash {
+				return s.transaction
+			}
+
+			prev, sealed = hash, true
+			last[s.transaction] = s.status
+			head.Hash = hash
+		}
+		return 0
+	}
+
+	for _, r := range chain {
+		if tampered := linkStatuses(r.id); tampered != 0 {
+			return head, tampered, fmt.Errorf(ERR_LEDGER_TAMPERED)
+		}
+
+		// The transactions from before there was a chain
+		if !r.hash.Valid && !sealed {
+			continue
+		}
+
+		hash := chainHash(prev, r.id, r.creditor, r.debitor, r.amount, decimals, r.currency, r.concept, r.created, r.due)
+		if !r.hash.Valid || r.hash.String != hash {
+			return head, r.id, fmt.Errorf(ERR_LEDGER_TAMPERED)
+		}
+
+		prev, sealed = hash, true
+		head = LedgerHead{Count: head.Count + 1, Last: r.id, Hash: hash}
+	}
+
+	if tampered := linkStatuses(math.MaxInt64); tampered != 0 {
+		return head, tampered, fmt.Errorf(ERR_LEDGER_TAMPERED)
+	}
+
+	for _, r := range chain {
+		status, chained := last[r.id]
+		if !chained && r.id <= unchained {
+			continue
+		}
+
+		// Never chained, it must still be pending
+		if r.status != status {
+			return head, r.id, fmt.Errorf(ERR_LEDGER_TAMPERED)
+		}
+	}
+
+	return head, 0, nil
+}
+
+// GetLedgerHead reads the last link of the chain, without verifying it.
+func (b *Bank) GetLedgerHead() (LedgerHead, error) {
+	var head LedgerHead
+	err := b.db.QueryRow("SELECT count(*), coalesce(max(id), 0) FROM transactions;").Scan(&head.Count, &head.Last)
+	if err != nil || head.Count == 0 {
+		return head, err
+	}
+
+	head.Hash, err = previousHash(b.db, head.Last+1)
+	return head, err
+}
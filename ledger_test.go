@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+// Settling, revoking and rewinding chain every change of status: the ledger
+// verifies after them, and not once a status is edited by hand.
+func TestLedgerChainsStatus(t *testing.T) {
+	b := newTestBank(t)
+
+	from, err := b.CreateAccount("payer", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := b.CreateAccount("payee", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Deposit(from, 1000, DEFAULT_CURRENCY, "funds"); err != nil {
+		t.Fatal(err)
+	}
+
+	date := b.GetDate()
+	if err = b.Transfer(uint64(from), uint64(to), 100, DEFAULT_CURRENCY, date+1, "settled"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Transfer(uint64(from), uint64(to), 100, DEFAULT_CURRENCY, date+2, "revoked"); err != nil {
+		t.Fatal(err)
+	}
+
+	var settled, revoked int64
+	if err = b.db.QueryRow("SELECT id FROM transactions WHERE concept = 'settled';").Scan(&settled); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.db.QueryRow("SELECT id FROM transactions WHERE concept = 'revoked';").Scan(&revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.RevokeTransaction(from, uint64(revoked)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.AdvanceClock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.AdvanceClock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.Rewind(date + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.AdvanceClock(); err != nil {
+		t.Fatal(err)
+	}
+
+	head, tampered, err := b.VerifyLedger()
+	if err != nil {
+		t.Fatalf("transaction %d does not verify: %v", tampered, err)
+	}
+
+	last, err := b.GetLedgerHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.Hash != head.Hash {
+		t.Errorf("head is %s, verified %s", last.Hash, head.Hash)
+	}
+
+	if _, err = b.db.Exec("UPDATE transactions SET payed = 0, date_settled = NULL WHERE id = $1;", settled); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, tampered, _ = b.VerifyLedger(); tampered != settled {
+		t.Errorf("editing the status of %d reported %d", settled, tampered)
+	}
+}
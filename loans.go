@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Loans are given out from the vault and repaid to it in one instalment
+// per date. Each instalment repays an equal part of the principal plus the
+// interest on what is still owed. Rates are in basis points (1% = 100).
+// What a bounced instalment left unpayed is owed again on the next date,
+// as a new instalment at the end of the schedule.
+const (
+	LOAN_ACTIVE   = "active"
+	LOAN_REPAID   = "repaid"
+	LOAN_FORGIVEN = "forgiven"
+)
+
+// Instalments not yet posted to the ledger are scheduled, afterwards they
+// follow the status of their transaction.
+const INSTALMENT_SCHEDULED = "scheduled"
+
+type Loan struct {
+	Id          int64
+	Account     int64
+	Holder      string
+	Principal   int64
+	Rate        int64
+	Term        uint64
+	Date        uint64
+	Status      string
+	Outstanding int64
+	Schedule    []Instalment
+}
+
+type Instalment struct {
+	Id          int64
+	Number      uint64
+	Date        uint64
+	Principal   int64
+	Interest    int64
+	Transaction int64
+	Status      string
+}
+
+func (i Instalment) Amount() int64 {
+	return i.Principal + i.Interest
+}
+
+// NextInstalment is the first instalment still to be payed, if any.
+func (l *Loan) NextInstalment() *Instalment {
+	for i := range l.Schedule {
+		if l.Schedule[i].Status == INSTALMENT_SCHEDULED || l.Schedule[i].Status == TX_PENDING {
+			return &l.Schedule[i]
+		}
+	}
+	return nil
+}
+
+// schedule inserts term instalments for principal, the first one due on
+// first, numbering them from number.
+func schedule(q dbtx, loan int64, principal int64, rate int64, term uint64, first uint64, number uint64) error {
+	part := principal / int64(term)
+	outstanding := principal
+
+	for i := uint64(0); i < term; i++ {
+		p := part
+		if i == term-1 {
+			p = outstanding
+		}
+
+		interest := outstanding/10000*rate + outstanding%10000*rate/10000
+
+		_, err := q.Exec("INSERT INTO instalments (loan, number, date_due, principal, interest) VALUES ($1, $2, $3, $4, $5);",
+			loan, number+i, first+i, p, interest)
+		if err != nil {
+			return err
+		}
+
+		outstanding -= p
+	}
+
+	return nil
+}
+
+func validLoanTerms(principal int64, rate int64, term uint64) error {
+	if principal <= 0 {
+		return fmt.Errorf(ERR_TRANSFER_AMOUNT_INVALID_ADMIN)
+	}
+
+	if rate < 0 || rate > MAX_INTEREST_RATE {
+		return fmt.Errorf(ERR_RATE_INVALID)
+	}
+
+	if term == 0 {
+		return fmt.Errorf(ERR_TERM_INVALID)
+	}
+
+	return nil
+}
+
+// GrantLoan disburses a loan from the vault to a player account and
+// schedules its repayment, starting on the next date.
+func (b *Bank) GrantLoan(account int64, principal int64, rate int64, term uint64) (int64, error) {
+	if err := validLoanTerms(principal, rate, term); err != nil {
+		return 0, err
+	}
+
+	if account < ACCOUNT_MIN {
+		return 0, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := b.GetAccountHolder(account); err != nil {
+		return 0, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	var id int64
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		vault, err := ledgerBalance(tx, ACCOUNT_VAULT, DEFAULT_CURRENCY)
+		if err != nil {
+			return err
+		}
+
+		if vault < principal {
+			return fmt.Errorf(ERR_VAULT_INSUFFICIENT_FUNDS)
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec("INSERT INTO loans (account, principal, rate, term, date_created, status) VALUES ($1, $2, $3, $4, $5, $6);",
+			account, principal, rate, term, date, LOAN_ACTIVE)
+		if err != nil {
+			return err
+		}
+
+		id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = insertTransaction(tx, account, ACCOUNT_VAULT, principal, DEFAULT_CURRENCY, fmt.Sprintf("Loan #%d", id), date, date, true)
+		if err != nil {
+			return err
+		}
+
+		return schedule(tx, id, principal, rate, term, date+1, 1)
+	})
+
+	return id, err
+}
+
+// postInstalments turns the instalments due on or before date into ledger
+// transactions from the borrower to the vault, so they settle with the rest.
+func postInstalments(q dbtx, date uint64) error {
+	rows, err := q.Query(`
+		SELECT i.id, i.number, i.date_due, i.principal, i.interest, l.id, l.account, l.term
+		FROM instalments i JOIN loans l ON i.loan = l.id
+		WHERE l.status = $1 AND i.transaction_id IS NULL AND i.date_due <= $2
+		ORDER BY i.date_due ASC, i.id ASC;`, LOAN_ACTIVE, date)
+	if err != nil {
+		return err
+	}
+
+	type due struct {
+		instalment Instalment
+		loan       int64
+		account    int64
+		term       uint64
+	}
+
+	var pending []due
+	for rows.Next() {
+		var d due
+		err := rows.Scan(&d.instalment.Id, &d.instalment.Number, &d.instalment.Date, &d.instalment.Principal, &d.instalment.Interest, &d.loan, &d.account, &d.term)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range pending {
+		concept := fmt.Sprintf("Loan #%d instalment %d/%d", d.loan, d.instalment.Number, d.term)
+		id, err := insertTransaction(q, ACCOUNT_VAULT, d.account, d.instalment.Amount(), DEFAULT_CURRENCY, concept, date, date, false)
+		if err != nil {
+			return err
+		}
+
+		if _, err = q.Exec("UPDATE instalments SET transaction_id = $1 WHERE id = $2;", id, d.instalment.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partialPayed is what the partial payments of a bounced transaction add
+// up to.
+const partialPayed = `(SELECT coalesce(sum(p.amount), 0) FROM transactions p WHERE p.partial_of = t.id AND p.payed = 1 AND p.revoked = 0)`
+
+// outstanding is the principal of a loan not yet repaid: everything but
+// the instalments whose transaction was payed. A partial payment of a
+// bounced instalment covers its interest first, and the rest its principal.
+func outstanding(q dbtx, loan int64) (int64, error) {
+	var repaid, principal int64
+
+	err := q.QueryRow("SELECT principal FROM loans WHERE id = $1;", loan).Scan(&principal)
+	if err != nil {
+		return 0, err
+	}
+
+	err = q.QueryRow(`
+		SELECT coalesce(sum(CASE WHEN t.payed = 1 THEN i.principal ELSE max(0, `+partialPayed+` - i.interest) END), 0)
+		FROM instalments i JOIN transactions t ON i.transaction_id = t.id
+		WHERE i.loan = $1 AND t.revoked = 0 AND (t.payed = 1 OR t.failed = 1);`, loan).Scan(&repaid)
+	if err != nil {
+		return 0, err
+	}
+
+	return principal - repaid, nil
+}
+
+// rescheduleBounced adds, for every instalment that bounced on date, a new
+// one on the next date for what it left unpayed.
+func rescheduleBounced(q dbtx, date uint64) error {
+	rows, err := q.Query(`
+		SELECT i.id, i.loan, i.principal, i.interest, `+partialPayed+`
+		FROM instalments i JOIN transactions t ON i.transaction_id = t.id JOIN loans l ON i.loan = l.id
+		WHERE l.status = $1 AND t.failed = 1 AND t.revoked = 0 AND t.date_settled = $2
+		AND NOT EXISTS (SELECT 1 FROM instalments s WHERE s.shortfall_of = i.id)
+		ORDER BY i.id ASC;`, LOAN_ACTIVE, date)
+	if err != nil {
+		return err
+	}
+
+	type bounced struct {
+		instalment Instalment
+		loan       int64
+		payed      int64
+	}
+
+	var all []bounced
+	for rows.Next() {
+		var b bounced
+		if err := rows.Scan(&b.instalment.Id, &b.loan, &b.instalment.Principal, &b.instalment.Interest, &b.payed); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, b)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range all {
+		interest := max(0, b.instalment.Interest-b.payed)
+		principal := b.instalment.Principal - max(0, b.payed-b.instalment.Interest)
+		if principal+interest <= 0 {
+			continue
+		}
+
+		var last uint64
+		if err = q.QueryRow("SELECT coalesce(max(number), 0) FROM instalments WHERE loan = $1;", b.loan).Scan(&last); err != nil {
+			return err
+		}
+
+		_, err = q.Exec("INSERT INTO instalments (loan, number, date_due, principal, interest, shortfall_of) VALUES ($1, $2, $3, $4, $5, $6);",
+			b.loan, last+1, date+1, principal, interest, b.instalment.Id)
+		if err != nil {
+			return err
+		}
+
+		if _, err = q.Exec("UPDATE loans SET term = $1 WHERE id = $2;", last+1, b.loan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeRepaidLoans marks as repaid the active loans nothing is owed on.
+func closeRepaidLoans(q dbtx) error {
+	rows, err := q.Query("SELECT id FROM loans WHERE status = $1;", LOAN_ACTIVE)
+	if err != nil {
+		return err
+	}
+
+	var active []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		active = append(active, id)
+	}
+	rows.Close()
+
+	for _, id := range active {
+		o, err := outstanding(q, id)
+		if err != nil {
+			return err
+		}
+
+		if o <= 0 {
+			if _, err = q.Exec("UPDATE loans SET status = $1 WHERE id = $2;", LOAN_REPAID, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return rows.Err()
+}
+
+func (b *Bank) loadSchedule(loan int64) ([]Instalment, error) {
+	rows, err := b.db.Query(`
+		SELECT i.id, i.number, i.date_due, i.principal, i.interest, coalesce(i.transaction_id, 0),
+			coalesce(t.payed, 0), coalesce(t.failed, 0), coalesce(t.revoked, 0)
+		FROM instalments i LEFT JOIN transactions t ON i.transaction_id = t.id
+		WHERE i.loan = $1 ORDER BY i.number ASC;`, loan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedule := []Instalment{}
+	for rows.Next() {
+		var i Instalment
+		var payed, failed, revoked bool
+		if err := rows.Scan(&i.Id, &i.Number, &i.Date, &i.Principal, &i.Interest, &i.Transaction, &payed, &failed, &revoked); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case i.Transaction == 0:
+			i.Status = INSTALMENT_SCHEDULED
+		case revoked:
+			continue
+		case failed:
+			i.Status = TX_BOUNCED
+		case payed:
+			i.Status = TX_PAYED
+		default:
+			i.Status = TX_PENDING
+		}
+
+		schedule = append(schedule, i)
+	}
+
+	return schedule, rows.Err()
+}
+
+func (b *Bank) GetLoan(id int64) (*Loan, error) {
+	var l Loan
+	err := b.db.QueryRow("SELECT l.id, l.account, a.holder, l.principal, l.rate, l.term, l.date_created, l.status FROM loans l JOIN accounts a ON l.account = a.id WHERE l.id = $1;", id).
+		Scan(&l.Id, &l.Account, &l.Holder, &l.Principal, &l.Rate, &l.Term, &l.Date, &l.Status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf(ERR_LOAN_NOT_FOUND)
+		}
+		return nil, err
+	}
+
+	l.Outstanding, err = outstanding(b.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Schedule, err = b.loadSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// GetLoans lists the loans of an account, or of every account if account
+// is nil. Only active loans are listed unless all is set.
+func (b *Bank) GetLoans(account *int64, all bool) ([]Loan, error) {
+	query := "SELECT id FROM loans WHERE ($1 IS NULL OR account = $1) AND ($2 OR status = $3) ORDER BY id ASC;"
+
+	rows, err := b.db.Query(query, account, all, LOAN_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	loans := []Loan{}
+	for _, id := range ids {
+		l, err := b.GetLoan(id)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, *l)
+	}
+
+	return loans, nil
+}
+
+// RestructureLoan replaces the instalments still to be posted with a new
+// schedule at the given rate, spreading what is still owed (bounced
+// instalments included) over term dates starting on the next date.
+func (b *Bank) RestructureLoan(id int64, rate int64, term uint64) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		return restructureLoan(tx, id, rate, term)
+	})
+}
+
+// activeLoan checks that a loan exists and is still active.
+func activeLoan(q dbtx, id int64) error {
+	var status string
+	err := q.QueryRow("SELECT status FROM loans WHERE id = $1;", id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf(ERR_LOAN_NOT_FOUND)
+	}
+	if err != nil {
+		return err
+	}
+
+	if status != LOAN_ACTIVE {
+		return fmt.Errorf(ERR_LOAN_NOT_ACTIVE)
+	}
+	return nil
+}
+
+func restructureLoan(tx *sql.Tx, id int64, rate int64, term uint64) error {
+	if err := activeLoan(tx, id); err != nil {
+		return err
+	}
+
+	owed, err := outstanding(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM instalments WHERE loan = $1 AND transaction_id IS NULL;", id); err != nil {
+		return err
+	}
+
+	// Instalments posted but not yet settled are part of what is owed too
+	var pending int64
+	err = tx.QueryRow(`
+		SELECT coalesce(sum(i.principal), 0)
+		FROM instalments i JOIN transactions t ON i.transaction_id = t.id
+		WHERE i.loan = $1 AND t.payed = 0 AND t.failed = 0 AND t.revoked = 0;`, id).Scan(&pending)
+	if err != nil {
+		return err
+	}
+
+	owed -= pending
+	if owed <= 0 {
+		return fmt.Errorf(ERR_LOAN_NOT_ACTIVE)
+	}
+
+	if err := validLoanTerms(owed, rate, term); err != nil {
+		return err
+	}
+
+	var last uint64
+	if err = tx.QueryRow("SELECT coalesce(max(number), 0) FROM instalments WHERE loan = $1;", id).Scan(&last); err != nil {
+		return err
+	}
+
+	date, err := readClock(tx)
+	if err != nil {
+		return err
+	}
+
+	if err = schedule(tx, id, owed, rate, term, date+1, last+1); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE loans SET rate = $1, term = $2 WHERE id = $3;", rate, last+term, id)
+	return err
+}
+
+// ForgiveLoan cancels whatever is still owed: scheduled instalments are
+// dropped and posted ones not yet settled are revoked.
+func (b *Bank) ForgiveLoan(id int64) error {
+	return serializable(b.db, func(tx *sql.Tx) error {
+		return forgiveLoan(tx, id)
+	})
+}
+
+func forgiveLoan(tx *sql.Tx, id int64) error {
+	if err := activeLoan(tx, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM instalments WHERE loan = $1 AND transaction_id IS NULL;", id); err != nil {
+		return err
+	}
+
+	ids, err := transactionIds(tx, "payed = 0 AND failed = 0 AND id IN (SELECT transaction_id FROM instalments WHERE loan = $1)", id)
+	if err != nil {
+		return err
+	}
+
+	if err = setStatus(tx, ids, "revoked = 1"); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE loans SET status = $1 WHERE id = $2;", LOAN_FORGIVEN, id)
+	return err
+}
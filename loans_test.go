@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// The interest of a large loan is scheduled in full, not overflowed, and
+// rates above the most are refused.
+func TestLoanScheduleLarge(t *testing.T) {
+	const principal = 10000000000000
+
+	b := newTestBank(t)
+
+	id, err := b.CreateAccount("borrower", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A deposit puts the same cash in the vault
+	if err = b.Deposit(id, principal, DEFAULT_CURRENCY, "reserves"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.GrantLoan(id, principal, MAX_INTEREST_RATE+1, 1); err == nil || err.Error() != ERR_RATE_INVALID {
+		t.Errorf("a rate above the most was not refused: %v", err)
+	}
+
+	loan, err := b.GrantLoan(id, principal, MAX_INTEREST_RATE, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var interest int64
+	if err = b.db.QueryRow("SELECT interest FROM instalments WHERE loan = $1;", loan).Scan(&interest); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := int64(principal / 10000 * MAX_INTEREST_RATE); interest != want {
+		t.Errorf("interest is %d, want %d", interest, want)
+	}
+}
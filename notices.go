@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Notify sends a letter from the bank vault to an account. Notices are
+// written in both languages, as the bank does not know which one the
+// holder reads.
+func (b *Bank) Notify(receiver int64, title string, body string) error {
+	var last int64
+	err := b.db.QueryRow("SELECT coalesce(max(id), 0) FROM letters;").Scan(&last)
+	if err != nil {
+		return err
+	}
+
+	// Letter ids are timestamps, make sure several notices in the same
+	// second do not collide
+	now := time.Now()
+	id := now.Unix()
+	if id <= last {
+		id = last + 1
+	}
+
+	holder, err := b.GetAccountHolder(ACCOUNT_VAULT)
+	if err != nil {
+		return err
+	}
+
+	date := b.GetDate()
+	directory := fmt.Sprintf("%d-%s", ACCOUNT_VAULT, holder)
+	name := fmt.Sprintf("%d-%s_notice_%d_to_%d.txt", date, now.Format("2006_01_02"), id, receiver)
+
+	l := &Letter{Timestamp: uint64(id), Sender: ACCOUNT_VAULT, Receiver: receiver, Date: date, Path: filepath.Join(b.letters, directory, name), Title: title, Body: []byte(body)}
+
+	return l.Send(b)
+}
+
+// notifyBounced tells both parties of every bounced transaction in s.
+// Failing to deliver a notice is logged but does not undo the settlement.
+func (b *Bank) notifyBounced(s *Settlement) {
+	decimals := b.GetDecimals()
+	partial := map[int64]string{}
+	for _, t := range s.Partial {
+		partial[t.Id] = formatAmount(t.Amount, decimals)
+	}
+
+	for _, t := range s.Failed {
+		from, _ := b.GetAccountHolder(t.Debitor)
+		to, _ := b.GetAccountHolder(t.Creditor)
+
+		symbol := t.Currency
+		if c, err := loadCurrency(b.db, t.Currency); err == nil {
+			symbol = c.Symbol
+		}
+		amount := formatAmount(t.Amount, decimals)
+
+		title := fmt.Sprintf("Transaction #%d bounced / Transacción #%d devuelta", t.Id, t.Id)
+		body := fmt.Sprintf("The transaction #%d (*%s*) of %s%s from %s [%04d] to %s [%04d], due on date %d, could not be covered and bounced.\n\n",
+			t.Id, t.Concept, symbol, amount, from, t.Debitor, to, t.Creditor, t.Date)
+		if payed, ok := partial[t.Id]; ok {
+			body += fmt.Sprintf("Only %s%s of it was payed.\n\n", symbol, payed)
+		}
+
+		body += "---\n\n"
+		body += fmt.Sprintf("La transacción #%d (*%s*) de %s%s de %s [%04d] a %s [%04d], con fecha de pago %d, no tenía fondos y ha sido devuelta.\n\n",
+			t.Id, t.Concept, amount, symbol, from, t.Debitor, to, t.Creditor, t.Date)
+		if payed, ok := partial[t.Id]; ok {
+			body += fmt.Sprintf("Solo se pagaron %s%s.\n", payed, symbol)
+		}
+
+		for _, receiver := range []int64{t.Debitor, t.Creditor} {
+			if receiver <= ACCOUNT_VAULT {
+				continue
+			}
+
+			if err := b.Notify(receiver, title, body); err != nil {
+				log.Printf("Could not notify %d of bounced transaction #%d: %s\n", receiver, t.Id, err.Error())
+			}
+		}
+	}
+}
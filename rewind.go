@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Rewinding takes the clock back to a past date, to undo a turn that went
+// wrong. What was settled after that date is pending again, and what was
+// created after it is hidden until the clock reaches its date again. The
+// interest, instalments and standing orders already posted are not posted
+// twice, so advancing again replays the same transactions. Revocations and
+// cancellations are not dated, so they stay as they are, and so do escrows
+// already released or returned: only their payments are pending again.
+
+// Rewind takes the bank back to date, and returns how many transactions
+// are pending again.
+func (b *Bank) Rewind(date uint64) (int64, error) {
+	var n int64
+
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		clock, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		if date >= clock {
+			return fmt.Errorf(ERR_REWIND_NOT_PAST)
+		}
+
+		// A transaction that bounces again is partially payed again. The
+		// ledger is hash chained, so the old payment is revoked, not deleted
+		partials, err := transactionIds(tx, "partial_of IN (SELECT id FROM transactions WHERE date_settled > $1)", date)
+		if err != nil {
+			return err
+		}
+
+		if err = setStatus(tx, partials, "revoked = 1"); err != nil {
+			return err
+		}
+
+		// What an instalment that bounces again leaves unpayed is owed again
+		// then, the shortfall owed now goes
+		shortfalls, err := transactionIds(tx, `id IN (
+			SELECT s.transaction_id FROM instalments s JOIN instalments i ON s.shortfall_of = i.id JOIN transactions t ON i.transaction_id = t.id
+			WHERE t.date_settled > $1)`, date)
+		if err != nil {
+			return err
+		}
+
+		if err = setStatus(tx, shortfalls, "revoked = 1"); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM instalments WHERE shortfall_of IN (
+				SELECT i.id FROM instalments i JOIN transactions t ON i.transaction_id = t.id WHERE t.date_settled > $1);`, date)
+		if err != nil {
+			return err
+		}
+
+		settled, err := transactionIds(tx, "date_settled > $1", date)
+		if err != nil {
+			return err
+		}
+
+		if err = setStatus(tx, settled, "payed = 0, failed = 0, date_settled = NULL"); err != nil {
+			return err
+		}
+		n = int64(len(settled))
+
+		if _, err = tx.Exec("UPDATE system SET clock = $1 WHERE id = 1;", date); err != nil {
+			return err
+		}
+
+		return reopenLoans(tx)
+	})
+
+	return n, err
+}
+
+// reopenLoans marks as active again the repaid loans that are owed again.
+func reopenLoans(q dbtx) error {
+	rows, err := q.Query("SELECT id FROM loans WHERE status = $1;", LOAN_REPAID)
+	if err != nil {
+		return err
+	}
+
+	var repaid []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		repaid = append(repaid, id)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range repaid {
+		o, err := outstanding(q, id)
+		if err != nil {
+			return err
+		}
+
+		if o > 0 {
+			if _, err = q.Exec("UPDATE loans SET status = $1 WHERE id = $2;", LOAN_ACTIVE, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ledgerBalanceAt computes the balance of an account in a currency on
+// date, from the transactions settled by then.
+func ledgerBalanceAt(q dbtx, id int64, currency string, date uint64) (int64, error) {
+	var credits, debits int64
+
+	err := q.QueryRow("SELECT coalesce(sum(amount), 0) FROM transactions WHERE debitor = $1 AND currency = $2 AND payed = 1 AND revoked = 0 AND coalesce(date_settled, date_due) <= $3;", id, currency, date).Scan(&debits)
+	if err != nil {
+		return 0, err
+	}
+
+	err = q.QueryRow("SELECT coalesce(sum(amount), 0) FROM transactions WHERE creditor = $1 AND currency = $2 AND payed = 1 AND revoked = 0 AND coalesce(date_settled, date_due) <= $3;", id, currency, date).Scan(&credits)
+	if err != nil {
+		return 0, err
+	}
+
+	return credits - debits, nil
+}
+
+// ledgerBalancesAt computes the balance of an account in every currency on
+// date.
+func ledgerBalancesAt(q dbtx, id int64, date uint64) ([]CurrencyBalance, error) {
+	currencies, err := loadCurrencies(q)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]CurrencyBalance, len(currencies))
+	for i, c := range currencies {
+		balances[i].Currency = c
+		if balances[i].Amount, err = ledgerBalanceAt(q, id, c.Code, date); err != nil {
+			return nil, err
+		}
+	}
+
+	return balances, nil
+}
+
+// LoadAccountAsOf loads an account as it was on date, to settle disputes.
+// It is only for reading: loans and standing orders keep no history, so
+// they are left out.
+func (b *Bank) LoadAccountAsOf(id int64, date uint64) (*Account, error) {
+	var a Account
+	err := b.db.QueryRow("SELECT id, holder, date FROM accounts WHERE id = $1;", id).Scan(&a.Id, &a.Holder, &a.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Balance, err = ledgerBalanceAt(b.db, id, DEFAULT_CURRENCY, date); err != nil {
+		return nil, err
+	}
+
+	if a.Balances, err = ledgerBalancesAt(b.db, id, date); err != nil {
+		return nil, err
+	}
+
+	if a.Transactions, err = b.getTransactions(id, date); err != nil {
+		return nil, err
+	}
+
+	if a.Letters, err = b.getLetters(id, date); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scheduler advances the clock on its own, for games played
+// asynchronously: either every so often, or every day at given times of the
+// (wall clock) day. The admin can pause it without restarting the server.
+type Scheduler struct {
+	bank  *Bank
+	every time.Duration
+	at    []time.Duration // offsets from midnight, in local time
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewScheduler builds a scheduler that advances every interval, or at the
+// comma separated times of day ("20:00" or "08:00,20:00"). It returns nil
+// if neither is given, as the scheduler is optional.
+func NewScheduler(b *Bank, every time.Duration, at string) (*Scheduler, error) {
+	if every < 0 {
+		return nil, fmt.Errorf("the advance interval cannot be negative")
+	}
+
+	if every > 0 && at != "" {
+		return nil, fmt.Errorf("advance either every interval or at times of day, not both")
+	}
+
+	s := &Scheduler{bank: b, every: every}
+	for _, t := range strings.Split(at, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		hour, minute, ok := strings.Cut(t, ":")
+		h, err := strconv.Atoi(hour)
+		if err != nil || !ok || h < 0 || h > 23 {
+			return nil, fmt.Errorf("invalid time of day: %s", t)
+		}
+
+		m, err := strconv.Atoi(minute)
+		if err != nil || m < 0 || m > 59 {
+			return nil, fmt.Errorf("invalid time of day: %s", t)
+		}
+
+		s.at = append(s.at, time.Duration(h)*time.Hour+time.Duration(m)*time.Minute)
+	}
+
+	if s.every == 0 && len(s.at) == 0 {
+		return nil, nil
+	}
+
+	return s, nil
+}
+
+// after computes the first advance strictly after now.
+func (s *Scheduler) after(now time.Time) time.Time {
+	if s.every > 0 {
+		return now.Add(s.every)
+	}
+
+	var next time.Time
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, offset := range s.at {
+		t := midnight.Add(offset)
+		if !t.After(now) {
+			t = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Add(offset)
+		}
+
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+// Status is the time of the next scheduled advance, and whether it will be
+// skipped because the scheduler is paused. The time is zero if there is no
+// scheduler.
+func (s *Scheduler) Status() (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	s.mu.Lock()
+	next := s.next
+	s.mu.Unlock()
+
+	paused, err := s.bank.AdvancePaused()
+	if err != nil {
+		log.Println("Error reading the scheduler state: " + err.Error())
+	}
+
+	return next, paused
+}
+
+// Run advances the clock of the bank on schedule, until the program ends.
+// When the scheduler is paused the advances are skipped.
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		s.next = s.after(time.Now())
+		next := s.next
+		s.mu.Unlock()
+
+		log.Printf("Next date advance at %s\n", next.Format(time.DateTime))
+		time.Sleep(time.Until(next))
+
+		paused, err := s.bank.AdvancePaused()
+		if err != nil {
+			log.Println("Error reading the scheduler state: " + err.Error())
+			continue
+		}
+
+		if paused {
+			log.Println("Scheduled date advance skipped, the scheduler is paused")
+			continue
+		}
+
+		st, err := s.bank.AdvanceClock()
+		if err != nil {
+			log.Println("Error advancing the date: " + err.Error())
+			continue
+		}
+
+		s.bank.Audit(nil, "next", map[string]any{"date": st.Date, "scheduled": true}, "")
+		log.Printf("Date advanced to %d on schedule: %d settled, %d failed\n", st.Date, len(st.Settled), len(st.Failed))
+	}
+}
+
+// AdvancePaused tells whether the admin paused the scheduled advances.
+func (b *Bank) AdvancePaused() (bool, error) {
+	var paused bool
+	err := b.db.QueryRow("SELECT advance_paused FROM system WHERE id = 1;").Scan(&paused)
+	return paused, err
+}
+
+// SetAdvancePaused pauses or resumes the scheduled advances. The flag is
+// kept in the database, so the admin command line can change it while the
+// server runs.
+func (b *Bank) SetAdvancePaused(paused bool) error {
+	_, err := b.db.Exec("UPDATE system SET advance_paused = $1 WHERE id = 1;", paused)
+	return err
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A migration takes the database from version-1 to version. Migrations are
+// only ever appended: once released, their SQL must not change.
+type migration struct {
+	version     int
+	description string
+	sql         string
+}
+
+var migrations = []migration{
+	{1, "base schema", `
+		CREATE TABLE IF NOT EXISTS system (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			clock INTEGER,
+			schema_version INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS accounts (
+			id INTEGER NOT NULL PRIMARY KEY,
+			holder VARCHAR(100) NOT NULL,
+			date INTEGER NOT NULL,
+			password TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS transactions (
+			id INTEGER NOT NULL PRIMARY KEY,
+			creditor INTEGER NOT NULL,
+			debitor INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			concept TEXT,
+			date_created INTEGER NOT NULL,
+			date_due INTEGER NOT NULL,
+			payed BOOLEAN NOT NULL DEFAULT FALSE,
+			revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			FOREIGN KEY (creditor) REFERENCES accounts(id),
+			FOREIGN KEY (debitor) REFERENCES accounts(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS letters (
+			id INTEGER PRIMARY KEY,
+			sender INTEGER NOT NULL,
+			receiver INTEGER NOT NULL,
+			Title VARCHAR(255),
+			Path VARCHAR(2048),
+			Date INTEGER,
+			public BOOLEAN,
+			FOREIGN KEY (sender) REFERENCES accounts (id),
+			FOREIGN KEY (receiver) REFERENCES accounts (id)
+		);
+
+		INSERT OR IGNORE INTO system (id, name, clock) VALUES (1, '', 0);
+	`},
+	{2, "settlement date and failed transactions", `
+		ALTER TABLE transactions ADD COLUMN date_settled INTEGER;
+		ALTER TABLE transactions ADD COLUMN failed BOOLEAN NOT NULL DEFAULT FALSE;
+		UPDATE transactions SET date_settled = date_due WHERE payed = 1;
+	`},
+	{3, "bounce and overdraft policy", `
+		ALTER TABLE system ADD COLUMN bounce_policy TEXT NOT NULL DEFAULT 'reject';
+		ALTER TABLE system ADD COLUMN overdraft_limit INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE transactions ADD COLUMN partial_of INTEGER REFERENCES transactions(id);
+	`},
+	{4, "loans and instalments", `
+		CREATE TABLE IF NOT EXISTS loans (
+			id INTEGER NOT NULL PRIMARY KEY,
+			account INTEGER NOT NULL,
+			principal INTEGER NOT NULL,
+			rate INTEGER NOT NULL,
+			term INTEGER NOT NULL,
+			date_created INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'active',
+			FOREIGN KEY (account) REFERENCES accounts(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS instalments (
+			id INTEGER NOT NULL PRIMARY KEY,
+			loan INTEGER NOT NULL,
+			number INTEGER NOT NULL,
+			date_due INTEGER NOT NULL,
+			principal INTEGER NOT NULL,
+			interest INTEGER NOT NULL,
+			transaction_id INTEGER,
+			FOREIGN KEY (loan) REFERENCES loans(id),
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+		);
+	`},
+	{5, "savings interest and account classes", `
+		ALTER TABLE accounts ADD COLUMN class TEXT NOT NULL DEFAULT 'standard';
+		ALTER TABLE system ADD COLUMN interest_rate INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE system ADD COLUMN interest_rounding TEXT NOT NULL DEFAULT 'floor';
+		ALTER TABLE system ADD COLUMN interest_date INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE IF NOT EXISTS interest_rates (
+			class TEXT NOT NULL PRIMARY KEY,
+			rate INTEGER NOT NULL
+		);
+	`},
+	{6, "standing orders", `
+		CREATE TABLE IF NOT EXISTS standing_orders (
+			id INTEGER NOT NULL PRIMARY KEY,
+			debitor INTEGER NOT NULL,
+			creditor INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			concept TEXT,
+			period INTEGER NOT NULL,
+			next_date INTEGER NOT NULL,
+			end_date INTEGER NOT NULL DEFAULT 0,
+			date_created INTEGER NOT NULL,
+			cancelled BOOLEAN NOT NULL DEFAULT FALSE,
+			FOREIGN KEY (creditor) REFERENCES accounts(id),
+			FOREIGN KEY (debitor) REFERENCES accounts(id)
+		);
+	`},
+	{7, "persistent sessions", `
+		CREATE TABLE IF NOT EXISTS sessions (
+			token TEXT NOT NULL PRIMARY KEY,
+			account INTEGER NOT NULL,
+			holder TEXT,
+			expiry INTEGER NOT NULL,
+			FOREIGN KEY (account) REFERENCES accounts(id)
+		);
+		CREATE INDEX IF NOT EXISTS sessions_expiry ON sessions (expiry);
+	`},
+	{8, "scheduled date advances", `
+		ALTER TABLE system ADD COLUMN advance_paused BOOLEAN NOT NULL DEFAULT FALSE;
+	`},
+	{9, "audit log", `
+		CREATE TABLE IF NOT EXISTS audit (
+			id INTEGER NOT NULL PRIMARY KEY,
+			actor INTEGER,
+			action TEXT NOT NULL,
+			params TEXT NOT NULL,
+			date INTEGER NOT NULL,
+			time INTEGER NOT NULL,
+			remote TEXT,
+			FOREIGN KEY (actor) REFERENCES accounts(id)
+		);
+		CREATE INDEX IF NOT EXISTS audit_actor ON audit (actor);
+
+		CREATE TRIGGER IF NOT EXISTS audit_no_update BEFORE UPDATE ON audit
+		BEGIN
+			SELECT RAISE(ABORT, 'the audit log cannot be changed');
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS audit_no_delete BEFORE DELETE ON audit
+		BEGIN
+			SELECT RAISE(ABORT, 'the audit log cannot be changed');
+		END;
+	`},
+	{10, "hash chained ledger", `
+		ALTER TABLE transactions ADD COLUMN hash TEXT;
+	`},
+	{11, "currencies and exchange rates", `
+		CREATE TABLE IF NOT EXISTS currencies (
+			code TEXT NOT NULL PRIMARY KEY,
+			symbol TEXT NOT NULL,
+			name TEXT NOT NULL
+		);
+		INSERT OR IGNORE INTO currencies (code, symbol, name) VALUES ('money', '$', 'Money');
+
+		ALTER TABLE transactions ADD COLUMN currency TEXT NOT NULL DEFAULT 'money';
+		CREATE INDEX IF NOT EXISTS transactions_currency ON transactions (currency);
+
+		CREATE TABLE IF NOT EXISTS exchange_rates (
+			source TEXT NOT NULL,
+			target TEXT NOT NULL,
+			source_units INTEGER NOT NULL,
+			target_units INTEGER NOT NULL,
+			PRIMARY KEY (source, target),
+			FOREIGN KEY (source) REFERENCES currencies(code),
+			FOREIGN KEY (target) REFERENCES currencies(code)
+		);
+	`},
+	{12, "minor units", `
+		ALTER TABLE system ADD COLUMN decimals INTEGER NOT NULL DEFAULT 0;
+	`},
+	{13, "transfer fees", `
+		CREATE TABLE IF NOT EXISTS fee_rules (
+			id INTEGER NOT NULL PRIMARY KEY,
+			class TEXT NOT NULL DEFAULT '',
+			counterparty INTEGER NOT NULL DEFAULT 0,
+			flat INTEGER NOT NULL DEFAULT 0,
+			rate INTEGER NOT NULL DEFAULT 0,
+			minimum INTEGER NOT NULL DEFAULT 0,
+			maximum INTEGER NOT NULL DEFAULT 0
+		);
+
+		ALTER TABLE transactions ADD COLUMN fee_of INTEGER REFERENCES transactions(id);
+	`},
+	{14, "tax rules", `
+		CREATE TABLE IF NOT EXISTS tax_rules (
+			id INTEGER NOT NULL PRIMARY KEY,
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			bracket_from INTEGER NOT NULL DEFAULT 0,
+			bracket_to INTEGER NOT NULL DEFAULT 0,
+			rate INTEGER NOT NULL DEFAULT 0,
+			amount INTEGER NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT FALSE
+		);
+
+		ALTER TABLE system ADD COLUMN tax_date INTEGER NOT NULL DEFAULT 0;
+		UPDATE system SET tax_date = clock WHERE id = 1;
+	`},
+	{15, "escrow", `
+		CREATE TABLE IF NOT EXISTS escrows (
+			id INTEGER NOT NULL PRIMARY KEY,
+			debitor INTEGER NOT NULL,
+			creditor INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			currency TEXT NOT NULL DEFAULT 'money',
+			concept TEXT,
+			deadline INTEGER NOT NULL,
+			date_created INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'held',
+			debitor_accepts BOOLEAN NOT NULL DEFAULT FALSE,
+			creditor_accepts BOOLEAN NOT NULL DEFAULT FALSE,
+			disputed BOOLEAN NOT NULL DEFAULT FALSE,
+			date_closed INTEGER,
+			FOREIGN KEY (creditor) REFERENCES accounts(id),
+			FOREIGN KEY (debitor) REFERENCES accounts(id)
+		);
+
+		INSERT OR IGNORE INTO accounts (id, holder, date, password)
+		SELECT -3, 'ESCROW', 0, password FROM accounts WHERE id = 0;
+	`},
+	{16, "invoices", `
+		CREATE TABLE IF NOT EXISTS invoices (
+			id INTEGER NOT NULL PRIMARY KEY,
+			issuer INTEGER NOT NULL,
+			payer INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			currency TEXT NOT NULL DEFAULT 'money',
+			concept TEXT,
+			date_due INTEGER NOT NULL,
+			date_created INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			transaction_id INTEGER,
+			FOREIGN KEY (issuer) REFERENCES accounts(id),
+			FOREIGN KEY (payer) REFERENCES accounts(id),
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+		);
+		CREATE INDEX IF NOT EXISTS invoices_payer ON invoices (payer);
+	`},
+	{17, "joint accounts", `
+		CREATE TABLE IF NOT EXISTS members (
+			account INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			password TEXT NOT NULL,
+			PRIMARY KEY (account, name),
+			FOREIGN KEY (account) REFERENCES accounts(id)
+		);
+
+		ALTER TABLE accounts ADD COLUMN approval_threshold INTEGER;
+		ALTER TABLE accounts ADD COLUMN approvals_required INTEGER NOT NULL DEFAULT 1;
+
+		CREATE TABLE IF NOT EXISTS pending_transfers (
+			id INTEGER NOT NULL PRIMARY KEY,
+			debitor INTEGER NOT NULL,
+			creditor INTEGER NOT NULL,
+			amount INTEGER NOT NULL,
+			currency TEXT NOT NULL DEFAULT 'money',
+			concept TEXT,
+			date_due INTEGER NOT NULL,
+			date_created INTEGER NOT NULL,
+			proposer TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			transaction_id INTEGER,
+			FOREIGN KEY (creditor) REFERENCES accounts(id),
+			FOREIGN KEY (debitor) REFERENCES accounts(id),
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS approvals (
+			pending INTEGER NOT NULL,
+			member TEXT NOT NULL,
+			PRIMARY KEY (pending, member),
+			FOREIGN KEY (pending) REFERENCES pending_transfers(id)
+		);
+	`},
+	{18, "users", `
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			password TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS user_accounts (
+			user_id INTEGER NOT NULL,
+			account INTEGER NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (user_id, account),
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (account) REFERENCES accounts(id)
+		);
+		CREATE INDEX IF NOT EXISTS user_accounts_account ON user_accounts (account);
+
+		ALTER TABLE sessions ADD COLUMN user_id INTEGER;
+	`},
+	{19, "loan shortfalls", `
+		ALTER TABLE instalments ADD COLUMN shortfall_of INTEGER REFERENCES instalments(id);
+	`},
+	{20, "chained status changes", `
+		CREATE TABLE IF NOT EXISTS transaction_status (
+			id INTEGER NOT NULL PRIMARY KEY,
+			transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+			chained_after INTEGER NOT NULL,
+			payed BOOLEAN NOT NULL,
+			failed BOOLEAN NOT NULL,
+			revoked BOOLEAN NOT NULL,
+			date_settled INTEGER,
+			hash TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS transaction_status_chained_after ON transaction_status (chained_after);
+
+		CREATE TRIGGER IF NOT EXISTS transaction_status_no_update BEFORE UPDATE ON transaction_status
+		BEGIN
+			SELECT RAISE(ABORT, 'the chained statuses cannot be changed');
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS transaction_status_no_delete BEFORE DELETE ON transaction_status
+		BEGIN
+			SELECT RAISE(ABORT, 'the chained statuses cannot be changed');
+		END;
+
+		-- The statuses of the transactions there already are were never chained
+		ALTER TABLE system ADD COLUMN status_chained_after INTEGER NOT NULL DEFAULT 0;
+		UPDATE system SET status_chained_after = (SELECT coalesce(max(id), 0) FROM transactions) WHERE id = 1;
+	`},
+	{21, "standing order currencies", `
+		ALTER TABLE standing_orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'money';
+	`},
+	{22, "member users", `
+		ALTER TABLE members ADD COLUMN user_id INTEGER REFERENCES users(id);
+		CREATE UNIQUE INDEX IF NOT EXISTS members_user ON members (account, user_id);
+	`},
+	{23, "console sessions", `
+		ALTER TABLE sessions ADD COLUMN console INTEGER NOT NULL DEFAULT 0;
+	`},
+}
+
+// SCHEMA_VERSION is the version a database has after every migration ran.
+var SCHEMA_VERSION = migrations[len(migrations)-1].version
+
+func hasColumn(q dbtx, table string, column string) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT count(*) FROM pragma_table_info($1) WHERE name = $2;", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// schemaVersion reads the version stored in the system table. Databases
+// created by the Lua console have the base schema but no version column, so
+// they are stamped as version 1.
+func schemaVersion(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'system';").Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	versioned, err := hasColumn(db, "system", "schema_version")
+	if err != nil {
+		return 0, err
+	}
+
+	if !versioned {
+		_, err = db.Exec("ALTER TABLE system ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1;")
+		if err != nil {
+			return 0, err
+		}
+		log.Println("Stamped legacy database with schema version 1")
+	}
+
+	var version int
+	err = db.QueryRow("SELECT schema_version FROM system WHERE id = 1;").Scan(&version)
+	return version, err
+}
+
+// migrate brings the database up to SCHEMA_VERSION, each migration in its own
+// transaction so a failure leaves the database at the last good version.
+func migrate(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("database schema version %d is newer than this program (%d)", version, SCHEMA_VERSION)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+
+		if _, err = tx.Exec("UPDATE system SET schema_version = $1 WHERE id = 1;", m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Printf("Migrated database to schema version %d: %s\n", m.version, m.description)
+	}
+
+	return nil
+}
@@ -8,12 +8,12 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 	"os"
 	"errors"
+	"flag"
 
-	"github.com/flytam/filenamify"
-	"github.com/google/uuid"
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
 )
@@ -21,14 +21,13 @@ import (
 const TITLE_PROVISIONAL = "NOMIC BANK"
 
 const COOKIE_NAME = "session_token"
+const CONSOLE_COOKIE_NAME = "console_token"
 
-var sessions = map[string]session{}
+var sessions *SessionManager
 
-type session struct {
-	id     uint64
-	holder string
-	expiry time.Time
-}
+var feed *Feed
+
+var scheduler *Scheduler
 
 type PageData struct {
 	Account *Account
@@ -37,34 +36,42 @@ type PageData struct {
 	Book    []Book
 	Lang	string
 	Title	string
+	NextAdvance time.Time
+	Paused	bool
+	AsOf	bool
+	Rates	[]ExchangeRate
+	Decimals	int
+	Preview	*TransferPreview
 }
 
-func (s session) isExpired() bool {
-	return s.expiry.Before(time.Now())
-}
+// loadSession loads the account logged in with a session token, and keeps
+// the session alive. It returns the new expiry of the session.
+func loadSession(b *Bank, sessionToken string) (*Account, time.Time, error) {
+	userSession, err := sessions.Touch(sessionToken)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
 
+	a, err := loadSessionAccount(b, userSession)
+	return a, userSession.expiry, err
+}
 
-func checkSessionCookie(b *Bank, r *http.Request) (*Account, error) {
-	c, err := r.Cookie(COOKIE_NAME)
+// peekSession loads the account of a session without extending it.
+func peekSession(b *Bank, sessionToken string) (*Account, error) {
+	userSession, err := sessions.Peek(sessionToken)
 	if err != nil {
 		return nil, err
 	}
 
-	sessionToken := c.Value
+	return loadSessionAccount(b, userSession)
+}
 
-	userSession, exists := sessions[sessionToken]
-	if !exists {
-		// If the session token is not present in session map, return an unauthorized error
+func loadSessionAccount(b *Bank, userSession session) (*Account, error) {
+	// The sessions of the admin console do not open the account pages
+	if userSession.console {
 		return nil, fmt.Errorf("Unauthorized")
 	}
 
-	// If the session is present, but has expired, we can delete the session, and return
-	// an unauthorized status
-	if userSession.isExpired() {
-		delete(sessions, sessionToken)
-		return nil, fmt.Errorf("Expired")
-	}
-
 	a, err := b.LoadAccountById(int64(userSession.id))
 	if err != nil {
 		// Account not found!
@@ -72,11 +79,54 @@ func checkSessionCookie(b *Bank, r *http.Request) (*Account, error) {
 
 	}
 
+	if err = b.loadIdentity(a, userSession); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// logoutAll ends every session of whoever is using the account: a user on
+// all of their accounts, or the holder or member who logged in to it. The
+// others who share the account stay logged in.
+func logoutAll(b *Bank, a *Account) error {
+	if a.User == "" {
+		return sessions.DeleteHolder(uint64(a.Id), a.Member)
+	}
+
+	user, err := b.getUserId(a.User)
+	if err != nil {
+		return err
+	}
+	return sessions.DeleteUser(user)
+}
+
+func setSessionCookie(w http.ResponseWriter, sessionToken string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    COOKIE_NAME,
+		Value:   sessionToken,
+		Expires: expiresAt,
+		Path:    "/",
+	})
+}
+
+func checkSessionCookie(b *Bank, w http.ResponseWriter, r *http.Request) (*Account, error) {
+	c, err := r.Cookie(COOKIE_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	a, expiresAt, err := loadSession(b, c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	setSessionCookie(w, c.Value, expiresAt)
 	return a, nil
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
-	renderTemplate(w, "index", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: nil, Errors: nil})
+	renderTemplate(w, b, "index", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: nil, Errors: nil})
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
@@ -87,48 +137,54 @@ func loginHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string)
 
 	var errors []string
 
-	if err != nil {
-		// Account number not well formatted
-		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
-	}
-
-	_, err = b.GetAccountHolder(int64(id))
-	if err != nil {
-		// Account not found i db
-		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
-	}
+	// A user logs in with their own name and password, on the account
+	// they choose or else on their first one
+	user, isUser := b.AuthenticateUser(holder, password)
+	if isUser {
+		if r.FormValue("account") == "" {
+			first, err := b.firstAccount(user)
+			id = uint64(first)
+			if err != nil {
+				errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
+			}
+		} else if err != nil {
+			errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
+		} else if _, err = b.userRole(user, int64(id)); err != nil {
+			errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
+		}
+	} else {
+		if err != nil {
+			// Account number not well formatted
+			errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
+		}
 
-	hash, err := b.GetHash(int64(id))
-	if err != nil {
-		// Account not found i db
-		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
-	}
+		_, err = b.GetAccountHolder(int64(id))
+		if err != nil {
+			// Account not found i db
+			errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
+		}
 
-	if !CheckPassword(password, hash) {
-		// Password incorrect
-		errors = append(errors, ErrorStrings[lang][ERR_INCORRECT_PASSWORD])
+		// The members of a joint account log in with their own name and
+		// password
+		if _, ok := b.Authenticate(int64(id), holder, password); !ok {
+			// Password incorrect
+			errors = append(errors, ErrorStrings[lang][ERR_INCORRECT_PASSWORD])
+		}
+		user = 0
 	}
 
 	if len(errors) > 0 {
-		renderTemplate(w, "index", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: nil, Errors: errors})
+		renderTemplate(w, b, "index", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: nil, Errors: errors})
 		return
 	}
 
-	sessionToken := uuid.NewString()
-	expiresAt := time.Now().Add(360 * time.Second)
-
-	sessions[sessionToken] = session{
-		id:     id,
-		holder: holder,
-		expiry: expiresAt,
+	sessionToken, expiresAt, err := sessions.New(id, holder, user)
+	if err != nil {
+		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
+		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    COOKIE_NAME,
-		Value:   sessionToken,
-		Expires: expiresAt,
-		Path:    "/",
-	})
+	setSessionCookie(w, sessionToken, expiresAt)
 
 	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
 }
@@ -148,53 +204,38 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string)
 
 	sessionToken := c.Value
 
-	delete(sessions, sessionToken)
+	sessions.Delete(sessionToken)
 
 	// We need to let the client know that the cookie is expired
 	// In the response, we set the session token to an empty
 	// value and set its expiry as the current time
-	http.SetCookie(w, &http.Cookie{
-		Name:    COOKIE_NAME,
-		Value:   "",
-		Expires: time.Now(),
-	})
+	setSessionCookie(w, "", time.Now())
 
 	http.Redirect(w, r, "/a/" + lang, http.StatusFound)
 }
 
-func accountHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
-	c, err := r.Cookie(COOKIE_NAME)
+func logoutallHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			// If the cookie is not set, return an unauthorized status
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		// For any other type of error, return a bad request status
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	sessionToken := c.Value
-
-	userSession, exists := sessions[sessionToken]
-	if !exists {
-		// If the session token is not present in session map, return an unauthorized error
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	// If the session is present, but has expired, we can delete the session, and return
-	// an unauthorized status
-	if userSession.isExpired() {
-		delete(sessions, sessionToken)
-		w.WriteHeader(http.StatusUnauthorized)
+	err = logoutAll(b, a)
+	if err != nil {
+		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
 		return
 	}
 
-	a, err := b.LoadAccountById(int64(userSession.id))
+	log.Printf("%s (%d) logged out of every device\n", a.Holder, a.Id)
+
+	setSessionCookie(w, "", time.Now())
+	http.Redirect(w, r, "/a/" + lang, http.StatusFound)
+}
+
+func accountHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
-		// Here I think unauthoized is the best response
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -207,14 +248,39 @@ func accountHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string
 		}
 	}
 
-	renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Account: a, Clock: b.clock, Errors: nil, Book: book})
+	var errors []string
+	clock := b.GetDate()
+	asOf := false
+
+	// With ?asof= the page shows the account as it was on a past date, and
+	// nothing can be ordered from it
+	if v := r.URL.Query().Get("asof"); v != "" {
+		date, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_DATE_INVALID])
+		} else if date < clock {
+			a, err = b.LoadAccountAsOf(a.Id, date)
+			if err != nil {
+				http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
+				return
+			}
+			clock, asOf = date, true
+		}
+	}
+
+	rates, err := b.GetExchangeRates()
+	if err != nil {
+		log.Println("Error querying: " + err.Error())
+	}
+
+	renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Account: a, Clock: clock, Errors: errors, Book: book, AsOf: asOf, Rates: rates})
 }
 
 func transferHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 	var errors []string
 
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -226,7 +292,7 @@ func transferHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang strin
 		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
 	}
 
-	amount, err := strconv.ParseInt(r.FormValue("amount"), 10, 64)
+	amount, err := parseAmount(r.FormValue("amount"), b.GetDecimals())
 	if err != nil {
 		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_AMOUNT_INVALID])
 	}
@@ -237,28 +303,442 @@ func transferHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang strin
 	}
 
 	if len(errors) > 0 {
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
 	concept := r.FormValue("concept")
 
-	err = b.Transfer(uint64(a.Id), creditor, amount, due, concept)
+	currency := r.FormValue("currency")
+	if currency == "" {
+		currency = DEFAULT_CURRENCY
+	}
+
+	// An escrow holds the funds until both parties accept, and the due
+	// date is its deadline
+	escrow := r.FormValue("escrow") != ""
+
+	// The form first shows what the transfer costs, fees included, and
+	// only orders it once the player confirms
+	if r.FormValue("confirm") == "" {
+		p, err := b.PreviewTransfer(uint64(a.Id), creditor, amount, currency, due, concept)
+		if err != nil {
+			errors = append(errors, GetBackendError(lang, err.Error()))
+			renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+			return
+		}
+
+		p.Escrow = escrow
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Preview: &p})
+		return
+	}
+
+	if escrow {
+		id, err := b.OpenEscrow(uint64(a.Id), creditor, amount, currency, due, concept)
+		if err != nil {
+			errors = append(errors, GetBackendError(lang, err.Error()))
+			renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+			return
+		}
+
+		log.Printf("Escrow #%d from %s (%d) to %d until %d for %d %s\n", id, a.Holder, a.Id, creditor, due, amount, currency)
+		auditRequest(b, r, a, "escrow", map[string]any{"id": id, "to": creditor, "amount": amount, "currency": currency, "deadline": due, "concept": concept})
+		http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+		return
+	}
+
+	// Above the threshold of a joint account, the transfer waits for the
+	// approval of its members
+	pending, err := b.ProposeTransfer(a.Id, a.Member, int64(creditor), amount, currency, due, concept)
 	if err != nil {
 		errors = append(errors, GetBackendError(lang, err.Error()))
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
-	log.Printf("Transfer Ordered from %s (%d) to %d due on %d for $%d\n", a.Holder, a.Id, creditor, due, amount)
+	if pending != 0 {
+		log.Printf("Transfer #%d from %s (%d) to %d waits for approvals\n", pending, a.Holder, a.Id, creditor)
+		auditRequest(b, r, a, "propose", map[string]any{"id": pending, "to": creditor, "amount": amount, "currency": currency, "due": due, "concept": concept})
+		http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+		return
+	}
+
+	log.Printf("Transfer Ordered from %s (%d) to %d due on %d for %d %s\n", a.Holder, a.Id, creditor, due, amount, currency)
+	auditRequest(b, r, a, "transfer", map[string]any{"to": creditor, "amount": amount, "currency": currency, "due": due, "concept": concept})
 	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound) // maybe some hash encoding or something
 }
 
+func convertHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	amount, err := parseAmount(r.FormValue("amount"), b.GetDecimals())
+	if err != nil {
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: []string{ErrorStrings[lang][ERR_TRANSFER_AMOUNT_INVALID]}})
+		return
+	}
+
+	// The form offers the pairs the bank exchanges as "from:to"
+	from, to, _ := strings.Cut(r.FormValue("rate"), ":")
+
+	bought, err := b.Convert(a.Id, amount, from, to)
+	if err != nil {
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: []string{GetBackendError(lang, err.Error())}})
+		return
+	}
+
+	log.Printf("%s (%d) exchanged %d %s for %d %s\n", a.Holder, a.Id, amount, from, bought, to)
+	auditRequest(b, r, a, "convert", map[string]any{"amount": amount, "from": from, "to": to, "bought": bought})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func standingHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	creditor, err := strconv.ParseInt(r.FormValue("to"), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
+	}
+
+	amount, err := parseAmount(r.FormValue("amount"), b.GetDecimals())
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_AMOUNT_INVALID])
+	}
+
+	start, err := strconv.ParseUint(r.FormValue("start"), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_DATE_INVALID])
+	}
+
+	period, err := strconv.ParseUint(r.FormValue("period"), 10, 64)
+	if err != nil || period == 0 {
+		errors = append(errors, ErrorStrings[lang][ERR_PERIOD_INVALID])
+	}
+
+	// The end date is optional, leaving it empty means forever
+	var end uint64
+	if r.FormValue("end") != "" {
+		end, err = strconv.ParseUint(r.FormValue("end"), 10, 64)
+		if err != nil {
+			errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_DATE_INVALID])
+		}
+	}
+
+	if len(errors) > 0 {
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	concept := r.FormValue("concept")
+
+	currency := r.FormValue("currency")
+	if currency == "" {
+		currency = DEFAULT_CURRENCY
+	}
+
+	id, err := b.CreateStandingOrder(a.Id, creditor, amount, currency, concept, start, period, end)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("Standing order #%d from %s (%d) to %d every %d dates from %d for %d %s\n", id, a.Holder, a.Id, creditor, period, start, amount, currency)
+	auditRequest(b, r, a, "standing", map[string]any{"id": id, "to": creditor, "amount": amount, "currency": currency, "concept": concept, "start": start, "period": period, "end": end})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func cancelHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	order_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_STANDING_ORDER_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	err = b.CancelStandingOrder(a.Id, order_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) cancelled standing order #%d\n", a.Holder, a.Id, order_id)
+	auditRequest(b, r, a, "cancel", map[string]any{"id": order_id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func acceptHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	escrow_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_ESCROW_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	err = b.AcceptEscrow(a.Id, escrow_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) accepted escrow #%d\n", a.Holder, a.Id, escrow_id)
+	auditRequest(b, r, a, "accept", map[string]any{"id": escrow_id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func approveHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	pending_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_PENDING_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	id, err := b.ApproveTransfer(a.Id, a.Member, pending_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) approved transfer #%d\n", a.Member, a.Id, pending_id)
+	auditRequest(b, r, a, "approve", map[string]any{"id": pending_id, "transaction": id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func rejectHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	pending_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_PENDING_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	err = b.RejectTransfer(a.Id, a.Member, pending_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) rejected transfer #%d\n", a.Member, a.Id, pending_id)
+	auditRequest(b, r, a, "reject", map[string]any{"id": pending_id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func disputeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	escrow_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_ESCROW_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	err = b.DisputeEscrow(a.Id, escrow_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) disputed escrow #%d\n", a.Holder, a.Id, escrow_id)
+	auditRequest(b, r, a, "dispute", map[string]any{"id": escrow_id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func invoiceHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	payer, err := strconv.ParseInt(r.FormValue("to"), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NUMBER_INVALID])
+	}
+
+	amount, err := parseAmount(r.FormValue("amount"), b.GetDecimals())
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_AMOUNT_INVALID])
+	}
+
+	due, err := strconv.ParseUint(r.FormValue("due"), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_TRANSFER_DATE_INVALID])
+	}
+
+	if len(errors) > 0 {
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	concept := r.FormValue("concept")
+
+	currency := r.FormValue("currency")
+	if currency == "" {
+		currency = DEFAULT_CURRENCY
+	}
+
+	id, err := b.IssueInvoice(a.Id, payer, amount, currency, due, concept)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("Invoice #%d from %s (%d) to %d due on %d for %d %s\n", id, a.Holder, a.Id, payer, due, amount, currency)
+	auditRequest(b, r, a, "invoice", map[string]any{"id": id, "to": payer, "amount": amount, "currency": currency, "due": due, "concept": concept})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func payHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	invoice_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_INVOICE_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	// Like a transfer, paying first shows what it costs
+	if r.FormValue("confirm") == "" {
+		p, err := b.PreviewInvoice(a.Id, invoice_id)
+		if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+		}
+
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Preview: &p})
+		return
+	}
+
+	id, err := b.PayInvoice(a.Id, invoice_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) paid invoice #%d with transaction #%d\n", a.Holder, a.Id, invoice_id, id)
+	auditRequest(b, r, a, "pay", map[string]any{"id": invoice_id, "transaction": id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func declineHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	invoice_id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		errors = append(errors, ErrorStrings[lang][ERR_INVOICE_ID_INVALID])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	err = b.DeclineInvoice(a.Id, invoice_id)
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) declined invoice #%d\n", a.Holder, a.Id, invoice_id)
+	auditRequest(b, r, a, "decline", map[string]any{"id": invoice_id})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
 func changepasswdHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 	var errors []string
 
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -273,37 +753,120 @@ func changepasswdHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang s
 		errors = append(errors, ErrorStrings[lang][ERR_NEW_PASSWORDS_MISMATCH])
 	}
 
-	hash, err := b.GetHash(a.Id)
-	if err != nil {
-		// Account not found i db
-		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
-	}
-
-	if !CheckPassword(currpass, hash) {
+	if !b.checkSessionPass(a, currpass) {
 		// Password incorrect
 		errors = append(errors, ErrorStrings[lang][ERR_CURRENT_PASSWORD_INCORRECT])
 	}
 
 	if len(errors) > 0 {
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
-	err = b.ChangePass(a.Id, newpass)
+	err = b.changeSessionPass(a, newpass)
 	if err != nil {
 		errors = append(errors, GetBackendError(lang, err.Error()))
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
+	auditRequest(b, r, a, "changepasswd", nil)
 	http.Redirect(w, r, "/a/" + lang +"/account/", http.StatusFound) // maybe some hash encoding or something
 }
 
+func switchHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("account"), 10, 64)
+	if err != nil || !a.linkedTo(id) {
+		errors = append(errors, ErrorStrings[lang][ERR_ACCOUNT_NOT_FOUND])
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	c, _ := r.Cookie(COOKIE_NAME)
+	if err = sessions.Switch(c.Value, uint64(id)); err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s switched from %d to %d\n", a.User, a.Id, id)
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func shareHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user := r.FormValue("user")
+	role := r.FormValue("role")
+
+	err = fmt.Errorf(ERR_NOT_OWNER)
+	if a.Role == ROLE_OWNER {
+		err = b.LinkUser(user, a.Id, role)
+	}
+
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) shared the account with %s as %s\n", a.Holder, a.Id, user, role)
+	auditRequest(b, r, a, "share", map[string]any{"with": user, "role": role})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
+func unshareHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	var errors []string
+
+	a, err := checkSessionCookie(b, w, r)
+	if err != nil {
+		// Account not found!
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user := r.FormValue("user")
+
+	err = fmt.Errorf(ERR_NOT_OWNER)
+	if a.Role == ROLE_OWNER {
+		err = b.UnlinkUser(user, a.Id)
+	}
+
+	if err != nil {
+		errors = append(errors, GetBackendError(lang, err.Error()))
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+		return
+	}
+
+	log.Printf("%s (%d) stopped sharing the account with %s\n", a.Holder, a.Id, user)
+	auditRequest(b, r, a, "unshare", map[string]any{"with": user})
+	http.Redirect(w, r, "/a/" + lang + "/account/", http.StatusFound)
+}
+
 func revokeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 	var errors []string
 	
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -314,18 +877,19 @@ func revokeHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string)
 	transaction_id, err := strconv.ParseUint(path.Base(r.URL.Path), 10, 64)
 	if err != nil {
 		errors = append(errors, ErrorStrings[lang][ERR_TRANSACTION_ID_INVALID])
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
 	err = b.RevokeTransaction(a.Id, transaction_id)
 	if err != nil {
 		errors = append(errors, GetBackendError(lang, err.Error()))
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
 	log.Printf("%s (%d) revoked transaction #%d\n", a.Holder, a.Id, transaction_id)
+	auditRequest(b, r, a, "revoke", map[string]any{"id": transaction_id})
 	http.Redirect(w, r, "/a/" + lang +"/account/", http.StatusFound) // maybe some hash encoding or something
 }
 
@@ -333,7 +897,7 @@ func readHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 	var errors []string
 
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -345,14 +909,14 @@ func readHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 	letter_id, err := strconv.ParseUint(path.Base(r.URL.Path), 10, 64)
 	if err != nil {
 		errors = append(errors, ErrorStrings[lang][ERR_LETTER_ID_INVALID])
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
 	l, err := a.LoadLetter(letter_id, b)
 	if err != nil {
 		errors = append(errors, GetBackendError(lang, err.Error()))
-		renderTemplate(w, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: errors})
+		renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
 		return
 	}
 
@@ -364,7 +928,7 @@ func readHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 func letterHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 	
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -380,12 +944,12 @@ func letterHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string)
 		}
 	}
 
-	renderTemplate(w, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: nil, Book: book})
+	renderTemplate(w, b, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: nil, Book: book})
 }
 
 func bookHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 	
-	_, err := checkSessionCookie(b, r)
+	_, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -440,7 +1004,7 @@ func docHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 func sendHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 		
-	a, err := checkSessionCookie(b, r)
+	a, err := checkSessionCookie(b, w, r)
 	if err != nil {
 		// Account not found!
 		w.WriteHeader(http.StatusUnauthorized)
@@ -450,56 +1014,88 @@ func sendHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
 
 	receiver, err := strconv.ParseInt(r.FormValue("to"), 10, 64)
 	if err != nil {
-		renderTemplate(w, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: []string{GetBackendError(lang, err.Error())}})
+		renderTemplate(w, b, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: []string{GetBackendError(lang, err.Error())}})
 	}
 
 	body := r.FormValue("body")
 	title := r.FormValue("title")
 
-	now := time.Now()
-	time := now.Unix()
-	directory := fmt.Sprintf("%d-%s", a.Id, a.Holder)
-	clock := fmt.Sprintf("%d", b.clock)
-	name, err := filenamify.Filenamify(title, filenamify.Options{
-		Replacement: "_",
-	})
-
+	l, err := b.NewLetter(a, receiver, title, body)
 	if err != nil {
 		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
 		return
 	}
 
-	path := path.Join("bank", "letters", directory, clock+"-"+now.Format("2006_01_02")+"_"+name+"_to_"+r.FormValue("to")+".txt")
-
-	l := &Letter{Timestamp: uint64(time), Sender: a.Id, Receiver: receiver, Date: b.clock, Path: path, Title: title, Body: []byte(body)}
-
+	action := ""
 	if r.FormValue("send") != "" {
+		action = "send"
 		err = l.Send(b)
 	} else if r.FormValue("publish") != "" {
+		action = "publish"
 		err = l.Publish(b)
 	} else {
 
 	}
 
 	if err != nil {
-		renderTemplate(w, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.clock, Account: a, Errors: []string{GetBackendError(lang, err.Error())}})
+		renderTemplate(w, b, "letter", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: []string{GetBackendError(lang, err.Error())}})
 		return
 	}
 
-	log.Println("Received letter from " + a.Holder + " at date " + string(b.clock) + ": " + title)
+	log.Println("Received letter from " + a.Holder + " at date " + strconv.FormatUint(b.GetDate(), 10) + ": " + title)
+	if action != "" {
+		auditRequest(b, r, a, action, map[string]any{"id": l.Timestamp, "to": receiver, "title": title})
+	}
 	http.Redirect(w, r, "/a/" + lang +"/account", http.StatusFound)
 }
 
-var templates = template.Must(template.ParseFiles("tmpl/index.html", "tmpl/account.html", "tmpl/letter.html", "tmpl/read.html", "tmpl/book.html", "tmpl/archive.html"))
+func ledgerHandler(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+
+	head, err := b.GetLedgerHead()
+	if err != nil {
+		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	err = templates.ExecuteTemplate(w, "ledger.html", &struct{Lang string; Clock uint64; Head LedgerHead}{Lang: lang, Clock: b.GetDate(), Head: head})
+	if err != nil {
+		http.Error(w, GetBackendError(lang, err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// Amounts are shown with the decimals of the bank: {{amount .Amount $.Decimals}}
+var templateFuncs = template.FuncMap{
+	"amount": formatAmount,
+	"step":   amountStep,
+}
+
+var templates = template.Must(template.New("").Funcs(templateFuncs).ParseFiles("tmpl/index.html", "tmpl/account.html", "tmpl/letter.html", "tmpl/read.html", "tmpl/book.html", "tmpl/archive.html", "tmpl/ledger.html", "tmpl/admin.html"))
+
+func renderTemplate(w http.ResponseWriter, b *Bank, tmpl string, d *PageData) {
+	d.NextAdvance, d.Paused = scheduler.Status()
+	d.Decimals = b.GetDecimals()
 
-func renderTemplate(w http.ResponseWriter, tmpl string, d *PageData) {
 	err := templates.ExecuteTemplate(w, tmpl+".html", d)
 	if err != nil {
 		http.Error(w,  err.Error(), http.StatusInternalServerError)
 	}
 }
 
-var validPath = regexp.MustCompile("^/a/(es|en)/(account/|archive/|transfer/|login/|send/|letter/|logout/|book/|changepasswd/|revoke/[0-9]+|read/[0-9]+|doc/[0-9]+)?$")
+var validPath = regexp.MustCompile("^/a/(es|en)/(account/|archive/|transfer/|convert/|login/|send/|letter/|logout/|logoutall/|events/|book/|ledger/|changepasswd/|switch/|share/|unshare/|admin/(login/|logout/|create/|passwd/|deposit/|withdraw/|next/|revoke/)?|standing/|cancel/[0-9]+|accept/[0-9]+|dispute/[0-9]+|approve/[0-9]+|reject/[0-9]+|invoice/|pay/[0-9]+|decline/[0-9]+|revoke/[0-9]+|read/[0-9]+|doc/[0-9]+)?$")
+
+// signerOnly runs fn only for the sessions that can use the funds of the
+// account. A viewer gets the account page with an error instead.
+func signerOnly(fn func(http.ResponseWriter, *http.Request, *Bank, string)) func(http.ResponseWriter, *http.Request, *Bank, string) {
+	return func(w http.ResponseWriter, r *http.Request, b *Bank, lang string) {
+		a, err := checkSessionCookie(b, w, r)
+		if err == nil && a.Role == ROLE_VIEWER {
+			errors := []string{GetBackendError(lang, ERR_READ_ONLY)}
+			renderTemplate(w, b, "account", &PageData{Title: TITLE_PROVISIONAL, Lang: lang, Clock: b.GetDate(), Account: a, Errors: errors})
+			return
+		}
+		fn(w, r, b, lang)
+	}
+}
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request, *Bank, string), b *Bank) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -516,12 +1112,25 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, *Bank, string), b *
 func main() {
 
 	args := os.Args
-	if len(args) != 2 {
-		fmt.Printf("Usage: %s <db-filename>\n", args[0])
+	if len(args) > 1 && args[1] == "admin" {
+		adminMain(args[2:])
+		return
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	lifetime := fs.Duration("session-lifetime", DEFAULT_SESSION_LIFETIME, "how long an idle session stays logged in")
+	store := fs.String("sessions", "db", "where sessions are kept (db or memory)")
+	every := fs.Duration("advance-every", 0, "advance the date on its own every interval (e.g. 30m)")
+	at := fs.String("advance-at", "", "advance the date on its own every day at these times (e.g. 20:00 or 08:00,20:00)")
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Printf("Usage: %s [-session-lifetime 6m] [-sessions db|memory] [-advance-every 30m | -advance-at 20:00] <db-filename>\n", args[0])
+		fmt.Printf("       %s admin [-lang en|es] <db-filename> <command> [arguments...]\n", args[0])
 		os.Exit(1)
 	}
 
-	dbfname := args[1]
+	dbfname := fs.Arg(0)
 	if _, err := os.Stat(dbfname); errors.Is(err, os.ErrNotExist) {
 		fmt.Println("No such database file: ", dbfname)
 		os.Exit(1)
@@ -534,22 +1143,72 @@ func main() {
 		log.Fatal(err)
 	}
 
+	switch *store {
+	case "db":
+		sessions = NewSessionManager(dbSessions{db: bank.db}, *lifetime)
+	case "memory":
+		sessions = NewSessionManager(memorySessions{}, *lifetime)
+	default:
+		log.Fatal("Unknown session store: ", *store)
+	}
+
+	go sessions.Sweep(time.Minute)
+
+	feed = NewFeed()
+	go feed.Watch(bank, FEED_POLL_INTERVAL)
+
+	scheduler, err = NewScheduler(bank, *every, *at)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if scheduler != nil {
+		go scheduler.Run()
+	}
+
 	
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	
 	http.HandleFunc("/a/{lang}/", makeHandler(indexHandler, bank))
 	http.HandleFunc("/a/{lang}/login/", makeHandler(loginHandler, bank))
 	http.HandleFunc("/a/{lang}/logout/", makeHandler(logoutHandler, bank))
+	http.HandleFunc("/a/{lang}/logoutall/", makeHandler(logoutallHandler, bank))
 	http.HandleFunc("/a/{lang}/account/", makeHandler(accountHandler, bank))
-	http.HandleFunc("/a/{lang}/transfer/", makeHandler(transferHandler, bank))
-	http.HandleFunc("/a/{lang}/revoke/", makeHandler(revokeHandler, bank))
+	http.HandleFunc("/a/{lang}/events/", makeHandler(eventsHandler, bank))
+	http.HandleFunc("/a/{lang}/transfer/", makeHandler(signerOnly(transferHandler), bank))
+	http.HandleFunc("/a/{lang}/convert/", makeHandler(signerOnly(convertHandler), bank))
+	http.HandleFunc("/a/{lang}/revoke/", makeHandler(signerOnly(revokeHandler), bank))
+	http.HandleFunc("/a/{lang}/standing/", makeHandler(signerOnly(standingHandler), bank))
+	http.HandleFunc("/a/{lang}/cancel/", makeHandler(signerOnly(cancelHandler), bank))
+	http.HandleFunc("/a/{lang}/accept/", makeHandler(signerOnly(acceptHandler), bank))
+	http.HandleFunc("/a/{lang}/dispute/", makeHandler(signerOnly(disputeHandler), bank))
+	http.HandleFunc("/a/{lang}/approve/", makeHandler(signerOnly(approveHandler), bank))
+	http.HandleFunc("/a/{lang}/reject/", makeHandler(signerOnly(rejectHandler), bank))
+	http.HandleFunc("/a/{lang}/invoice/", makeHandler(signerOnly(invoiceHandler), bank))
+	http.HandleFunc("/a/{lang}/pay/", makeHandler(signerOnly(payHandler), bank))
+	http.HandleFunc("/a/{lang}/decline/", makeHandler(signerOnly(declineHandler), bank))
 	http.HandleFunc("/a/{lang}/letter/", makeHandler(letterHandler, bank))
-	http.HandleFunc("/a/{lang}/send/", makeHandler(sendHandler, bank))
+	http.HandleFunc("/a/{lang}/send/", makeHandler(signerOnly(sendHandler), bank))
 	http.HandleFunc("/a/{lang}/read/", makeHandler(readHandler, bank))
 	http.HandleFunc("/a/{lang}/book/", makeHandler(bookHandler, bank))
 	http.HandleFunc("/a/{lang}/archive/", makeHandler(archiveHandler, bank))
+	http.HandleFunc("/a/{lang}/ledger/", makeHandler(ledgerHandler, bank))
 	http.HandleFunc("/a/{lang}/doc/", makeHandler(docHandler, bank))
 	http.HandleFunc("/a/{lang}/changepasswd/", makeHandler(changepasswdHandler, bank))
+	http.HandleFunc("/a/{lang}/switch/", makeHandler(switchHandler, bank))
+	http.HandleFunc("/a/{lang}/share/", makeHandler(shareHandler, bank))
+	http.HandleFunc("/a/{lang}/unshare/", makeHandler(unshareHandler, bank))
+	http.HandleFunc("/a/{lang}/admin/", makeHandler(consoleHandler, bank))
+	http.HandleFunc("POST /a/{lang}/admin/login/", makeHandler(consoleLoginHandler, bank))
+	http.HandleFunc("POST /a/{lang}/admin/logout/", makeHandler(consoleLogoutHandler, bank))
+	http.HandleFunc("POST /a/{lang}/admin/create/", makeHandler(adminOnly(consoleCreateHandler), bank))
+	http.HandleFunc("POST /a/{lang}/admin/passwd/", makeHandler(adminOnly(consolePasswdHandler), bank))
+	http.HandleFunc("POST /a/{lang}/admin/deposit/", makeHandler(adminOnly(consoleDepositHandler), bank))
+	http.HandleFunc("POST /a/{lang}/admin/withdraw/", makeHandler(adminOnly(consoleWithdrawHandler), bank))
+	http.HandleFunc("POST /a/{lang}/admin/next/", makeHandler(adminOnly(consoleNextHandler), bank))
+	http.HandleFunc("POST /a/{lang}/admin/revoke/", makeHandler(adminOnly(consoleRevokeHandler), bank))
+
+	registerAPI(bank)
 
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DEFAULT_SESSION_LIFETIME = 360 * time.Second
+
+type session struct {
+	id      uint64
+	holder  string
+	user    int64 // the user logged in, 0 if it was the account itself
+	console bool  // the admin on the web console, not on the account pages
+	expiry  time.Time
+}
+
+func (s session) isExpired() bool {
+	return s.expiry.Before(time.Now())
+}
+
+// A SessionStore keeps the logged in sessions by token. The bank database
+// is the default, so nobody is logged out when the server restarts.
+type SessionStore interface {
+	Save(token string, s session) error
+	Load(token string) (session, bool, error)
+	Delete(token string) error
+	DeleteHolder(id uint64, member string) error
+	DeleteUser(user int64) error
+	Sweep(now time.Time) (int64, error)
+}
+
+// memorySessions keeps sessions in memory only, as the server used to.
+type memorySessions map[string]session
+
+func (m memorySessions) Save(token string, s session) error {
+	m[token] = s
+	return nil
+}
+
+func (m memorySessions) Load(token string) (session, bool, error) {
+	s, ok := m[token]
+	return s, ok, nil
+}
+
+func (m memorySessions) Delete(token string) error {
+	delete(m, token)
+	return nil
+}
+
+func (m memorySessions) DeleteHolder(id uint64, member string) error {
+	for token, s := range m {
+		if s.id == id && s.user == 0 && !s.console && (member == "" || s.holder == member) {
+			delete(m, token)
+		}
+	}
+	return nil
+}
+
+func (m memorySessions) DeleteUser(user int64) error {
+	for token, s := range m {
+		if s.user == user {
+			delete(m, token)
+		}
+	}
+	return nil
+}
+
+func (m memorySessions) Sweep(now time.Time) (int64, error) {
+	var n int64
+	for token, s := range m {
+		if s.expiry.Before(now) {
+			delete(m, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// dbSessions keeps sessions in the sessions table of the bank database.
+type dbSessions struct {
+	db *sql.DB
+}
+
+func (d dbSessions) Save(token string, s session) error {
+	_, err := d.db.Exec("INSERT INTO sessions (token, account, holder, user_id, console, expiry) VALUES ($1, $2, $3, nullif($4, 0), $5, $6) ON CONFLICT (token) DO UPDATE SET account = excluded.account, expiry = excluded.expiry;",
+		token, s.id, s.holder, s.user, s.console, s.expiry.Unix())
+	return err
+}
+
+func (d dbSessions) Load(token string) (session, bool, error) {
+	var s session
+	var expiry int64
+	err := d.db.QueryRow("SELECT account, coalesce(holder, ''), coalesce(user_id, 0), console, expiry FROM sessions WHERE token = $1;", token).Scan(&s.id, &s.holder, &s.user, &s.console, &expiry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+
+	s.expiry = time.Unix(expiry, 0)
+	return s, true, nil
+}
+
+func (d dbSessions) Delete(token string) error {
+	_, err := d.db.Exec("DELETE FROM sessions WHERE token = $1;", token)
+	return err
+}
+
+func (d dbSessions) DeleteHolder(id uint64, member string) error {
+	_, err := d.db.Exec("DELETE FROM sessions WHERE account = $1 AND user_id IS NULL AND NOT console AND ($2 = '' OR holder = $2);", id, member)
+	return err
+}
+
+func (d dbSessions) DeleteUser(user int64) error {
+	_, err := d.db.Exec("DELETE FROM sessions WHERE user_id = $1;", user)
+	return err
+}
+
+func (d dbSessions) Sweep(now time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM sessions WHERE expiry < $1;", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// A SessionManager logs accounts in and out. Sessions slide: every request
+// made with a session keeps it alive for another lifetime. The handlers run
+// concurrently, so the store is only ever used with the manager locked;
+// stores do not need to synchronize themselves.
+type SessionManager struct {
+	mu       sync.Mutex
+	store    SessionStore
+	lifetime time.Duration
+}
+
+func NewSessionManager(store SessionStore, lifetime time.Duration) *SessionManager {
+	if lifetime <= 0 {
+		lifetime = DEFAULT_SESSION_LIFETIME
+	}
+	return &SessionManager{store: store, lifetime: lifetime}
+}
+
+// New logs an account in, or a user on one of their accounts, and returns
+// the token that identifies the session, both for the web cookie and the
+// API.
+func (m *SessionManager) New(id uint64, holder string, user int64) (string, time.Time, error) {
+	return m.start(session{id: id, holder: holder, user: user})
+}
+
+// NewConsole logs the admin in to the web console. Its sessions are apart
+// from those of the accounts: they open the console and nothing else.
+func (m *SessionManager) NewConsole() (string, time.Time, error) {
+	return m.start(session{id: uint64(ACCOUNT_VAULT), console: true})
+}
+
+func (m *SessionManager) start(s session) (string, time.Time, error) {
+	sessionToken := uuid.NewString()
+	s.expiry = time.Now().Add(m.lifetime)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.store.Save(sessionToken, s)
+	return sessionToken, s.expiry, err
+}
+
+// Touch checks a session token and extends the session. It returns the
+// session with its new expiry.
+func (m *SessionManager) Touch(sessionToken string) (session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userSession, err := m.check(sessionToken)
+	if err != nil {
+		return userSession, err
+	}
+
+	userSession.expiry = time.Now().Add(m.lifetime)
+	return userSession, m.store.Save(sessionToken, userSession)
+}
+
+// Peek checks a session token without extending the session, for the event
+// streams: they stay open, but must not keep an idle session alive.
+func (m *SessionManager) Peek(sessionToken string) (session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.check(sessionToken)
+}
+
+// check loads a session, if it exists and has not expired. The manager must
+// be locked.
+func (m *SessionManager) check(sessionToken string) (session, error) {
+	userSession, exists, err := m.store.Load(sessionToken)
+	if err != nil {
+		return userSession, err
+	}
+
+	if !exists {
+		// If the session token is not present in the store, return an unauthorized error
+		return userSession, fmt.Errorf("Unauthorized")
+	}
+
+	// If the session is present, but has expired, we can delete the session, and return
+	// an unauthorized status
+	if userSession.isExpired() {
+		m.store.Delete(sessionToken)
+		return userSession, fmt.Errorf("Expired")
+	}
+
+	return userSession, nil
+}
+
+// Switch makes another account the one a session uses. Only users can
+// switch, to the accounts linked to them, which the caller checks.
+func (m *SessionManager) Switch(sessionToken string, id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userSession, exists, err := m.store.Load(sessionToken)
+	if err != nil {
+		return err
+	}
+
+	if !exists || userSession.user == 0 {
+		return fmt.Errorf("Unauthorized")
+	}
+
+	userSession.id = id
+	return m.store.Save(sessionToken, userSession)
+}
+
+func (m *SessionManager) Delete(sessionToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.Delete(sessionToken)
+}
+
+// DeleteHolder logs out of every device those who logged in to an account
+// with its password: the member given on a joint account, anyone on the
+// others. The users linked to the account stay logged in.
+func (m *SessionManager) DeleteHolder(id uint64, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.DeleteHolder(id, member)
+}
+
+// DeleteUser logs a user out of every device, whatever account they use.
+func (m *SessionManager) DeleteUser(user int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.DeleteUser(user)
+}
+
+// Sweep removes the expired sessions every interval, until the program ends.
+func (m *SessionManager) Sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.mu.Lock()
+		n, err := m.store.Sweep(time.Now())
+		m.mu.Unlock()
+
+		if err != nil {
+			log.Println("Error sweeping sessions: " + err.Error())
+			continue
+		}
+
+		if n > 0 {
+			log.Printf("Swept %d expired sessions\n", n)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBank creates a bank in a temporary file, closed when the test ends.
+func newTestBank(t *testing.T) *Bank {
+	t.Helper()
+
+	b, err := CreateBank(filepath.Join(t.TempDir(), "test.db"), "Test", "WITHDRAWALS", "DEPOSITS", "VAULT", "ESCROW", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b
+}
+
+// The server handles every request in its own goroutine: sessions are
+// created, touched and swept while the clock is read and advanced. Run with
+// go test -race.
+func TestSessionsConcurrent(t *testing.T) {
+	b := newTestBank(t)
+
+	// Sessions belong to accounts that exist
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		id, err := b.CreateAccount(fmt.Sprintf("holder %d", i), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	stores := map[string]SessionStore{
+		"memory": memorySessions{},
+		"db":     dbSessions{db: b.db},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			m := NewSessionManager(store, time.Minute)
+			go m.Sweep(time.Millisecond)
+
+			var wg sync.WaitGroup
+			for _, id := range ids {
+				wg.Add(1)
+				go func(id int64) {
+					defer wg.Done()
+
+					for j := 0; j < 20; j++ {
+						token, _, err := m.New(uint64(id), "holder", 0)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						s, err := m.Touch(token)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+
+						if s.id != uint64(id) {
+							t.Errorf("session of %d loaded as %d", id, s.id)
+						}
+
+						b.GetDate()
+					}
+				}(id)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 5; j++ {
+					if _, err := b.AdvanceClock(); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+
+			wg.Wait()
+		})
+	}
+
+	if date := b.GetDate(); date != 10 {
+		t.Errorf("date is %d after 10 advances", date)
+	}
+}
+
+// The event streams peek at their session: only requests extend it.
+func TestSessionPeek(t *testing.T) {
+	m := NewSessionManager(memorySessions{}, time.Minute)
+
+	token, expiresAt, err := m.New(ACCOUNT_MIN, "holder", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	s, err := m.Peek(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.expiry.Equal(expiresAt) {
+		t.Errorf("peek moved the expiry from %v to %v", expiresAt, s.expiry)
+	}
+
+	if s, err = m.Touch(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.expiry.After(expiresAt) {
+		t.Errorf("touch left the expiry at %v", s.expiry)
+	}
+}
+
+// Logging out of every device ends the sessions of whoever asks, not those
+// of the others who share the account.
+func TestSessionsLogoutAll(t *testing.T) {
+	b := newTestBank(t)
+
+	id, err := b.CreateAccount("holder", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := b.CreateUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]SessionStore{
+		"memory": memorySessions{},
+		"db":     dbSessions{db: b.db},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			m := NewSessionManager(store, time.Minute)
+
+			tokens := map[string]string{}
+			for who, s := range map[string]session{
+				"alice": {id: uint64(id), holder: "alice"},
+				"bob":   {id: uint64(id), holder: "bob"},
+				"user":  {id: uint64(id), holder: "user", user: user},
+			} {
+				token, _, err := m.New(s.id, s.holder, s.user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tokens[who] = token
+			}
+
+			if err := m.DeleteHolder(uint64(id), "alice"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := m.Peek(tokens["alice"]); err == nil {
+				t.Error("alice is still logged in")
+			}
+			for _, who := range []string{"bob", "user"} {
+				if _, err := m.Peek(tokens[who]); err != nil {
+					t.Errorf("%s was logged out with alice", who)
+				}
+			}
+
+			if err := m.DeleteUser(user); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := m.Peek(tokens["user"]); err == nil {
+				t.Error("the user is still logged in")
+			}
+			if _, err := m.Peek(tokens["bob"]); err != nil {
+				t.Error("bob was logged out with the user")
+			}
+		})
+	}
+}
+
+// The sessions of the admin console open nothing but the console, and
+// logging the vault out of every device leaves them alone.
+func TestConsoleSessions(t *testing.T) {
+	b := newTestBank(t)
+
+	m := NewSessionManager(dbSessions{db: b.db}, time.Minute)
+
+	token, _, err := m.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := m.Touch(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.console {
+		t.Fatal("the console session was loaded as an account's")
+	}
+
+	if _, err = loadSessionAccount(b, s); err == nil {
+		t.Error("the console session opened the vault's account page")
+	}
+
+	if err = m.DeleteHolder(uint64(ACCOUNT_VAULT), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = m.Peek(token); err != nil {
+		t.Error("logging the vault out of every device ended the console session")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Bounce policies decide what happens to a transaction the debitor cannot
+// cover when it falls due.
+const (
+	POLICY_REJECT    = "reject"    // the transaction bounces
+	POLICY_OVERDRAFT = "overdraft" // the account may go negative up to a limit
+	POLICY_PARTIAL   = "partial"   // whatever is available gets payed, the rest bounces
+)
+
+type BouncePolicy struct {
+	Policy         string
+	OverdraftLimit int64
+}
+
+// A Settlement is the outcome of advancing the clock to Date: the
+// transactions that got payed, the ones the debitor could not cover, and
+// the ones only partially payed (with the amount actually payed).
+type Settlement struct {
+	Date    uint64
+	Settled []Transaction
+	Failed  []Transaction
+	Partial []Transaction
+}
+
+func loadBouncePolicy(q dbtx) (BouncePolicy, error) {
+	var p BouncePolicy
+	err := q.QueryRow("SELECT bounce_policy, overdraft_limit FROM system WHERE id = 1;").Scan(&p.Policy, &p.OverdraftLimit)
+	return p, err
+}
+
+// available is how much an account with the given balance can spend. The
+// overdraft is only granted in the default currency.
+func (p BouncePolicy) available(balance int64, currency string) int64 {
+	if p.Policy == POLICY_OVERDRAFT && currency == DEFAULT_CURRENCY {
+		return balance + p.OverdraftLimit
+	}
+	return balance
+}
+
+func (b *Bank) GetBouncePolicy() (BouncePolicy, error) {
+	return loadBouncePolicy(b.db)
+}
+
+func (b *Bank) SetBouncePolicy(p BouncePolicy) error {
+	switch p.Policy {
+	case POLICY_REJECT, POLICY_PARTIAL:
+		p.OverdraftLimit = 0
+	case POLICY_OVERDRAFT:
+		if p.OverdraftLimit < 0 {
+			return fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+		}
+	default:
+		return fmt.Errorf(ERR_POLICY_INVALID)
+	}
+
+	_, err := b.db.Exec("UPDATE system SET bounce_policy = $1, overdraft_limit = $2 WHERE id = 1;", p.Policy, p.OverdraftLimit)
+	return err
+}
+
+// ledgerBalance computes the balance of an account in a currency from the
+// payed and non revoked transactions, as seen by q.
+func ledgerBalance(q dbtx, id int64, currency string) (int64, error) {
+	var credits, debits int64
+
+	err := q.QueryRow("SELECT coalesce(sum(amount), 0) FROM transactions WHERE debitor = $1 AND currency = $2 AND payed = 1 AND revoked = 0;", id, currency).Scan(&debits)
+	if err != nil {
+		return 0, err
+	}
+
+	err = q.QueryRow("SELECT coalesce(sum(amount), 0) FROM transactions WHERE creditor = $1 AND currency = $2 AND payed = 1 AND revoked = 0;", id, currency).Scan(&credits)
+	if err != nil {
+		return 0, err
+	}
+
+	return credits - debits, nil
+}
+
+// settleTransaction pays a single transaction on date, if the debitor can
+// still afford it under the bank's policy. Otherwise the transaction bounces
+// and is marked as failed; with the partial policy whatever is available is
+// payed first in a new transaction. It returns the amount actually payed.
+// The deposits and withdrawals accounts are the bank's border with the
+// outside world and are allowed to go negative.
+func settleTransaction(q dbtx, t Transaction, date uint64, p BouncePolicy) (int64, error) {
+	if t.Debitor >= ACCOUNT_VAULT {
+		balance, err := ledgerBalance(q, t.Debitor, t.Currency)
+		if err != nil {
+			return 0, err
+		}
+
+		available := p.available(balance, t.Currency)
+		if available < t.Amount {
+			if err = setStatus(q, []int64{t.Id}, "failed = 1, date_settled = $1", date); err != nil {
+				return 0, err
+			}
+
+			if p.Policy != POLICY_PARTIAL || available <= 0 {
+				return 0, nil
+			}
+
+			concept := fmt.Sprintf("%s (#%d)", t.Concept, t.Id)
+			id, err := insertTransaction(q, t.Creditor, t.Debitor, available, t.Currency, concept, date, date, true)
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = q.Exec("UPDATE transactions SET partial_of = $1 WHERE id = $2;", t.Id, id)
+			return available, err
+		}
+	}
+
+	return t.Amount, setStatus(q, []int64{t.Id}, "payed = 1, date_settled = $1", date)
+}
+
+// settle pays, in due order, every pending transaction that is due on or
+// before date.
+func settle(q dbtx, date uint64) (*Settlement, error) {
+	rows, err := q.Query("SELECT id, date_due, coalesce(concept, ''), amount, currency, creditor, debitor, coalesce(fee_of, 0) FROM transactions WHERE payed = 0 AND revoked = 0 AND failed = 0 AND date_due <= $1 ORDER BY date_due ASC, id ASC;", date)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Transaction
+	feeOf := map[int64]int64{}
+	for rows.Next() {
+		var t Transaction
+		var parent int64
+		if err := rows.Scan(&t.Id, &t.Date, &t.Concept, &t.Amount, &t.Currency, &t.Creditor, &t.Debitor, &parent); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pending = append(pending, t)
+		if parent != 0 {
+			feeOf[t.Id] = parent
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p, err := loadBouncePolicy(q)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Settlement{Date: date}
+	bounced := map[int64]bool{}
+	for _, t := range pending {
+		// A fee comes after its transfer and bounces along with it, the
+		// bank only charges for what got payed
+		if parent, ok := feeOf[t.Id]; ok && bounced[parent] {
+			if err = setStatus(q, []int64{t.Id}, "failed = 1, date_settled = $1", date); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		payed, err := settleTransaction(q, t, date, p)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case payed == t.Amount:
+			t.Payed = true
+			t.Status = TX_PAYED
+			s.Settled = append(s.Settled, t)
+		case payed > 0:
+			bounced[t.Id] = true
+			t.Status = TX_BOUNCED
+			s.Failed = append(s.Failed, t)
+			t.Amount = payed
+			s.Partial = append(s.Partial, t)
+		default:
+			bounced[t.Id] = true
+			t.Status = TX_BOUNCED
+			s.Failed = append(s.Failed, t)
+		}
+	}
+
+	return s, nil
+}
+
+func readClock(q dbtx) (uint64, error) {
+	var clock uint64
+	err := q.QueryRow("SELECT clock FROM system WHERE id = 1;").Scan(&clock)
+	return clock, err
+}
+
+// AdvanceClock moves the bank to the next date and settles everything that
+// falls due, all in one database transaction: either the clock advances and
+// every settlement is recorded, or nothing changes.
+func (b *Bank) AdvanceClock() (*Settlement, error) {
+	var s *Settlement
+	var date uint64
+
+	err := serializable(b.db, func(tx *sql.Tx) error {
+		clock, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		date = clock + 1
+		if _, err = tx.Exec("UPDATE system SET clock = $1 WHERE id = 1;", date); err != nil {
+			return err
+		}
+
+		if err = accrueInterest(tx, date); err != nil {
+			return err
+		}
+
+		if err = levyTaxes(tx, date); err != nil {
+			return err
+		}
+
+		if err = postInstalments(tx, date); err != nil {
+			return err
+		}
+
+		if err = materializeStandingOrders(tx, date); err != nil {
+			return err
+		}
+
+		if err = expireEscrows(tx, date); err != nil {
+			return err
+		}
+
+		s, err = settle(tx, date)
+		if err != nil {
+			return err
+		}
+
+		if err = rescheduleBounced(tx, date); err != nil {
+			return err
+		}
+
+		return closeRepaidLoans(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range s.Failed {
+		log.Printf("Transaction #%d from %d to %d for %d %s failed to settle on date %d\n", t.Id, t.Debitor, t.Creditor, t.Amount, t.Currency, date)
+	}
+
+	b.notifyBounced(s)
+
+	return s, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// A StandingOrder is a recurring transfer. Each time the clock reaches its
+// next date it is materialized into a transfer, with its fee, which then
+// settles (or bounces) like any other.
+type StandingOrder struct {
+	Id       int64
+	Debitor  int64
+	Creditor int64
+	Amount   int64
+	Currency string
+	Symbol   string
+	Concept  string
+	Period   uint64
+	Next     uint64
+	End      uint64 // 0 means it never ends
+	Created  uint64
+	To_from  string
+}
+
+// CreateStandingOrder schedules amount to be payed from one account to
+// another every period dates, starting on start and up to end (if not 0).
+func (b *Bank) CreateStandingOrder(from int64, to int64, amount int64, currency string, concept string, start uint64, period uint64, end uint64) (int64, error) {
+	if from == to {
+		return 0, fmt.Errorf(ERR_TRANSFER_TO_SELF)
+	}
+
+	if amount < 0 {
+		return 0, fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	}
+
+	if period == 0 {
+		return 0, fmt.Errorf(ERR_TERM_INVALID)
+	}
+
+	date := b.GetDate()
+	if start <= date {
+		return 0, fmt.Errorf(ERR_STANDING_START_INVALID)
+	}
+
+	if end != 0 && end < start {
+		return 0, fmt.Errorf(ERR_STANDING_END_INVALID)
+	}
+
+	if _, err := b.GetAccountHolder(to); err != nil {
+		return 0, fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := loadCurrency(b.db, currency); err != nil {
+		return 0, err
+	}
+
+	if err := checkApproval(b.db, from, amount); err != nil {
+		return 0, err
+	}
+
+	res, err := b.db.Exec(`
+		INSERT INTO standing_orders
+		(debitor, creditor, amount, currency, concept, period, next_date, end_date, date_created, cancelled)
+		VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		from, to, amount, currency, concept, period, start, end, date, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (b *Bank) getStandingOrder(id int64) (StandingOrder, error) {
+	var o StandingOrder
+	err := b.db.QueryRow("SELECT id, debitor, creditor, amount, currency, coalesce(concept, ''), period, next_date, end_date, date_created FROM standing_orders WHERE id = $1 AND cancelled = 0;", id).
+		Scan(&o.Id, &o.Debitor, &o.Creditor, &o.Amount, &o.Currency, &o.Concept, &o.Period, &o.Next, &o.End, &o.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return o, fmt.Errorf(ERR_STANDING_NOT_FOUND)
+	}
+	return o, err
+}
+
+// CancelStandingOrder stops a standing order. Either party can cancel it;
+// the account 0 (the bank) can cancel any. Transactions already
+// materialized are not touched, they can be revoked on their own.
+func (b *Bank) CancelStandingOrder(account_id int64, id int64) error {
+	o, err := b.getStandingOrder(id)
+	if err != nil {
+		return err
+	}
+
+	if account_id != ACCOUNT_VAULT && o.Debitor != account_id && o.Creditor != account_id {
+		return fmt.Errorf(ERR_STANDING_NOT_FOUND)
+	}
+
+	_, err = b.db.Exec("UPDATE standing_orders SET cancelled = 1 WHERE id = $1;", id)
+	return err
+}
+
+// GetStandingOrders lists the active standing orders an account takes part
+// in, or every active one if account is nil.
+func (b *Bank) GetStandingOrders(account *int64) ([]StandingOrder, error) {
+	rows, err := b.db.Query(`
+		SELECT o.id, o.debitor, o.creditor, o.amount, o.currency, c.symbol, coalesce(o.concept, ''), o.period, o.next_date, o.end_date, o.date_created
+		FROM standing_orders o JOIN currencies c ON c.code = o.currency
+		WHERE o.cancelled = 0 AND (o.end_date = 0 OR o.next_date <= o.end_date) AND ($1 IS NULL OR o.debitor = $1 OR o.creditor = $1)
+		ORDER BY o.id ASC;`, account)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []StandingOrder{}
+	for rows.Next() {
+		var o StandingOrder
+		if err := rows.Scan(&o.Id, &o.Debitor, &o.Creditor, &o.Amount, &o.Currency, &o.Symbol, &o.Concept, &o.Period, &o.Next, &o.End, &o.Created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return orders, nil
+	}
+
+	for i := range orders {
+		if orders[i].Creditor == *account {
+			debitor, err := b.GetAccountHolder(orders[i].Debitor)
+			if err != nil {
+				return nil, err
+			}
+			orders[i].To_from = fmt.Sprintf("<-- %s [%04d]", debitor, orders[i].Debitor)
+		} else {
+			creditor, err := b.GetAccountHolder(orders[i].Creditor)
+			if err != nil {
+				return nil, err
+			}
+			orders[i].To_from = fmt.Sprintf("--> %s [%04d]", creditor, orders[i].Creditor)
+			orders[i].Amount = -orders[i].Amount
+		}
+	}
+
+	return orders, nil
+}
+
+// materializeStandingOrders orders the transfers of every standing order
+// that falls due on or before date, catching up if dates were missed. Each
+// one pays its fee, as a transfer ordered by hand would.
+func materializeStandingOrders(q dbtx, date uint64) error {
+	rows, err := q.Query(`
+		SELECT id, debitor, creditor, amount, currency, coalesce(concept, ''), period, next_date, end_date
+		FROM standing_orders
+		WHERE cancelled = 0 AND next_date <= $1 AND (end_date = 0 OR next_date <= end_date)
+		ORDER BY id ASC;`, date)
+	if err != nil {
+		return err
+	}
+
+	var due []StandingOrder
+	for rows.Next() {
+		var o StandingOrder
+		if err := rows.Scan(&o.Id, &o.Debitor, &o.Creditor, &o.Amount, &o.Currency, &o.Concept, &o.Period, &o.Next, &o.End); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, o)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range due {
+		fee, err := transferFee(q, o.Debitor, o.Creditor, o.Amount)
+		if err != nil {
+			return err
+		}
+
+		for o.Next <= date && (o.End == 0 || o.Next <= o.End) {
+			concept := fmt.Sprintf("%s (SO #%d)", o.Concept, o.Id)
+			if _, _, err := orderTransfer(q, o.Debitor, o.Creditor, o.Amount, fee, o.Currency, concept, date, date); err != nil {
+				return err
+			}
+			o.Next += o.Period
+		}
+
+		if _, err := q.Exec("UPDATE standing_orders SET next_date = $1 WHERE id = $2;", o.Next, o.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+// Keeps the account page up to date without reloading it. The server sends
+// an event whenever something changes for the account; the page is then
+// fetched again and every part marked with data-live is swapped in place.
+(function () {
+  if (!window.EventSource || !window.fetch) {
+    return;
+  }
+
+  var lang = document.documentElement.lang;
+  var source = new EventSource("/a/" + lang + "/events/");
+
+  function refresh() {
+    fetch("/a/" + lang + "/account/", { credentials: "same-origin" })
+      .then(function (response) {
+        if (!response.ok) {
+          // Logged out or expired, nothing else to show
+          source.close();
+          throw response.status;
+        }
+        return response.text();
+      })
+      .then(function (html) {
+        var page = new DOMParser().parseFromString(html, "text/html");
+        document.querySelectorAll("[data-live]").forEach(function (old) {
+          var fresh = page.querySelector('[data-live="' + old.dataset.live + '"]');
+          if (!fresh) {
+            return;
+          }
+
+          old.replaceWith(fresh);
+          fresh.querySelectorAll("table.sortable").forEach(function (table) {
+            sorttable.makeSortable(table);
+          });
+        });
+      })
+      .catch(function () {});
+  }
+
+  ["clock", "transaction", "settlement", "letter", "invoice", "approval", "escrow", "standing", "balance", "account"].forEach(function (e) {
+    source.addEventListener(e, refresh);
+  });
+
+  source.addEventListener("logout", function () {
+    source.close();
+  });
+})();
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tax laws are rules the admin defines, and levies every time the clock
+// advances once they are enabled. A wealth tax takes a rate of the part of
+// the balance inside a bracket, an income tax the same of the credits
+// received since the previous date, and a poll tax a flat amount from
+// every account. Brackets are separate rules, so a progressive tax is a
+// few rules with adjacent brackets. Each rule posts its own transaction to
+// the vault, left for settlement like interest, in the default currency.
+// Income is what other accounts and cash deposits bring in: loans,
+// interest and exchanges come from the vault and are not taxed.
+const (
+	TAX_WEALTH = "wealth"
+	TAX_INCOME = "income"
+	TAX_POLL   = "poll"
+
+	// MAX_TAX_RATE is all of it, in basis points
+	MAX_TAX_RATE = 10000
+)
+
+type TaxRule struct {
+	Id      int64
+	Kind    string
+	Name    string
+	From    int64 // the bracket starts above this amount
+	To      int64 // and ends at this one, 0 for no end
+	Rate    int64 // basis points of the part inside the bracket
+	Amount  int64 // what a poll tax takes
+	Enabled bool
+}
+
+// tax computes what the rule takes from an account whose balance or
+// income is base, the rate rounded down. It is split by ten thousands so
+// that no multiplication overflows, however large the base.
+func (t TaxRule) tax(base int64) int64 {
+	if t.Kind == TAX_POLL {
+		return t.Amount
+	}
+
+	if base <= t.From {
+		return 0
+	}
+
+	if t.To > 0 && base > t.To {
+		base = t.To
+	}
+
+	// Rules added before the rate was checked never take more than all
+	rate := min(t.Rate, MAX_TAX_RATE)
+	part := base - t.From
+	return part/10000*rate + part%10000*rate/10000
+}
+
+// concept describes the transaction of the tax, such as "Land Act: wealth
+// tax on 1200.00".
+func (t TaxRule) concept(base int64, decimals int) string {
+	label := t.Kind + " tax"
+	if t.Kind != TAX_POLL {
+		label += " on " + formatAmount(base, decimals)
+	}
+
+	if t.Name == "" {
+		return strings.ToUpper(label[:1]) + label[1:]
+	}
+	return t.Name + ": " + label
+}
+
+// A TaxLevy is the tax one rule takes from one account.
+type TaxLevy struct {
+	Rule    int64
+	Account int64
+	Holder  string
+	Base    int64
+	Amount  int64
+	Concept string
+}
+
+func loadTaxRules(q dbtx, enabledOnly bool) ([]TaxRule, error) {
+	rows, err := q.Query("SELECT id, kind, name, bracket_from, bracket_to, rate, amount, enabled FROM tax_rules WHERE enabled = 1 OR $1 = 0 ORDER BY id ASC;", enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []TaxRule
+	for rows.Next() {
+		var t TaxRule
+		if err := rows.Scan(&t.Id, &t.Kind, &t.Name, &t.From, &t.To, &t.Rate, &t.Amount, &t.Enabled); err != nil {
+			return nil, err
+		}
+		rules = append(rules, t)
+	}
+
+	return rules, rows.Err()
+}
+
+func (b *Bank) GetTaxRules() ([]TaxRule, error) {
+	return loadTaxRules(b.db, false)
+}
+
+// AddTaxRule defines a rule, disabled so it can be previewed first, and
+// returns its id.
+func (b *Bank) AddTaxRule(t TaxRule) (int64, error) {
+	t.Name = strings.TrimSpace(t.Name)
+
+	switch t.Kind {
+	case TAX_WEALTH, TAX_INCOME:
+		if t.From < 0 || t.Rate < 0 || t.Rate > MAX_TAX_RATE || (t.To != 0 && t.To <= t.From) {
+			return 0, fmt.Errorf(ERR_TAX_RULE_INVALID)
+		}
+		t.Amount = 0
+	case TAX_POLL:
+		if t.Amount < 0 {
+			return 0, fmt.Errorf(ERR_TAX_RULE_INVALID)
+		}
+		t.From, t.To, t.Rate = 0, 0, 0
+	default:
+		return 0, fmt.Errorf(ERR_TAX_RULE_INVALID)
+	}
+
+	res, err := b.db.Exec("INSERT INTO tax_rules (kind, name, bracket_from, bracket_to, rate, amount) VALUES ($1, $2, $3, $4, $5, $6);",
+		t.Kind, t.Name, t.From, t.To, t.Rate, t.Amount)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// EnableTaxRule starts or stops levying a rule when the clock advances.
+func (b *Bank) EnableTaxRule(id int64, enabled bool) error {
+	res, err := b.db.Exec("UPDATE tax_rules SET enabled = $1 WHERE id = $2;", enabled, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf(ERR_TAX_RULE_NOT_FOUND)
+	}
+	return nil
+}
+
+func (b *Bank) RemoveTaxRule(id int64) error {
+	res, err := b.db.Exec("DELETE FROM tax_rules WHERE id = $1;", id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf(ERR_TAX_RULE_NOT_FOUND)
+	}
+	return nil
+}
+
+// taxIncome is what an account received, in the default currency, from
+// other accounts and cash deposits settled on or after since and before
+// date.
+func taxIncome(q dbtx, id int64, since uint64, date uint64) (int64, error) {
+	var income int64
+	err := q.QueryRow(`
+		SELECT coalesce(sum(amount), 0) FROM transactions
+		WHERE creditor = $1 AND debitor <> $2 AND currency = $3 AND payed = 1 AND revoked = 0
+		AND date_settled >= $4 AND date_settled < $5;`,
+		id, ACCOUNT_VAULT, DEFAULT_CURRENCY, since, date).Scan(&income)
+	return income, err
+}
+
+// assessTaxes works out what the rules take from every player account when
+// the clock advances to date, on the balance it holds coming into date and
+// the income since the previous advance.
+func assessTaxes(q dbtx, rules []TaxRule, date uint64) ([]TaxLevy, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var since uint64
+	if err := q.QueryRow("SELECT tax_date FROM system WHERE id = 1;").Scan(&since); err != nil {
+		return nil, err
+	}
+
+	decimals, err := loadDecimals(q)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query("SELECT id, holder FROM accounts WHERE id >= $1 ORDER BY id ASC;", ACCOUNT_MIN)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []TaxLevy
+	for rows.Next() {
+		var a TaxLevy
+		if err := rows.Scan(&a.Account, &a.Holder); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var levies []TaxLevy
+	for _, a := range accounts {
+		balance, err := ledgerBalance(q, a.Account, DEFAULT_CURRENCY)
+		if err != nil {
+			return nil, err
+		}
+
+		income, err := taxIncome(q, a.Account, since, date)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range rules {
+			l := a
+			l.Rule = t.Id
+
+			switch t.Kind {
+			case TAX_WEALTH:
+				l.Base = balance
+			case TAX_INCOME:
+				l.Base = income
+			}
+
+			if l.Amount = t.tax(l.Base); l.Amount <= 0 {
+				continue
+			}
+
+			l.Concept = t.concept(l.Base, decimals)
+			levies = append(levies, l)
+		}
+	}
+
+	return levies, nil
+}
+
+// levyTaxes posts, once per date, the taxes of the enabled rules. The
+// transactions are left for settlement, so an account that cannot pay
+// bounces them like any other.
+func levyTaxes(q dbtx, date uint64) error {
+	var last uint64
+	if err := q.QueryRow("SELECT tax_date FROM system WHERE id = 1;").Scan(&last); err != nil {
+		return err
+	}
+
+	if date <= last {
+		return nil
+	}
+
+	rules, err := loadTaxRules(q, true)
+	if err != nil {
+		return err
+	}
+
+	levies, err := assessTaxes(q, rules, date)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range levies {
+		if _, err = insertTransaction(q, ACCOUNT_VAULT, l.Account, l.Amount, DEFAULT_CURRENCY, l.Concept, date, date, false); err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec("UPDATE system SET tax_date = $1 WHERE id = 1;", date)
+	return err
+}
+
+// DryRunTaxes works out the taxes the next date advance would levy against
+// the ledger as it is now, without posting them. With no ids it runs the
+// enabled rules; otherwise the given ones, enabled or not.
+func (b *Bank) DryRunTaxes(ids []int64) ([]TaxLevy, error) {
+	rules, err := loadTaxRules(b.db, len(ids) == 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		var chosen []TaxRule
+		for _, id := range ids {
+			found := false
+			for _, t := range rules {
+				if t.Id == id {
+					chosen, found = append(chosen, t), true
+				}
+			}
+
+			if !found {
+				return nil, fmt.Errorf(ERR_TAX_RULE_NOT_FOUND)
+			}
+		}
+		rules = chosen
+	}
+
+	date, err := readClock(b.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return assessTaxes(b.db, rules, date+1)
+}
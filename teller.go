@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// Reserved accounts used internally by the bank when users make deposits or
+// withdrawals. The vault holds the "real" money of the bank, and the escrow
+// account what transfers in escrow hold until they are released.
+const (
+	ACCOUNT_ESCROW      int64 = -3
+	ACCOUNT_WITHDRAWALS int64 = -2
+	ACCOUNT_DEPOSITS    int64 = -1
+	ACCOUNT_VAULT       int64 = 0
+)
+
+// Player account numbers are drawn at random from this range, as the Lua
+// console always did.
+const (
+	ACCOUNT_MIN = 1000
+	ACCOUNT_MAX = 9999
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so ledger helpers can run
+// inside or outside of a database transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// BUSY_RETRIES is how many times a write is tried while another connection
+// (another request, or the admin command line) holds the database.
+const BUSY_RETRIES = 10
+
+// serializable runs fn in an immediate transaction: the write lock is taken
+// up front, so nothing fn reads can change before it commits. If another
+// writer holds the database it waits a little and runs fn again, so fn must
+// not have side effects outside of tx.
+func serializable(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runSerializable(db, fn)
+		if !errors.Is(err, sqlite3.BUSY) || attempt == BUSY_RETRIES {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+}
+
+func runSerializable(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateBank creates a new bank database with its reserved accounts, all of
+// them protected by the master password. It refuses to overwrite an existing file.
+func CreateBank(filename string, name string, withdrawals string, deposits string, vault string, escrow string, master string) (*Bank, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return nil, fmt.Errorf(ERR_BANK_EXISTS)
+	}
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := CreateHash(master)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("UPDATE system SET name = $1, clock = 0 WHERE id = 1;", name); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	reserved := map[int64]string{
+		ACCOUNT_WITHDRAWALS: withdrawals,
+		ACCOUNT_DEPOSITS:    deposits,
+		ACCOUNT_VAULT:       vault,
+		ACCOUNT_ESCROW:      escrow,
+	}
+
+	for id, holder := range reserved {
+		_, err = tx.Exec("INSERT INTO accounts (id, holder, date, password) VALUES ($1, $2, 0, $3);", id, holder, hash)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bank{db: db, letters: lettersDir(filename)}, nil
+}
+
+// insertTransaction is the single place where rows are added to the ledger.
+// Transactions inserted as payed are settled on their due date. Every row
+// is linked to the hash chain as it is inserted.
+func insertTransaction(q dbtx, creditor int64, debitor int64, amount int64, currency string, concept string, created uint64, due uint64, payed bool) (int64, error) {
+	insert := `
+		INSERT INTO transactions
+		(creditor, debitor, amount, concept, date_created, date_due, payed, revoked, date_settled, currency)
+		VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	var settled any
+	if payed {
+		settled = due
+	}
+
+	res, err := q.Exec(insert, creditor, debitor, amount, concept, created, due, payed, false, settled, currency)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = chainTransaction(q, id, creditor, debitor, amount, currency, concept, created, due); err != nil {
+		return 0, err
+	}
+
+	// Payed as it is ordered, its status is chained right after it
+	if payed {
+		err = chainStatus(q, id)
+	}
+	return id, err
+}
+
+// CreateAccount opens a new player account with a random account number.
+func (b *Bank) CreateAccount(holder string, password string) (int64, error) {
+	holder = strings.TrimSpace(holder)
+	if holder == "" {
+		return 0, fmt.Errorf(ERR_HOLDER_INVALID)
+	}
+
+	hash, err := CreateHash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	date := b.GetDate()
+
+	// Retry until we hit a free account number, the range is small on purpose
+	for tries := 0; tries <= ACCOUNT_MAX-ACCOUNT_MIN; tries++ {
+		id := int64(ACCOUNT_MIN + rand.Intn(ACCOUNT_MAX-ACCOUNT_MIN+1))
+
+		var exists int
+		err = b.db.QueryRow("SELECT count(*) FROM accounts WHERE id = $1;", id).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if exists > 0 {
+			continue
+		}
+
+		_, err = b.db.Exec("INSERT INTO accounts (id, holder, date, password) VALUES ($1, $2, $3, $4);", id, holder, date, hash)
+		if err != nil {
+			return 0, err
+		}
+
+		return id, nil
+	}
+
+	return 0, fmt.Errorf(ERR_NO_FREE_ACCOUNTS)
+}
+
+// Deposit brings cash into the bank: the deposits account pays both the
+// player's account and the vault.
+func (b *Bank) Deposit(id int64, amount int64, currency string, concept string) error {
+	if amount < 0 {
+		return fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	}
+
+	if id < ACCOUNT_MIN {
+		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := b.GetAccountHolder(id); err != nil {
+		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := loadCurrency(b.db, currency); err != nil {
+		return err
+	}
+
+	return serializable(b.db, func(tx *sql.Tx) error {
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		if _, err = insertTransaction(tx, id, ACCOUNT_DEPOSITS, amount, currency, concept, date, date, true); err != nil {
+			return err
+		}
+
+		_, err = insertTransaction(tx, ACCOUNT_VAULT, ACCOUNT_DEPOSITS, amount, currency, fmt.Sprintf("[%d]", id), date, date, true)
+		return err
+	})
+}
+
+// Withdraw takes cash out of the bank: both the player's account and the
+// vault pay the withdrawals account.
+func (b *Bank) Withdraw(id int64, amount int64, currency string, concept string) error {
+	if amount < 0 {
+		return fmt.Errorf(ERR_NEGATIVE_TRANSFER_AMOUNT)
+	}
+
+	if id < ACCOUNT_MIN {
+		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := b.GetAccountHolder(id); err != nil {
+		return fmt.Errorf(ERR_RECIPIENT_ACCOUNT_NOT_FOUND)
+	}
+
+	if _, err := loadCurrency(b.db, currency); err != nil {
+		return err
+	}
+
+	return serializable(b.db, func(tx *sql.Tx) error {
+		balance, err := ledgerBalance(tx, id, currency)
+		if err != nil {
+			return err
+		}
+
+		if balance < amount {
+			return fmt.Errorf(ERR_INSUFFICIENT_FUNDS)
+		}
+
+		vault, err := ledgerBalance(tx, ACCOUNT_VAULT, currency)
+		if err != nil {
+			return err
+		}
+
+		if vault < amount {
+			return fmt.Errorf(ERR_VAULT_INSUFFICIENT_FUNDS)
+		}
+
+		date, err := readClock(tx)
+		if err != nil {
+			return err
+		}
+
+		if _, err = insertTransaction(tx, ACCOUNT_WITHDRAWALS, id, amount, currency, concept, date, date, true); err != nil {
+			return err
+		}
+
+		_, err = insertTransaction(tx, ACCOUNT_WITHDRAWALS, ACCOUNT_VAULT, amount, currency, fmt.Sprintf("[%d]", id), date, date, true)
+		return err
+	})
+}
+
+// ForceRevoke revokes any unpayed transaction on behalf of the bank.
+func (b *Bank) ForceRevoke(transaction_id uint64) error {
+	t, err := b.getTransaction(transaction_id)
+	if err != nil {
+		return fmt.Errorf(ERR_TRANSACTION_NOT_FOUND)
+	}
+
+	if t.Payed {
+		return fmt.Errorf(ERR_REVOKE_NOT_ALLOWED)
+	}
+
+	// The fee of a transfer goes with it, but the bank may waive a fee alone
+	return serializable(b.db, func(tx *sql.Tx) error {
+		ids, err := transactionIds(tx, "id = $1 OR (fee_of = $1 AND payed = 0)", t.Id)
+		if err != nil {
+			return err
+		}
+
+		return setStatus(tx, ids, "revoked = 1")
+	})
+}
+
+type Statement struct {
+	Account *Account
+	Rows    []StatementRow
+	Totals  []StatementTotals
+}
+
+// StatementTotals add up the rows of a statement in one currency.
+type StatementTotals struct {
+	Currency     string
+	CreditsTotal int64
+	DebitsTotal  int64
+	Balance      int64
+	Cash         int64
+	Debt         int64
+}
+
+type StatementRow struct {
+	Id       int64
+	Created  uint64
+	Due      uint64
+	Concept  string
+	Amount   int64
+	Currency string
+	Creditor int64
+	Debitor  int64
+	Payed    bool
+	Failed   bool
+}
+
+// Statement builds the same financial statement the Lua console printed:
+// totals, cash (only payed transactions) and debt that cannot be covered.
+func (b *Bank) Statement(id int64) (*Statement, error) {
+	return b.StatementAsOf(id, b.GetDate())
+}
+
+// StatementAsOf builds the statement of an account as it was on date. The
+// totals are kept per currency, the default one always and the others if
+// the account ever used them.
+func (b *Bank) StatementAsOf(id int64, date uint64) (*Statement, error) {
+	a, err := b.LoadAccountAsOf(id, date)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+		}
+		return nil, err
+	}
+
+	rows, err := b.db.Query(`
+		SELECT id, date_created, date_due, coalesce(concept, ''), amount, currency, creditor, debitor,
+		payed = 1 AND coalesce(date_settled, date_due) <= $1,
+		failed = 1 AND coalesce(date_settled, date_due) <= $1
+		FROM transactions WHERE (creditor = $2 OR debitor = $3) AND revoked = 0 AND date_created <= $1
+		ORDER BY date_created DESC, id DESC;`, date, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s := &Statement{Account: a}
+
+	type unpayed struct {
+		credits int64
+		debits  int64
+	}
+	totals := map[string]*StatementTotals{}
+	pending := map[string]*unpayed{}
+
+	for rows.Next() {
+		var r StatementRow
+		if err := rows.Scan(&r.Id, &r.Created, &r.Due, &r.Concept, &r.Amount, &r.Currency, &r.Creditor, &r.Debitor, &r.Payed, &r.Failed); err != nil {
+			return nil, err
+		}
+
+		s.Rows = append(s.Rows, r)
+
+		t, ok := totals[r.Currency]
+		if !ok {
+			t = &StatementTotals{Currency: r.Currency}
+			totals[r.Currency] = t
+			pending[r.Currency] = &unpayed{}
+		}
+		u := pending[r.Currency]
+
+		// Failed transactions are listed but never count towards the totals
+		if r.Failed {
+			continue
+		}
+
+		if r.Debitor == id {
+			t.DebitsTotal += r.Amount
+			if r.Payed {
+				t.Cash -= r.Amount
+			} else {
+				u.debits += r.Amount
+			}
+		} else {
+			t.CreditsTotal += r.Amount
+			if r.Payed {
+				t.Cash += r.Amount
+			} else {
+				u.credits += r.Amount
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	currencies, err := loadCurrencies(b.db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range currencies {
+		t, ok := totals[c.Code]
+		if !ok {
+			if c.Code != DEFAULT_CURRENCY {
+				continue
+			}
+			t, pending[c.Code] = &StatementTotals{Currency: c.Code}, &unpayed{}
+		}
+
+		t.Balance = t.CreditsTotal - t.DebitsTotal
+		t.Debt = pending[c.Code].debits - pending[c.Code].credits - t.Cash
+		s.Totals = append(s.Totals, *t)
+	}
+
+	return s, nil
+}
+
+// GetAccounts lists every account, reserved ones included.
+func (b *Bank) GetAccounts() ([]Book, error) {
+	rows, err := b.db.Query("SELECT id, holder FROM accounts ORDER BY id ASC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var book []Book
+	for rows.Next() {
+		var bo Book
+		if err := rows.Scan(&bo.Id, &bo.Holder); err != nil {
+			return nil, err
+		}
+		book = append(book, bo)
+	}
+
+	return book, rows.Err()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A user is a player, apart from the accounts they use: one player may run
+// a personal account, a company and a treasury. Users log in with their own
+// name and password and then switch between the accounts linked to them,
+// each with a role. An owner does everything with the account and shares
+// it with other users, a signer moves its funds, and a viewer only looks.
+// Logging in with the number and password of an account still works, as
+// its owner. Logging in to the vault with the master password makes the
+// session the bank's own, with the admin role; it is never linked to users.
+const (
+	ROLE_OWNER  = "owner"
+	ROLE_SIGNER = "signer"
+	ROLE_VIEWER = "viewer"
+	ROLE_ADMIN  = "admin"
+)
+
+func validRole(role string) bool {
+	return role == ROLE_OWNER || role == ROLE_SIGNER || role == ROLE_VIEWER
+}
+
+// A LinkedAccount is an account a user can use, or a user who can use an
+// account, and the role they have.
+type LinkedAccount struct {
+	Id     int64
+	Holder string
+	User   string
+	Role   string
+}
+
+type User struct {
+	Id       int64
+	Name     string
+	Accounts []LinkedAccount
+}
+
+// CreateUser adds a user who logs in with name and password, or changes
+// the password of an existing one, and returns their id.
+func (b *Bank) CreateUser(name string, password string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, fmt.Errorf(ERR_USER_NOT_FOUND)
+	}
+
+	hash, err := CreateHash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = b.db.QueryRow("INSERT INTO users (name, password) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET password = excluded.password RETURNING id;",
+		name, hash).Scan(&id)
+	return id, err
+}
+
+func (b *Bank) getUserId(name string) (int64, error) {
+	var id int64
+	err := b.db.QueryRow("SELECT id FROM users WHERE name = $1;", name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf(ERR_USER_NOT_FOUND)
+	}
+	return id, err
+}
+
+// GetUsers lists every user with the accounts linked to them.
+func (b *Bank) GetUsers() ([]User, error) {
+	rows, err := b.db.Query("SELECT id, name FROM users ORDER BY name ASC;")
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Id, &u.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if users[i].Accounts, err = b.GetUserAccounts(users[i].Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (b *Bank) queryLinks(query string, arg int64) ([]LinkedAccount, error) {
+	rows, err := b.db.Query(`
+		SELECT l.account, a.holder, u.name, l.role
+		FROM user_accounts l JOIN accounts a ON a.id = l.account JOIN users u ON u.id = l.user_id
+		WHERE `+query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []LinkedAccount{}
+	for rows.Next() {
+		var l LinkedAccount
+		if err := rows.Scan(&l.Id, &l.Holder, &l.User, &l.Role); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
+
+// GetUserAccounts lists the accounts a user can switch to.
+func (b *Bank) GetUserAccounts(user int64) ([]LinkedAccount, error) {
+	return b.queryLinks("l.user_id = $1 ORDER BY l.account ASC;", user)
+}
+
+// GetAccountUsers lists the users an account is shared with.
+func (b *Bank) GetAccountUsers(account int64) ([]LinkedAccount, error) {
+	return b.queryLinks("l.account = $1 ORDER BY u.name ASC;", account)
+}
+
+// LinkUser lets the user called name use a player account with role, or
+// changes the role they have.
+func (b *Bank) LinkUser(name string, account int64, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf(ERR_ROLE_INVALID)
+	}
+
+	user, err := b.getUserId(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.GetAccountHolder(account); err != nil || account <= ACCOUNT_VAULT {
+		return fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+
+	_, err = b.db.Exec("INSERT INTO user_accounts (user_id, account, role) VALUES ($1, $2, $3) ON CONFLICT (user_id, account) DO UPDATE SET role = excluded.role;",
+		user, account, role)
+	return err
+}
+
+// UnlinkUser stops the user called name from using an account. Their
+// sessions on it end with the next request.
+func (b *Bank) UnlinkUser(name string, account int64) error {
+	user, err := b.getUserId(name)
+	if err != nil {
+		return err
+	}
+
+	res, err := b.db.Exec("DELETE FROM user_accounts WHERE user_id = $1 AND account = $2;", user, account)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf(ERR_USER_NOT_FOUND)
+	}
+	return nil
+}
+
+// AuthenticateUser checks the password of the user called name, and
+// returns their id.
+func (b *Bank) AuthenticateUser(name string, password string) (int64, bool) {
+	var id int64
+	var hash []byte
+	if err := b.db.QueryRow("SELECT id, password FROM users WHERE name = $1;", name).Scan(&id, &hash); err != nil {
+		return 0, false
+	}
+
+	return id, CheckPassword(password, hash)
+}
+
+// ChangeUserPass changes the password of the user called name.
+func (b *Bank) ChangeUserPass(name string, password string) error {
+	hash, err := CreateHash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec("UPDATE users SET password = $1 WHERE name = $2;", hash, name)
+	return err
+}
+
+// userRole is the role a user has on an account, ERR_ACCOUNT_NOT_FOUND_ADMIN
+// if it is not linked to them.
+func (b *Bank) userRole(user int64, account int64) (string, error) {
+	var role string
+	err := b.db.QueryRow("SELECT role FROM user_accounts WHERE user_id = $1 AND account = $2;", user, account).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+	return role, err
+}
+
+// firstAccount is the account a user starts on when they log in without
+// choosing one: the first they own, or else the first linked to them.
+func (b *Bank) firstAccount(user int64) (int64, error) {
+	var id int64
+	err := b.db.QueryRow("SELECT account FROM user_accounts WHERE user_id = $1 ORDER BY role <> $2, account ASC LIMIT 1;", user, ROLE_OWNER).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf(ERR_ACCOUNT_NOT_FOUND_ADMIN)
+	}
+	return id, err
+}
+
+// loadIdentity fills in who is using the account of a session: the user
+// and their role, the accounts they can switch to, and the users an owner
+// shares it with. A user no longer linked to the account is logged out.
+func (b *Bank) loadIdentity(a *Account, s session) error {
+	var err error
+
+	if s.user == 0 {
+		// A member removed from a joint account is logged out
+		a.Role = ROLE_OWNER
+		if a.Id == ACCOUNT_VAULT {
+			a.Role = ROLE_ADMIN
+		}
+		a.Member, err = b.sessionMember(a.Id, s.holder)
+		if err != nil {
+			return err
+		}
+	} else {
+		a.User = s.holder
+		if a.Role, err = b.userRole(s.user, a.Id); err != nil {
+			return err
+		}
+
+		if a.Linked, err = b.GetUserAccounts(s.user); err != nil {
+			return err
+		}
+
+		// On a joint account, a user linked to a member approves as one
+		if a.Member, err = b.userMember(a.Id, s.user); err != nil {
+			return err
+		}
+	}
+
+	if a.Role == ROLE_OWNER {
+		a.Users, err = b.GetAccountUsers(a.Id)
+	}
+	return err
+}
+
+// linkedTo tells if the user logged in can switch to the account id.
+func (a *Account) linkedTo(id int64) bool {
+	for _, l := range a.Linked {
+		if l.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSessionPass checks the password of whoever is logged in to a: the
+// user, the member of a joint account, or the account itself.
+func (b *Bank) checkSessionPass(a *Account, password string) bool {
+	if a.User != "" {
+		_, ok := b.AuthenticateUser(a.User, password)
+		return ok
+	}
+
+	_, ok := b.Authenticate(a.Id, a.Member, password)
+	return ok
+}
+
+// changeSessionPass changes the password of whoever is logged in to a, and
+// only theirs.
+func (b *Bank) changeSessionPass(a *Account, password string) error {
+	switch {
+	case a.User != "":
+		return b.ChangeUserPass(a.User, password)
+	case a.Member != "":
+		return b.AddMember(a.Id, a.Member, password)
+	default:
+		return b.ChangePass(a.Id, password)
+	}
+}